@@ -0,0 +1,393 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Dataset permissions granted by access control lists. Stream, extract and
+// delete imply view, since each of them reads the dataset.
+const (
+	permView    = "view"
+	permStream  = "stream"
+	permExtract = "extract"
+	permDelete  = "delete"
+)
+
+// authConfig enables authentication when any method is configured
+type authConfig struct {
+	APIKeys []apiKeyConfig `yaml:"apiKeys"`
+	JWT     *jwtConfig     `yaml:"jwt"`
+	OIDC    *oidcConfig    `yaml:"oidc"`
+	// Admins are subjects or "group:<name>" entries with every permission
+	Admins []string `yaml:"admins"`
+	// Datasets maps dataset names to their access control list; "*" is
+	// the list of datasets without one and of point clouds from outside /file/
+	Datasets map[string]datasetACL `yaml:"datasets"`
+	Signing  signingConfig         `yaml:"signing"`
+}
+
+// apiKeyConfig is a static API key, given in plain text or as a SHA-256 hex digest
+type apiKeyConfig struct {
+	Key       string   `yaml:"key"`
+	KeySHA256 string   `yaml:"keySha256"`
+	Subject   string   `yaml:"subject"`
+	Groups    []string `yaml:"groups"`
+}
+
+// jwtConfig validates JWTs against a local JWKS file
+type jwtConfig struct {
+	JWKSFile    string `yaml:"jwksFile"`
+	Issuer      string `yaml:"issuer"`
+	Audience    string `yaml:"audience"`
+	GroupsClaim string `yaml:"groupsClaim"` // defaults to "groups"
+}
+
+// oidcConfig validates tokens of an OpenID Connect provider
+type oidcConfig struct {
+	Issuer      string `yaml:"issuer"`
+	Audience    string `yaml:"audience"` // usually the client ID
+	GroupsClaim string `yaml:"groupsClaim"`
+}
+
+// datasetACL lists who holds each permission: subjects, "group:<name>"
+// entries, or "*" for every authenticated user
+type datasetACL struct {
+	View    []string `yaml:"view"`
+	Stream  []string `yaml:"stream"`
+	Extract []string `yaml:"extract"`
+	Delete  []string `yaml:"delete"`
+}
+
+// principal is an authenticated caller
+type principal struct {
+	Subject string
+	Groups  []string
+	admin   bool
+}
+
+// errNotMine tells that a credential is not of an authenticator's kind
+var errNotMine = errors.New("credential is not handled by this authenticator")
+
+// authenticator resolves a credential to a principal
+type authenticator interface {
+	authenticate(credential string) (*principal, error)
+}
+
+var (
+	authEnabled    bool
+	authenticators []authenticator
+
+	// localPrincipal is used for every request when authentication is off
+	localPrincipal = &principal{Subject: "local", admin: true}
+)
+
+// initAuth sets up the configured authenticators
+func initAuth(c *authConfig) error {
+	authenticators = []authenticator{browserTokens}
+	initSigning(&c.Signing)
+
+	if len(c.APIKeys) > 0 {
+		keys := apiKeys{}
+		for i, k := range c.APIKeys {
+			digest := k.KeySHA256
+			if k.Key != "" {
+				sum := sha256.Sum256([]byte(k.Key))
+				digest = hex.EncodeToString(sum[:])
+			}
+			if len(digest) != sha256.Size*2 || k.Subject == "" {
+				return fmt.Errorf("auth.apiKeys[%d] needs a key or keySha256 and a subject", i)
+			}
+			keys[strings.ToLower(digest)] = &principal{Subject: k.Subject, Groups: k.Groups}
+		}
+		authenticators = append(authenticators, keys)
+	}
+	if c.JWT != nil {
+		keys, err := loadJWKSFile(c.JWT.JWKSFile)
+		if err != nil {
+			return fmt.Errorf("auth.jwt: %w", err)
+		}
+		authenticators = append(authenticators, &jwtAuthenticator{
+			keys: keys, issuer: c.JWT.Issuer, audience: c.JWT.Audience, groupsClaim: cmp.Or(c.JWT.GroupsClaim, "groups"),
+		})
+	}
+	if c.OIDC != nil {
+		if c.OIDC.Issuer == "" || c.OIDC.Audience == "" {
+			return errors.New("auth.oidc needs an issuer and an audience")
+		}
+		keys, err := discoverOIDC(c.OIDC.Issuer)
+		if err != nil {
+			return fmt.Errorf("auth.oidc: %w", err)
+		}
+		authenticators = append(authenticators, &jwtAuthenticator{
+			keys: keys, issuer: c.OIDC.Issuer, audience: c.OIDC.Audience, groupsClaim: cmp.Or(c.OIDC.GroupsClaim, "groups"),
+		})
+	}
+
+	authEnabled = len(authenticators) > 1
+	if !authEnabled {
+		slog.Warn("Authentication is disabled, every client has full access")
+	} else if len(c.Datasets) == 0 {
+		slog.Warn("No dataset access control lists are configured, only admins can use datasets")
+	}
+	return nil
+}
+
+// apiKeys maps SHA-256 hex digests of API keys to their principals
+type apiKeys map[string]*principal
+
+func (k apiKeys) authenticate(credential string) (*principal, error) {
+	sum := sha256.Sum256([]byte(credential))
+	p, ok := k[hex.EncodeToString(sum[:])]
+	if !ok {
+		return nil, errNotMine
+	}
+	return p, nil
+}
+
+// tokenStore holds random tokens issued by the server itself, such as the
+// one the streaming browser uses to load datasets for its session's owner
+type tokenStore struct {
+	mu     sync.Mutex
+	tokens map[string]*principal
+}
+
+var browserTokens = &tokenStore{tokens: map[string]*principal{}}
+
+// issue returns a new token acting as p
+func (s *tokenStore) issue(p *principal) string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	token := hex.EncodeToString(b)
+	s.mu.Lock()
+	s.tokens[token] = p
+	s.mu.Unlock()
+	return token
+}
+
+// revoke invalidates a token
+func (s *tokenStore) revoke(token string) {
+	s.mu.Lock()
+	delete(s.tokens, token)
+	s.mu.Unlock()
+}
+
+func (s *tokenStore) authenticate(credential string) (*principal, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.tokens[credential]
+	if !ok {
+		return nil, errNotMine
+	}
+	return p, nil
+}
+
+// credential returns the API key or bearer token of a request. EventSource
+// and media elements cannot set headers, so access_token is accepted too.
+func credential(r *http.Request) string {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(token)
+	}
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	return r.URL.Query().Get("access_token")
+}
+
+type principalKey struct{}
+
+// authenticate attaches the caller's principal to requests that carry a
+// credential and rejects invalid credentials. Routes decide whether they
+// need a principal.
+func authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !authEnabled {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, localPrincipal)))
+			return
+		}
+		cred := credential(r)
+		if cred == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		for _, a := range authenticators {
+			p, err := a.authenticate(cred)
+			if errors.Is(err, errNotMine) {
+				continue
+			}
+			if err != nil {
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+				requestLog(r).Warn("Error authenticating request", "error", err)
+				return
+			}
+			caller := *p
+			caller.admin = p.admin || p.matches(cfg.Auth.Admins)
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, &caller)))
+			return
+		}
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+	})
+}
+
+// principalFrom returns the caller of a request, nil when anonymous
+func principalFrom(r *http.Request) *principal {
+	p, _ := r.Context().Value(principalKey{}).(*principal)
+	return p
+}
+
+// matches reports whether an entry of a list names the principal
+func (p *principal) matches(entries []string) bool {
+	for _, e := range entries {
+		if group, ok := strings.CutPrefix(e, "group:"); ok {
+			if slices.Contains(p.Groups, group) {
+				return true
+			}
+		} else if e == "*" || e == p.Subject {
+			return true
+		}
+	}
+	return false
+}
+
+// allowed reports whether the principal holds a permission on a dataset
+func (p *principal) allowed(dataset, perm string) bool {
+	// "*" is the fallback ACL, not a dataset, and "" names none
+	if dataset == "" || dataset == "*" {
+		return false
+	}
+	acl, ok := cfg.Auth.Datasets[dataset]
+	if !ok {
+		acl, ok = cfg.Auth.Datasets["*"]
+	}
+	return p.granted(acl, ok, perm)
+}
+
+// allowedExternal reports whether the principal holds a permission on
+// point clouds served from elsewhere than /file/, which fall under the
+// fallback ACL
+func (p *principal) allowedExternal(perm string) bool {
+	acl, ok := cfg.Auth.Datasets["*"]
+	return p.granted(acl, ok, perm)
+}
+
+// granted reports whether an ACL gives the principal a permission; admins
+// hold every permission, and without an ACL nobody else holds any
+func (p *principal) granted(acl datasetACL, ok bool, perm string) bool {
+	if p == nil {
+		return false
+	}
+	if p.admin {
+		return true
+	}
+	if !ok {
+		return false
+	}
+	switch perm {
+	case permView:
+		return p.matches(acl.View) || p.matches(acl.Stream) || p.matches(acl.Extract) || p.matches(acl.Delete)
+	case permStream:
+		return p.matches(acl.Stream)
+	case permExtract:
+		return p.matches(acl.Extract)
+	case permDelete:
+		return p.matches(acl.Delete)
+	}
+	return false
+}
+
+// authorize checks a permission for the caller and responds with 401 or
+// 403 when it is missing
+func authorize(w http.ResponseWriter, r *http.Request, dataset, perm string) bool {
+	p, ok := authenticated(w, r)
+	if ok && !p.allowed(dataset, perm) {
+		http.Error(w, "Not allowed to "+perm+" dataset "+dataset, http.StatusForbidden)
+		return false
+	}
+	return ok
+}
+
+// authorizeExternal is authorize for point clouds served from elsewhere than /file/
+func authorizeExternal(w http.ResponseWriter, r *http.Request, perm string) bool {
+	p, ok := authenticated(w, r)
+	if ok && !p.allowedExternal(perm) {
+		http.Error(w, "Not allowed to "+perm+" point clouds from outside the data directory", http.StatusForbidden)
+		return false
+	}
+	return ok
+}
+
+// authenticated returns the caller, responding with 401 when anonymous
+func authenticated(w http.ResponseWriter, r *http.Request) (*principal, bool) {
+	p := principalFrom(r)
+	if p == nil {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Authentication required", http.StatusUnauthorized)
+		return nil, false
+	}
+	return p, true
+}
+
+// owns reports whether the principal may control something owner started
+func (p *principal) owns(owner *principal) bool {
+	return p != nil && (p.admin || owner != nil && owner.Subject == p.Subject)
+}
+
+// requireUser rejects anonymous requests
+func requireUser(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := authenticated(w, r); ok {
+			h(w, r)
+		}
+	}
+}
+
+// requireDataset checks a permission on the {name} dataset of a route
+func requireDataset(perm string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if authorize(w, r, r.PathValue("name"), perm) {
+			h(w, r)
+		}
+	}
+}
+
+// requireDataFile accepts a signed URL or checks the view permission on the
+// dataset of a /file/ path
+func requireDataFile(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if signed, _, ok := checkSignature(w, r, r.URL.Path); signed {
+			if ok {
+				h.ServeHTTP(w, r)
+			}
+			return
+		}
+		// only files inside a dataset directory are served, never the data
+		// root or files next to the datasets
+		name, _, nested := strings.Cut(strings.TrimPrefix(r.URL.Path, "/file/"), "/")
+		dir, err := datasetDir(name)
+		if err == nil && !nested {
+			if info, statErr := os.Stat(dir); statErr != nil || !info.IsDir() {
+				err = errDatasetNotFound
+			}
+		}
+		if err != nil {
+			http.Error(w, "Dataset not found", http.StatusNotFound)
+			return
+		}
+		if authorize(w, r, name, permView) {
+			h.ServeHTTP(w, r)
+		}
+	})
+}
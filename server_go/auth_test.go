@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// withPrincipal returns r as sent by p
+func withPrincipal(r *http.Request, p *principal) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), principalKey{}, p))
+}
+
+// withACLs replaces the dataset access lists until the test ends
+func withACLs(t *testing.T, acls map[string]datasetACL) {
+	old := cfg.Auth.Datasets
+	cfg.Auth.Datasets = acls
+	t.Cleanup(func() { cfg.Auth.Datasets = old })
+}
+
+func TestPrincipalAllowed(t *testing.T) {
+	withACLs(t, map[string]datasetACL{
+		"*":      {View: []string{"*"}},
+		"survey": {View: []string{"bob"}, Stream: []string{"group:surveyors"}, Extract: []string{"alice"}},
+		"closed": {},
+	})
+	alice := &principal{Subject: "alice"}
+	bob := &principal{Subject: "bob"}
+	carol := &principal{Subject: "carol", Groups: []string{"surveyors"}}
+	admin := &principal{Subject: "root", admin: true}
+
+	tests := []struct {
+		p       *principal
+		dataset string
+		perm    string
+		want    bool
+	}{
+		{nil, "survey", permView, false},
+		{alice, "survey", permView, true}, // extract implies view
+		{alice, "survey", permExtract, true},
+		{alice, "survey", permStream, false},
+		{bob, "survey", permView, true},
+		{bob, "survey", permExtract, false},
+		{carol, "survey", permStream, true},
+		{carol, "survey", permDelete, false},
+		{alice, "other", permView, true}, // "*" applies without an ACL
+		{alice, "other", permExtract, false},
+		{alice, "closed", permView, false}, // an ACL replaces "*"
+		{admin, "closed", permDelete, true},
+		{alice, "", permView, false},
+		{alice, "*", permView, false}, // "*" from a request path names no dataset
+		{admin, "*", permView, false},
+		{admin, "", permView, false},
+		{alice, "survey", "unknown", false},
+	}
+	for _, tt := range tests {
+		subject := "anonymous"
+		if tt.p != nil {
+			subject = tt.p.Subject
+		}
+		if got := tt.p.allowed(tt.dataset, tt.perm); got != tt.want {
+			t.Errorf("%s may %s %q = %v, want %v", subject, tt.perm, tt.dataset, got, tt.want)
+		}
+	}
+}
+
+func TestPrincipalAllowedExternal(t *testing.T) {
+	alice := &principal{Subject: "alice"}
+	carol := &principal{Subject: "carol", Groups: []string{"surveyors"}}
+	admin := &principal{Subject: "root", admin: true}
+	fallback := map[string]datasetACL{
+		"*":      {View: []string{"*"}, Stream: []string{"group:surveyors"}},
+		"survey": {Stream: []string{"alice"}},
+	}
+
+	tests := []struct {
+		name string
+		acls map[string]datasetACL
+		p    *principal
+		perm string
+		want bool
+	}{
+		{"admin", fallback, admin, permStream, true},
+		{"auth off", nil, localPrincipal, permStream, true},
+		{"admin without fallback", map[string]datasetACL{}, admin, permStream, true},
+		{"in fallback", fallback, carol, permStream, true},
+		{"view only", fallback, alice, permStream, false}, // a dataset ACL does not count
+		{"view", fallback, alice, permView, true},
+		{"without fallback", map[string]datasetACL{"survey": {Stream: []string{"*"}}}, carol, permStream, false},
+		{"anonymous", fallback, nil, permView, false},
+	}
+	for _, tt := range tests {
+		withACLs(t, tt.acls)
+		if got := tt.p.allowedExternal(tt.perm); got != tt.want {
+			t.Errorf("%s: allowedExternal(%s) = %v, want %v", tt.name, tt.perm, got, tt.want)
+		}
+	}
+}
+
+func TestRequireDataFile(t *testing.T) {
+	data := t.TempDir()
+	defer func(dir string) { cfg.DataDir = dir }(cfg.DataDir)
+	cfg.DataDir = data
+	os.Mkdir(filepath.Join(data, "survey"), 0o755)
+	os.Mkdir(filepath.Join(data, "closed"), 0o755)
+	os.WriteFile(filepath.Join(data, "survey", "metadata.json"), []byte("{}"), 0o644)
+	os.WriteFile(filepath.Join(data, "notes.txt"), []byte("secret"), 0o644)
+	withACLs(t, map[string]datasetACL{"*": {View: []string{"*"}}, "closed": {}})
+
+	h := requireDataFile(http.StripPrefix("/file/", http.FileServer(http.Dir(data))))
+	alice := &principal{Subject: "alice"}
+	tests := []struct {
+		path string
+		p    *principal
+		want int
+	}{
+		{"/file/survey/metadata.json", alice, http.StatusOK},
+		{"/file/survey/metadata.json", nil, http.StatusUnauthorized},
+		{"/file/survey", alice, http.StatusMovedPermanently}, // to the directory
+		{"/file/", alice, http.StatusNotFound},
+		{"/file/notes.txt", alice, http.StatusNotFound},
+		{"/file/missing/metadata.json", alice, http.StatusNotFound},
+		{"/file/closed/metadata.json", alice, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, withPrincipal(httptest.NewRequest("GET", tt.path, nil), tt.p))
+		if rec.Code != tt.want {
+			t.Errorf("GET %s = %d, want %d", tt.path, rec.Code, tt.want)
+		}
+	}
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+)
+
+// pointGrid is a uniform hash grid over points for radius and nearest neighbour queries
+type pointGrid struct {
+	cell  float64
+	pts   [][3]float64
+	cells map[[3]int32][]int32
+}
+
+func newPointGrid(pts [][3]float64, cell float64) *pointGrid {
+	g := &pointGrid{cell: cell, pts: pts, cells: map[[3]int32][]int32{}}
+	for i, p := range pts {
+		k := g.key(p)
+		g.cells[k] = append(g.cells[k], int32(i))
+	}
+	return g
+}
+
+func (g *pointGrid) key(p [3]float64) [3]int32 {
+	return [3]int32{int32(math.Floor(p[0] / g.cell)), int32(math.Floor(p[1] / g.cell)), int32(math.Floor(p[2] / g.cell))}
+}
+
+// within calls fn for every point closer than radius to p
+func (g *pointGrid) within(p [3]float64, radius float64, fn func(q [3]float64)) {
+	k := g.key(p)
+	r := int32(math.Ceil(radius / g.cell))
+	for x := k[0] - r; x <= k[0]+r; x++ {
+		for y := k[1] - r; y <= k[1]+r; y++ {
+			for z := k[2] - r; z <= k[2]+r; z++ {
+				for _, i := range g.cells[[3]int32{x, y, z}] {
+					q := g.pts[i]
+					if dist3(p, q) <= radius {
+						fn(q)
+					}
+				}
+			}
+		}
+	}
+}
+
+// nearest returns the distance to the closest point, searching shells of
+// cells outwards up to maxDistance; ok is false if there is none in range
+func (g *pointGrid) nearest(p [3]float64, maxDistance float64) (float64, bool) {
+	k := g.key(p)
+	best := math.Inf(1)
+	rings := int32(math.Ceil(maxDistance / g.cell))
+	for r := int32(0); r <= rings; r++ {
+		for x := k[0] - r; x <= k[0]+r; x++ {
+			for y := k[1] - r; y <= k[1]+r; y++ {
+				for z := k[2] - r; z <= k[2]+r; z++ {
+					// only the surface of the shell is new
+					if r > 0 && x != k[0]-r && x != k[0]+r && y != k[1]-r && y != k[1]+r && z != k[2]-r && z != k[2]+r {
+						continue
+					}
+					for _, i := range g.cells[[3]int32{x, y, z}] {
+						best = math.Min(best, dist3(p, g.pts[i]))
+					}
+				}
+			}
+		}
+		// every point outside this shell is at least r cells away
+		if best <= float64(r)*g.cell {
+			break
+		}
+	}
+	return best, best <= maxDistance
+}
+
+func dist3(a, b [3]float64) float64 {
+	return math.Sqrt((a[0]-b[0])*(a[0]-b[0]) + (a[1]-b[1])*(a[1]-b[1]) + (a[2]-b[2])*(a[2]-b[2]))
+}
+
+// smallestEigenvector returns the eigenvector of the smallest eigenvalue of
+// a symmetric 3x3 matrix, using cyclic Jacobi rotations
+func smallestEigenvector(a [3][3]float64) [3]float64 {
+	v := [3][3]float64{{1, 0, 0}, {0, 1, 0}, {0, 0, 1}}
+	for sweep := 0; sweep < 16; sweep++ {
+		off := a[0][1]*a[0][1] + a[0][2]*a[0][2] + a[1][2]*a[1][2]
+		if off < 1e-20 {
+			break
+		}
+		for p := 0; p < 2; p++ {
+			for q := p + 1; q < 3; q++ {
+				if a[p][q] == 0 {
+					continue
+				}
+				theta := (a[q][q] - a[p][p]) / (2 * a[p][q])
+				t := math.Copysign(1, theta) / (math.Abs(theta) + math.Sqrt(theta*theta+1))
+				c := 1 / math.Sqrt(t*t+1)
+				s := t * c
+				for k := 0; k < 3; k++ {
+					akp, akq := a[k][p], a[k][q]
+					a[k][p], a[k][q] = c*akp-s*akq, s*akp+c*akq
+				}
+				for k := 0; k < 3; k++ {
+					apk, aqk := a[p][k], a[q][k]
+					a[p][k], a[q][k] = c*apk-s*aqk, s*apk+c*aqk
+				}
+				for k := 0; k < 3; k++ {
+					vkp, vkq := v[k][p], v[k][q]
+					v[k][p], v[k][q] = c*vkp-s*vkq, s*vkp+c*vkq
+				}
+			}
+		}
+	}
+	smallest := 0
+	for i := 1; i < 3; i++ {
+		if a[i][i] < a[smallest][smallest] {
+			smallest = i
+		}
+	}
+	return [3]float64{v[0][smallest], v[1][smallest], v[2][smallest]}
+}
+
+// surfaceNormal fits a plane through the points by PCA, oriented upwards
+func surfaceNormal(pts [][3]float64) [3]float64 {
+	var c [3]float64
+	for _, p := range pts {
+		for k := 0; k < 3; k++ {
+			c[k] += p[k] / float64(len(pts))
+		}
+	}
+	var cov [3][3]float64
+	for _, p := range pts {
+		d := [3]float64{p[0] - c[0], p[1] - c[1], p[2] - c[2]}
+		for i := 0; i < 3; i++ {
+			for j := 0; j < 3; j++ {
+				cov[i][j] += d[i] * d[j]
+			}
+		}
+	}
+	n := smallestEigenvector(cov)
+	if n[2] < 0 {
+		n = [3]float64{-n[0], -n[1], -n[2]}
+	}
+	return n
+}
+
+// changeOptions configures a change detection job
+type changeOptions struct {
+	Compare string `json:"compare"` // the later epoch, compared against the dataset in the URL
+	Output  string `json:"output"`  // name of the new dataset
+	Method  string `json:"method"`  // "c2c" (default) or "m3c2"
+	LOD     *int   `json:"lod"`
+
+	// C2C: nearest neighbour distances are capped at MaxDistance
+	MaxDistance float64 `json:"maxDistance"`
+
+	// M3C2: normals are fitted within NormalRadius, distances are measured
+	// in a cylinder of ProjectionRadius reaching MaxDepth along the normal
+	NormalRadius     float64 `json:"normalRadius"`
+	ProjectionRadius float64 `json:"projectionRadius"`
+	MaxDepth         float64 `json:"maxDepth"`
+}
+
+// defaults fills unset distances from the spacing of the finest level read
+func (o *changeOptions) defaults(d *potreeDataset) error {
+	if o.Method == "" {
+		o.Method = "c2c"
+	}
+	if o.Method != "c2c" && o.Method != "m3c2" {
+		return errors.New("method must be c2c or m3c2")
+	}
+	depth := d.meta.Hierarchy.Depth
+	if o.LOD != nil && *o.LOD >= 0 && *o.LOD < depth {
+		depth = *o.LOD
+	}
+	s := d.spacingAt(depth)
+	for _, v := range []struct {
+		value    *float64
+		fallback float64
+	}{
+		{&o.MaxDistance, 16 * s},
+		{&o.NormalRadius, 4 * s},
+		{&o.ProjectionRadius, 2 * s},
+		{&o.MaxDepth, 16 * s},
+	} {
+		if *v.value < 0 {
+			return errors.New("distances must not be negative")
+		}
+		if *v.value == 0 {
+			*v.value = v.fallback
+		}
+	}
+	return nil
+}
+
+// changeReport summarises the distances of a change detection job
+type changeReport struct {
+	Reference    string        `json:"reference"`
+	Compared     string        `json:"compared"`
+	Output       string        `json:"output"`
+	Options      changeOptions `json:"options"`
+	Points       int64         `json:"points"`
+	Undetermined int64         `json:"undetermined"` // no neighbours in range
+	Mean         float64       `json:"mean"`
+	StdDev       float64       `json:"stdDev"`
+	RMS          float64       `json:"rms"`
+	Min          float64       `json:"min"`
+	Max          float64       `json:"max"`
+	Histogram    *histogram    `json:"histogram"`
+	// ColorBy is the attribute to pass as colorMode to /start
+	ColorBy string `json:"colorBy"`
+}
+
+// loadPositions reads all positions of a dataset up to maxLevel
+func loadPositions(ctx context.Context, d *potreeDataset, maxLevel int) ([][3]float64, error) {
+	var pts [][3]float64
+	err := d.forEachPointIn(ctx, &region{bounds: d.bounds()}, maxLevel, func(p *point) error {
+		pts = append(pts, [3]float64{p.X, p.Y, p.Z})
+		return nil
+	})
+	return pts, err
+}
+
+// detectChanges writes the compared dataset with a distance attribute to
+// the reference. Undetermined points get the C2C cap or 0 for M3C2.
+func detectChanges(ctx context.Context, ref, cmp *potreeDataset, opts changeOptions) (*changeReport, error) {
+	maxLevel := -1
+	if opts.LOD != nil {
+		maxLevel = *opts.LOD
+	}
+	jobLogf(ctx, "Loading %s", ref.name)
+	refPts, err := loadPositions(progressStage(ctx, 0, 0.1), ref, maxLevel)
+	if err != nil {
+		return nil, err
+	}
+	if len(refPts) == 0 {
+		return nil, errors.New("reference dataset has no points")
+	}
+
+	var refGrid, cmpGrid *pointGrid
+	var distance func(p [3]float64) (float64, bool)
+	switch opts.Method {
+	case "c2c":
+		refGrid = newPointGrid(refPts, opts.MaxDistance/8)
+		distance = func(p [3]float64) (float64, bool) {
+			d, ok := refGrid.nearest(p, opts.MaxDistance)
+			if !ok {
+				return opts.MaxDistance, false
+			}
+			return d, true
+		}
+	case "m3c2":
+		jobLogf(ctx, "Loading %s", cmp.name)
+		cmpPts, err := loadPositions(progressStage(ctx, 0.1, 0.2), cmp, maxLevel)
+		if err != nil {
+			return nil, err
+		}
+		refGrid = newPointGrid(refPts, opts.NormalRadius)
+		cmpGrid = newPointGrid(cmpPts, opts.NormalRadius)
+		distance = func(p [3]float64) (float64, bool) {
+			var local [][3]float64
+			refGrid.within(p, opts.NormalRadius, func(q [3]float64) { local = append(local, q) })
+			if len(local) < 3 {
+				return 0, false
+			}
+			n := surfaceNormal(local)
+			// mean position of each epoch along the normal inside the cylinder
+			reach := math.Hypot(opts.ProjectionRadius, opts.MaxDepth)
+			project := func(g *pointGrid) (float64, bool) {
+				var sum float64
+				var count int
+				g.within(p, reach, func(q [3]float64) {
+					d := [3]float64{q[0] - p[0], q[1] - p[1], q[2] - p[2]}
+					along := d[0]*n[0] + d[1]*n[1] + d[2]*n[2]
+					radial := math.Sqrt(math.Max(0, d[0]*d[0]+d[1]*d[1]+d[2]*d[2]-along*along))
+					if radial <= opts.ProjectionRadius && math.Abs(along) <= opts.MaxDepth {
+						sum += along
+						count++
+					}
+				})
+				return sum / float64(count), count > 0
+			}
+			m1, ok1 := project(refGrid)
+			m2, ok2 := project(cmpGrid)
+			if !ok1 || !ok2 {
+				return 0, false
+			}
+			return m2 - m1, true
+		}
+	}
+
+	report := &changeReport{
+		Reference: ref.name,
+		Compared:  cmp.name,
+		Output:    opts.Output,
+		Options:   opts,
+		Min:       math.Inf(1),
+		Max:       math.Inf(-1),
+		ColorBy:   "distance",
+	}
+	var sum, sumSquares float64
+	var values []float64
+
+	distanceAttr := newAttribute("distance", "float", 1)
+	distanceAttr.Description = "Distance to " + ref.name + " (" + opts.Method + ")"
+	jobLogf(ctx, "Computing %s distances of %d points", opts.Method, cmp.meta.Points)
+	err = deriveDataset(progressStage(ctx, 0.2, 1), cmp, opts.Output, "Changes of "+cmp.name+" relative to "+ref.name,
+		[]potreeAttribute{distanceAttr},
+		func(n *octreeNode, pts []point, records [][]byte, offsets map[string]int) error {
+			dists := make([]float64, len(pts))
+			determined := make([]bool, len(pts))
+
+			// points of a node are independent, spread them over all cores
+			var wg sync.WaitGroup
+			workers := runtime.NumCPU()
+			for w := 0; w < workers; w++ {
+				wg.Add(1)
+				go func(w int) {
+					defer wg.Done()
+					for i := w; i < len(pts); i += workers {
+						dists[i], determined[i] = distance([3]float64{pts[i].X, pts[i].Y, pts[i].Z})
+					}
+				}(w)
+			}
+			wg.Wait()
+
+			for i, d := range dists {
+				distanceAttr.putValue(records[i][offsets["distance"]:], 0, d)
+				report.Points++
+				if !determined[i] {
+					report.Undetermined++
+					continue
+				}
+				sum += d
+				sumSquares += d * d
+				report.Min = math.Min(report.Min, d)
+				report.Max = math.Max(report.Max, d)
+				values = append(values, d)
+			}
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	valid := float64(len(values))
+	if valid == 0 {
+		report.Min, report.Max = 0, 0
+		report.Histogram = newHistogram(0, 0)
+		return report, nil
+	}
+	report.Mean = sum / valid
+	report.RMS = math.Sqrt(sumSquares / valid)
+	report.StdDev = math.Sqrt(math.Max(0, sumSquares/valid-report.Mean*report.Mean))
+	report.Histogram = newHistogram(report.Min, report.Max)
+	for _, v := range values {
+		report.Histogram.add(v)
+	}
+	return report, nil
+}
+
+// compareDatasets handles POST /datasets/{name}/changes and starts a change
+// detection job against a later epoch of the same site
+func compareDatasets(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+
+	var opts changeOptions
+	if err := json.NewDecoder(r.Body).Decode(&opts); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	outputDir, err := datasetDir(opts.Output)
+	if err != nil {
+		http.Error(w, "output must be a valid dataset name", http.StatusBadRequest)
+		return
+	}
+	if _, err := os.Stat(outputDir); err == nil {
+		http.Error(w, "Output dataset already exists", http.StatusConflict)
+		return
+	}
+
+	ref, ok := openDatasetForRequest(w, name)
+	if !ok {
+		return
+	}
+	if !authorize(w, r, opts.Compare, permView) {
+		return
+	}
+	cmp, ok := openDatasetForRequest(w, opts.Compare)
+	if !ok {
+		return
+	}
+	if err := opts.defaults(ref); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	refCRS, err1 := ref.crs()
+	cmpCRS, err2 := cmp.crs()
+	if err1 == nil && err2 == nil && refCRS.EPSG != 0 && cmpCRS.EPSG != 0 && refCRS.EPSG != cmpCRS.EPSG {
+		http.Error(w, "Datasets use different coordinate systems", http.StatusUnprocessableEntity)
+		return
+	}
+
+	j := startJob("changes", name, func(ctx context.Context, dir string) ([]string, error) {
+		report, err := detectChanges(ctx, ref, cmp, opts)
+		if err != nil {
+			return nil, err
+		}
+		raw, err := json.MarshalIndent(report, "", "\t")
+		if err != nil {
+			return nil, err
+		}
+		return []string{"report.json"}, os.WriteFile(filepath.Join(dir, "report.json"), raw, 0o644)
+	})
+	writeJob(w, http.StatusAccepted, j)
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// config holds the server settings. They are read from a YAML file, then
+// overridden by GIS_* environment variables and then by command line flags.
+type config struct {
+	Listen string `yaml:"listen"`
+	// PublicURL is how the browser on this machine reaches the server; FFmpeg
+	// uploads to the listen address
+	PublicURL   string   `yaml:"publicUrl"`
+	CORSOrigins []string `yaml:"corsOrigins"`
+	DataDir     string   `yaml:"dataDir"`
+	PotreeDir   string   `yaml:"potreeDir"`
+	JobsDir     string   `yaml:"jobsDir"`
+	JobWorkers  int      `yaml:"jobWorkers"` // 0 uses half of the CPUs
+	// LASzip is the laszip executable; LAZ output and laszip EPT data are
+	// unavailable when it is not found
+	LASzip string `yaml:"laszip"`
+	// StateFile records the processes and directories the server creates,
+	// so the next start cleans up after a crash
+	StateFile string `yaml:"stateFile"`
+	// ShutdownTimeout is how long stopping the sessions and requests may take
+	ShutdownTimeout time.Duration `yaml:"shutdownTimeout"`
+
+	Browser browserConfig `yaml:"browser"`
+	FFmpeg  ffmpegConfig  `yaml:"ffmpeg"`
+	Auth    authConfig    `yaml:"auth"`
+	Limits  limitsConfig  `yaml:"limits"`
+	Log     logConfig     `yaml:"log"`
+}
+
+// browserConfig configures the Chrome window that renders the viewer
+type browserConfig struct {
+	// ViewerPath is the viewer page below PublicURL
+	ViewerPath string `yaml:"viewerPath"`
+	// SettleTime is how long the window gets to render before capture starts
+	SettleTime time.Duration `yaml:"settleTime"`
+	// LoadTimeout is how long /start waits for the point clouds to load
+	LoadTimeout time.Duration `yaml:"loadTimeout"`
+}
+
+// ffmpegConfig configures the screen capture and HLS encoder
+type ffmpegConfig struct {
+	Path        string `yaml:"path"`
+	InputFormat string `yaml:"inputFormat"` // e.g. dshow, gdigrab or x11grab
+	Input       string `yaml:"input"`
+	FrameRate   int    `yaml:"frameRate"`
+	Width       int    `yaml:"width"` // output resolution
+	Height      int    `yaml:"height"`
+	// CropOffsetY skips the browser chrome above the viewer
+	CropOffsetY     int      `yaml:"cropOffsetY"`
+	Codec           string   `yaml:"codec"`
+	Bitrate         string   `yaml:"bitrate"`
+	GOP             int      `yaml:"gop"`
+	Threads         int      `yaml:"threads"`
+	Speed           int      `yaml:"speed"`
+	TileColumns     int      `yaml:"tileColumns"`
+	RTBufSize       string   `yaml:"rtbufsize"`
+	SegmentDuration int      `yaml:"segmentDuration"` // seconds
+	PlaylistSize    int      `yaml:"playlistSize"`
+	ExtraArgs       []string `yaml:"extraArgs"` // added before the output options
+}
+
+// cfg is the configuration in effect, the defaults until main loads it
+var cfg = defaultConfig()
+
+// defaultConfig returns the settings of a local development setup
+func defaultConfig() config {
+	return config{
+		Listen:          ":8080",
+		PublicURL:       "http://localhost:8080",
+		CORSOrigins:     []string{"http://localhost:5173"},
+		DataDir:         "data",
+		PotreeDir:       "potree",
+		JobsDir:         "jobs",
+		LASzip:          "laszip",
+		StateFile:       "server-state.json",
+		ShutdownTimeout: 30 * time.Second,
+		Browser: browserConfig{
+			ViewerPath:  "/potree/viewer.html",
+			SettleTime:  2 * time.Second,
+			LoadTimeout: 2 * time.Minute,
+		},
+		FFmpeg: ffmpegConfig{
+			Path:            "ffmpeg",
+			InputFormat:     "dshow",
+			Input:           "video=screen-capture-recorder",
+			FrameRate:       40,
+			Width:           1280,
+			Height:          720,
+			CropOffsetY:     50,
+			Codec:           "libvpx-vp9",
+			Bitrate:         "6M",
+			GOP:             40,
+			Threads:         8,
+			Speed:           6,
+			TileColumns:     4,
+			RTBufSize:       "40M",
+			SegmentDuration: 1,
+			PlaylistSize:    5,
+		},
+		Auth: authConfig{
+			Signing: signingConfig{
+				TTL:        time.Hour,
+				MaxTTL:     24 * time.Hour,
+				SegmentTTL: 5 * time.Minute,
+			},
+		},
+		Limits: limitsConfig{
+			MaxSessions:          1,
+			MaxSessionsPerUser:   1,
+			MaxLoad:              0.9,
+			MinAvailableMemoryMB: 1024,
+			RetryAfter:           30 * time.Second,
+			IdleTimeout:          2 * time.Minute,
+			MaxLifetime:          8 * time.Hour,
+			MaxProfilePoints:     1000000,
+		},
+		Log: logConfig{
+			Format:       "json",
+			Level:        "info",
+			SessionLines: 1000,
+		},
+	}
+}
+
+// setting binds a configuration value to an environment variable and a flag
+type setting struct {
+	name  string // flag name; the variable is GIS_ plus the name in upper snake case
+	usage string
+	value any // *string, *[]string, *int, *float64 or *time.Duration
+}
+
+// settings lists the values that can be overridden
+func (c *config) settings() []setting {
+	return []setting{
+		{"listen", "address to listen on", &c.Listen},
+		{"public-url", "URL the browser uses to reach the server", &c.PublicURL},
+		{"cors-origins", "comma separated allowed CORS origins", &c.CORSOrigins},
+		{"data-dir", "dataset directory", &c.DataDir},
+		{"potree-dir", "Potree viewer directory", &c.PotreeDir},
+		{"jobs-dir", "job output directory", &c.JobsDir},
+		{"job-workers", "jobs run at the same time, 0 for half of the CPUs", &c.JobWorkers},
+		{"laszip", "laszip executable for LAZ output", &c.LASzip},
+		{"state-file", "file recording the processes of running streams", &c.StateFile},
+		{"shutdown-timeout", "time stopping the streams and requests may take", &c.ShutdownTimeout},
+		{"viewer-path", "viewer page below the public URL", &c.Browser.ViewerPath},
+		{"browser-settle-time", "time the viewer gets to render before capture", &c.Browser.SettleTime},
+		{"browser-load-timeout", "time the point clouds get to load", &c.Browser.LoadTimeout},
+		{"ffmpeg-path", "FFmpeg executable", &c.FFmpeg.Path},
+		{"ffmpeg-input-format", "FFmpeg capture input format", &c.FFmpeg.InputFormat},
+		{"ffmpeg-input", "FFmpeg capture input", &c.FFmpeg.Input},
+		{"ffmpeg-frame-rate", "capture frame rate", &c.FFmpeg.FrameRate},
+		{"ffmpeg-width", "output width", &c.FFmpeg.Width},
+		{"ffmpeg-height", "output height", &c.FFmpeg.Height},
+		{"ffmpeg-crop-offset-y", "pixels of browser chrome above the viewer", &c.FFmpeg.CropOffsetY},
+		{"ffmpeg-codec", "video codec", &c.FFmpeg.Codec},
+		{"ffmpeg-bitrate", "video bitrate", &c.FFmpeg.Bitrate},
+		{"ffmpeg-gop", "keyframe interval in frames", &c.FFmpeg.GOP},
+		{"ffmpeg-threads", "encoder threads", &c.FFmpeg.Threads},
+		{"ffmpeg-speed", "encoder speed", &c.FFmpeg.Speed},
+		{"ffmpeg-tile-columns", "encoder tile columns", &c.FFmpeg.TileColumns},
+		{"ffmpeg-rtbufsize", "capture buffer size", &c.FFmpeg.RTBufSize},
+		{"ffmpeg-segment-duration", "HLS segment duration in seconds", &c.FFmpeg.SegmentDuration},
+		{"ffmpeg-playlist-size", "segments listed in the HLS playlist", &c.FFmpeg.PlaylistSize},
+		{"signing-key", "secret of signed URLs, random when empty", &c.Auth.Signing.Key},
+		{"max-sessions", "streams running at the same time", &c.Limits.MaxSessions},
+		{"max-sessions-per-user", "streams one user may run, 0 for no cap", &c.Limits.MaxSessionsPerUser},
+		{"max-load", "load average per CPU above which streams are refused, 0 to ignore", &c.Limits.MaxLoad},
+		{"min-available-memory-mb", "free memory a new stream needs", &c.Limits.MinAvailableMemoryMB},
+		{"session-queue-timeout", "time /start waits for a free slot", &c.Limits.QueueTimeout},
+		{"session-idle-timeout", "time a stream runs without viewers", &c.Limits.IdleTimeout},
+		{"session-max-lifetime", "longest a stream runs, 0 for no limit", &c.Limits.MaxLifetime},
+		{"max-profile-points", "points one elevation profile may return, 0 for no cap", &c.Limits.MaxProfilePoints},
+		{"cgroup-root", "cgroup v2 directory for Chrome and FFmpeg limits", &c.Limits.CgroupRoot},
+		{"log-format", "log format, json or text", &c.Log.Format},
+		{"log-level", "lowest level logged: debug, info, warn or error", &c.Log.Level},
+		{"session-log-lines", "log records kept for each stream", &c.Log.SessionLines},
+	}
+}
+
+// envName returns the environment variable of a setting
+func (s setting) envName() string {
+	return "GIS_" + strings.ToUpper(strings.ReplaceAll(s.name, "-", "_"))
+}
+
+// set parses raw into the setting's value
+func (s setting) set(raw string) error {
+	switch v := s.value.(type) {
+	case *string:
+		*v = raw
+	case *[]string:
+		*v = nil
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				*v = append(*v, item)
+			}
+		}
+	case *int:
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return err
+		}
+		*v = n
+	case *float64:
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return err
+		}
+		*v = f
+	case *time.Duration:
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		*v = d
+	}
+	return nil
+}
+
+// loadConfig builds the configuration from the defaults, the file given by
+// -config or GIS_CONFIG (config.yaml if present otherwise), the environment
+// and the command line flags in args, and validates it
+func loadConfig(args []string) (config, error) {
+	c := defaultConfig()
+	settings := c.settings()
+
+	fs := flag.NewFlagSet("server", flag.ContinueOnError)
+	path := fs.String("config", os.Getenv("GIS_CONFIG"), "YAML configuration file")
+	flags := map[string]*string{}
+	for _, s := range settings {
+		flags[s.name] = fs.String(s.name, "", s.usage+" (env "+s.envName()+")")
+	}
+	if err := fs.Parse(args); err != nil {
+		return c, err
+	}
+
+	file := *path
+	if file == "" {
+		if _, err := os.Stat("config.yaml"); err == nil {
+			file = "config.yaml"
+		}
+	}
+	if file != "" {
+		f, err := os.Open(file)
+		if err != nil {
+			return c, err
+		}
+		dec := yaml.NewDecoder(f)
+		dec.KnownFields(true)
+		err = dec.Decode(&c)
+		f.Close()
+		if err != nil && !errors.Is(err, io.EOF) {
+			return c, fmt.Errorf("%s: %w", file, err)
+		}
+	}
+
+	for _, s := range settings {
+		if raw, ok := os.LookupEnv(s.envName()); ok {
+			if err := s.set(raw); err != nil {
+				return c, fmt.Errorf("%s: %w", s.envName(), err)
+			}
+		}
+	}
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		for _, s := range settings {
+			if s.name == f.Name && err == nil {
+				if setErr := s.set(*flags[s.name]); setErr != nil {
+					err = fmt.Errorf("-%s: %w", s.name, setErr)
+				}
+			}
+		}
+	})
+	if err != nil {
+		return c, err
+	}
+	err = c.validate()
+	return c, err
+}
+
+// validate reports every invalid setting
+func (c *config) validate() error {
+	var errs []error
+	if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+		errs = append(errs, fmt.Errorf("listen: %w", err))
+	}
+	c.PublicURL = strings.TrimSuffix(c.PublicURL, "/")
+	if u, err := url.Parse(c.PublicURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs = append(errs, errors.New("publicUrl must be an absolute http or https URL"))
+	}
+	for _, origin := range c.CORSOrigins {
+		if u, err := url.Parse(origin); origin != "*" && (err != nil || u.Scheme == "" || u.Host == "") {
+			errs = append(errs, fmt.Errorf("corsOrigins: %q is not an origin", origin))
+		}
+	}
+	for name, dir := range map[string]string{"dataDir": c.DataDir, "potreeDir": c.PotreeDir, "jobsDir": c.JobsDir, "stateFile": c.StateFile} {
+		if dir == "" {
+			errs = append(errs, fmt.Errorf("%s must not be empty", name))
+		}
+	}
+	if c.JobWorkers < 0 {
+		errs = append(errs, errors.New("jobWorkers must not be negative"))
+	}
+	if c.ShutdownTimeout <= 0 {
+		errs = append(errs, errors.New("shutdownTimeout must be positive"))
+	}
+	if !strings.HasPrefix(c.Browser.ViewerPath, "/") {
+		errs = append(errs, errors.New("browser.viewerPath must start with /"))
+	}
+	if c.Browser.SettleTime < 0 {
+		errs = append(errs, errors.New("browser.settleTime must not be negative"))
+	}
+	if c.Browser.LoadTimeout <= 0 {
+		errs = append(errs, errors.New("browser.loadTimeout must be positive"))
+	}
+
+	f := &c.FFmpeg
+	for name, v := range map[string]string{"path": f.Path, "inputFormat": f.InputFormat, "input": f.Input, "codec": f.Codec} {
+		if v == "" {
+			errs = append(errs, fmt.Errorf("ffmpeg.%s must not be empty", name))
+		}
+	}
+	for name, v := range map[string]int{
+		"frameRate": f.FrameRate, "width": f.Width, "height": f.Height, "gop": f.GOP,
+		"segmentDuration": f.SegmentDuration, "playlistSize": f.PlaylistSize,
+	} {
+		if v <= 0 {
+			errs = append(errs, fmt.Errorf("ffmpeg.%s must be positive", name))
+		}
+	}
+	if f.Width%2 != 0 || f.Height%2 != 0 {
+		errs = append(errs, errors.New("ffmpeg.width and ffmpeg.height must be even for yuv420p"))
+	}
+	if f.CropOffsetY < 0 || f.Threads < 0 || f.TileColumns < 0 {
+		errs = append(errs, errors.New("ffmpeg.cropOffsetY, threads and tileColumns must not be negative"))
+	}
+
+	s := &c.Auth.Signing
+	if s.Key != "" && len(s.Key) < 32 {
+		errs = append(errs, errors.New("auth.signing.key must be at least 32 characters"))
+	}
+	if s.TTL <= 0 || s.MaxTTL < s.TTL || s.SegmentTTL <= 0 {
+		errs = append(errs, errors.New("auth.signing ttl and segmentTtl must be positive and ttl at most maxTtl"))
+	}
+
+	l := &c.Limits
+	if l.MaxSessions <= 0 {
+		errs = append(errs, errors.New("limits.maxSessions must be positive"))
+	}
+	if l.MaxSessionsPerUser < 0 || l.MaxLoad < 0 || l.MinAvailableMemoryMB < 0 || l.QueueTimeout < 0 {
+		errs = append(errs, errors.New("limits.maxSessionsPerUser, maxLoad, minAvailableMemoryMb and queueTimeout must not be negative"))
+	}
+	if l.RetryAfter < time.Second {
+		errs = append(errs, errors.New("limits.retryAfter must be at least 1s"))
+	}
+	if l.IdleTimeout < time.Second || l.MaxLifetime < 0 {
+		errs = append(errs, errors.New("limits.idleTimeout must be at least 1s and maxLifetime not negative"))
+	}
+	if l.MaxProfilePoints < 0 {
+		errs = append(errs, errors.New("limits.maxProfilePoints must not be negative"))
+	}
+	for name, p := range map[string]processLimits{"browser": l.Browser, "ffmpeg": l.FFmpeg} {
+		if p.MemoryMB < 0 || p.CPUs < 0 || p.MaxProcesses < 0 {
+			errs = append(errs, fmt.Errorf("limits.%s must not be negative", name))
+		}
+	}
+	if l.Browser.MemoryMB > 0 && l.CgroupRoot == "" {
+		errs = append(errs, errors.New("limits.browser.memoryMb needs limits.cgroupRoot, Chrome does not run with an address space limit"))
+	}
+
+	if c.Log.Format != "json" && c.Log.Format != "text" {
+		errs = append(errs, errors.New("log.format must be json or text"))
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.Log.Level)); err != nil {
+		errs = append(errs, errors.New("log.level must be debug, info, warn or error"))
+	}
+	if c.Log.SessionLines <= 0 {
+		errs = append(errs, errors.New("log.sessionLines must be positive"))
+	}
+	return errors.Join(errs...)
+}
+
+// viewerURL returns the viewer page with a query
+func (c *config) viewerURL(query string) string {
+	return c.PublicURL + c.Browser.ViewerPath + "?" + query
+}
+
+// args returns the FFmpeg command line capturing a window region and
+// uploading HLS to ingestURL
+func (f *ffmpegConfig) args(x, y, width, height int, ingestURL string) []string {
+	// progress goes to stdout as key=value blocks instead of stderr stats lines
+	args := []string{"-nostats", "-progress", "pipe:1"}
+	if f.RTBufSize != "" {
+		args = append(args, "-rtbufsize", f.RTBufSize)
+	}
+	args = append(args,
+		"-f", f.InputFormat,
+		"-i", f.Input,
+		"-r", strconv.Itoa(f.FrameRate),
+		"-vf", fmt.Sprintf("crop=%d:%d:%d:%d,format=yuv420p,scale=%d:%d", width, height, x, y+f.CropOffsetY, f.Width, f.Height),
+		"-c:v", f.Codec,
+	)
+	if f.Bitrate != "" {
+		args = append(args, "-b:v", f.Bitrate)
+	}
+	args = append(args, "-g", strconv.Itoa(f.GOP))
+	if f.Codec == "libvpx-vp9" {
+		args = append(args,
+			"-quality", "realtime",
+			"-speed", strconv.Itoa(f.Speed),
+			"-deadline", "realtime",
+			"-frame-parallel", "1",
+			"-tile-columns", strconv.Itoa(f.TileColumns),
+			"-row-mt", "1",
+		)
+	}
+	if f.Threads > 0 {
+		args = append(args, "-threads", strconv.Itoa(f.Threads))
+	}
+	args = append(args, f.ExtraArgs...)
+	return append(args,
+		"-hls_time", strconv.Itoa(f.SegmentDuration),
+		"-hls_list_size", strconv.Itoa(f.PlaylistSize),
+		"-hls_flags", "append_list+delete_segments+split_by_time",
+		"-hls_segment_filename", ingestURL+"/segment_%03d.m4s",
+		"-hls_segment_type", "fmp4",
+		"-method", "PUT",
+		"-http_persistent", "1",
+		"-f", "hls",
+		ingestURL+"/output.m3u8",
+	)
+}
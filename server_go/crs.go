@@ -0,0 +1,787 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Kinds of coordinate reference system
+const (
+	crsGeographic = "geographic"
+	crsProjected  = "projected"
+	crsGeocentric = "geocentric"
+)
+
+// ellipsoid is defined by its semi-major axis and flattening
+type ellipsoid struct {
+	a, f float64
+}
+
+var (
+	wgs84Ellipsoid = ellipsoid{6378137, 1 / 298.257223563}
+	grs80Ellipsoid = ellipsoid{6378137, 1 / 298.257222101}
+)
+
+// projection converts between geographic degrees and projected metres on one ellipsoid
+type projection interface {
+	forward(lon, lat float64) (x, y float64)
+	inverse(x, y float64) (lon, lat float64)
+}
+
+// crs is a parsed coordinate reference system. Only datums that are
+// equivalent to WGS84 at the metre level are supported for transformation,
+// datum shifts are not applied.
+type crs struct {
+	EPSG       int    `json:"epsg,omitempty"`
+	Name       string `json:"name,omitempty"`
+	Kind       string `json:"kind,omitempty"`
+	Definition string `json:"definition,omitempty"`
+	Supported  bool   `json:"supported"`
+
+	ellipsoid ellipsoid
+	proj      projection // nil for geographic and geocentric systems
+	unit      float64    // metres per projected unit
+}
+
+func degToRad(d float64) float64 { return d * math.Pi / 180 }
+func radToDeg(r float64) float64 { return r * 180 / math.Pi }
+
+// webMercator is EPSG:3857, a spherical Mercator on the WGS84 semi-major axis
+type webMercator struct{}
+
+func (webMercator) forward(lon, lat float64) (float64, float64) {
+	r := wgs84Ellipsoid.a
+	return r * degToRad(lon), r * math.Log(math.Tan(math.Pi/4+degToRad(lat)/2))
+}
+
+func (webMercator) inverse(x, y float64) (float64, float64) {
+	r := wgs84Ellipsoid.a
+	return radToDeg(x / r), radToDeg(2*math.Atan(math.Exp(y/r)) - math.Pi/2)
+}
+
+// transverseMercator uses the Krüger series, accurate to well below a
+// millimetre within a few thousand kilometres of the central meridian
+type transverseMercator struct {
+	lon0, k0, x0, y0 float64
+	e, a             float64 // eccentricity and rectifying radius
+	alpha, beta      [4]float64
+	delta            [4]float64
+	m0               float64 // northing of the latitude of origin
+}
+
+func newTransverseMercator(el ellipsoid, lat0, lon0, k0, x0, y0 float64) *transverseMercator {
+	n := el.f / (2 - el.f)
+	n2, n3, n4 := n*n, n*n*n, n*n*n*n
+	t := &transverseMercator{
+		lon0: lon0, k0: k0, x0: x0, y0: y0,
+		e: 2 * math.Sqrt(n) / (1 + n),
+		a: el.a / (1 + n) * (1 + n2/4 + n4/64),
+		alpha: [4]float64{
+			n/2 - 2*n2/3 + 5*n3/16 + 41*n4/180,
+			13*n2/48 - 3*n3/5 + 557*n4/1440,
+			61*n3/240 - 103*n4/140,
+			49561 * n4 / 161280,
+		},
+		beta: [4]float64{
+			n/2 - 2*n2/3 + 37*n3/96 - n4/360,
+			n2/48 + n3/15 - 437*n4/1440,
+			17*n3/480 - 37*n4/840,
+			4397 * n4 / 161280,
+		},
+		delta: [4]float64{
+			2*n - 2*n2/3 - 2*n3 + 116*n4/45,
+			7*n2/3 - 8*n3/5 - 227*n4/45,
+			56*n3/15 - 136*n4/35,
+			4279 * n4 / 630,
+		},
+	}
+	if lat0 != 0 {
+		_, t.m0 = t.forward(lon0, lat0)
+		t.m0 -= y0
+	}
+	return t
+}
+
+func (t *transverseMercator) forward(lon, lat float64) (float64, float64) {
+	phi, dl := degToRad(lat), degToRad(lon-t.lon0)
+	s := math.Sin(phi)
+	tau := math.Sinh(math.Atanh(s) - t.e*math.Atanh(t.e*s))
+	xi := math.Atan2(tau, math.Cos(dl))
+	eta := math.Atanh(math.Sin(dl) / math.Sqrt(1+tau*tau))
+
+	x, y := eta, xi
+	for j, a := range t.alpha {
+		k := 2 * float64(j+1)
+		x += a * math.Cos(k*xi) * math.Sinh(k*eta)
+		y += a * math.Sin(k*xi) * math.Cosh(k*eta)
+	}
+	return t.x0 + t.k0*t.a*x, t.y0 + t.k0*t.a*y - t.m0
+}
+
+func (t *transverseMercator) inverse(x, y float64) (float64, float64) {
+	xi := (y - t.y0 + t.m0) / (t.k0 * t.a)
+	eta := (x - t.x0) / (t.k0 * t.a)
+
+	xi1, eta1 := xi, eta
+	for j, b := range t.beta {
+		k := 2 * float64(j+1)
+		xi1 -= b * math.Sin(k*xi) * math.Cosh(k*eta)
+		eta1 -= b * math.Cos(k*xi) * math.Sinh(k*eta)
+	}
+	chi := math.Asin(math.Sin(xi1) / math.Cosh(eta1))
+	phi := chi
+	for j, d := range t.delta {
+		phi += d * math.Sin(2*float64(j+1)*chi)
+	}
+	return t.lon0 + radToDeg(math.Atan2(math.Sinh(eta1), math.Cos(xi1))), radToDeg(phi)
+}
+
+// geodeticToECEF converts degrees and ellipsoidal height to earth centred coordinates
+func geodeticToECEF(el ellipsoid, lon, lat, h float64) (float64, float64, float64) {
+	phi, lambda := degToRad(lat), degToRad(lon)
+	e2 := el.f * (2 - el.f)
+	n := el.a / math.Sqrt(1-e2*math.Sin(phi)*math.Sin(phi))
+	return (n + h) * math.Cos(phi) * math.Cos(lambda),
+		(n + h) * math.Cos(phi) * math.Sin(lambda),
+		(n*(1-e2) + h) * math.Sin(phi)
+}
+
+// ecefToGeodetic is Bowring's method with a few refinement iterations
+func ecefToGeodetic(el ellipsoid, x, y, z float64) (float64, float64, float64) {
+	e2 := el.f * (2 - el.f)
+	p := math.Hypot(x, y)
+	lambda := math.Atan2(y, x)
+	phi := math.Atan2(z, p*(1-e2))
+	var h float64
+	for i := 0; i < 5; i++ {
+		n := el.a / math.Sqrt(1-e2*math.Sin(phi)*math.Sin(phi))
+		h = p/math.Cos(phi) - n
+		phi = math.Atan2(z, p*(1-e2*n/(n+h)))
+	}
+	return radToDeg(lambda), radToDeg(phi), h
+}
+
+// epsgCRS builds one of the built in EPSG definitions
+func epsgCRS(code int) (*crs, error) {
+	c := &crs{EPSG: code, Supported: true, ellipsoid: wgs84Ellipsoid, unit: 1, Definition: "EPSG:" + strconv.Itoa(code)}
+	switch {
+	case code == 4326:
+		c.Name, c.Kind = "WGS 84", crsGeographic
+	case code == 4258:
+		c.Name, c.Kind, c.ellipsoid = "ETRS89", crsGeographic, grs80Ellipsoid
+	case code == 4269:
+		c.Name, c.Kind, c.ellipsoid = "NAD83", crsGeographic, grs80Ellipsoid
+	case code == 4978:
+		c.Name, c.Kind = "WGS 84 geocentric", crsGeocentric
+	case code == 3857:
+		c.Name, c.Kind, c.proj = "WGS 84 / Pseudo-Mercator", crsProjected, webMercator{}
+	case code > 32600 && code <= 32660:
+		c.Name, c.Kind = fmt.Sprintf("WGS 84 / UTM zone %dN", code-32600), crsProjected
+		c.proj = utmProjection(wgs84Ellipsoid, code-32600, false)
+	case code > 32700 && code <= 32760:
+		c.Name, c.Kind = fmt.Sprintf("WGS 84 / UTM zone %dS", code-32700), crsProjected
+		c.proj = utmProjection(wgs84Ellipsoid, code-32700, true)
+	case code >= 25828 && code <= 25838:
+		c.Name, c.Kind, c.ellipsoid = fmt.Sprintf("ETRS89 / UTM zone %dN", code-25800), crsProjected, grs80Ellipsoid
+		c.proj = utmProjection(grs80Ellipsoid, code-25800, false)
+	case code >= 26901 && code <= 26923:
+		c.Name, c.Kind, c.ellipsoid = fmt.Sprintf("NAD83 / UTM zone %dN", code-26900), crsProjected, grs80Ellipsoid
+		c.proj = utmProjection(grs80Ellipsoid, code-26900, false)
+	default:
+		return nil, fmt.Errorf("EPSG:%d is not supported", code)
+	}
+	return c, nil
+}
+
+func utmProjection(el ellipsoid, zone int, south bool) projection {
+	y0 := 0.0
+	if south {
+		y0 = 10_000_000
+	}
+	return newTransverseMercator(el, 0, float64(zone*6-183), 0.9996, 500_000, y0)
+}
+
+// parseCRS parses "EPSG:n", a PROJ string or OGC WKT (version 1 or 2). A
+// definition that is recognised but cannot be transformed is returned with
+// Supported set to false.
+func parseCRS(def string) (*crs, error) {
+	def = strings.TrimSpace(def)
+	switch {
+	case def == "":
+		return nil, errors.New("empty CRS definition")
+	case strings.HasPrefix(strings.ToUpper(def), "EPSG:"):
+		code, err := strconv.Atoi(def[5:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid EPSG code %q", def)
+		}
+		return epsgCRS(code)
+	case strings.Contains(def, "+proj="):
+		return parseProjString(def)
+	case strings.Contains(def, "["):
+		return parseWKTCRS(def)
+	}
+	return nil, fmt.Errorf("unrecognised CRS definition %q", def)
+}
+
+// parseProjString handles the PROJ.4 style definitions PotreeConverter copies into metadata.json
+func parseProjString(def string) (*crs, error) {
+	params := map[string]string{}
+	for _, tok := range strings.Fields(def) {
+		k, v, _ := strings.Cut(strings.TrimPrefix(tok, "+"), "=")
+		params[k] = v
+	}
+	num := func(k string, fallback float64) float64 {
+		if v, err := strconv.ParseFloat(params[k], 64); err == nil {
+			return v
+		}
+		return fallback
+	}
+
+	c := &crs{Definition: def, unit: 1, ellipsoid: wgs84Ellipsoid, Supported: true}
+	if init := params["init"]; strings.HasPrefix(strings.ToLower(init), "epsg:") {
+		if code, err := strconv.Atoi(init[5:]); err == nil {
+			if known, err := epsgCRS(code); err == nil {
+				known.Definition = def
+				return known, nil
+			}
+			c.EPSG = code
+		}
+	}
+
+	switch strings.ToUpper(params["ellps"] + params["datum"]) {
+	case "", "WGS84", "WGS84WGS84":
+	case "GRS80", "NAD83", "GRS80NAD83":
+		c.ellipsoid = grs80Ellipsoid
+	default:
+		c.Supported = false
+	}
+	if a := num("a", 0); a > 0 {
+		c.ellipsoid.a = a
+		if rf := num("rf", 0); rf > 0 {
+			c.ellipsoid.f = 1 / rf
+		} else if b := num("b", 0); b > 0 {
+			c.ellipsoid.f = (a - b) / a
+		} else {
+			c.ellipsoid.f = num("f", 0)
+		}
+	}
+	if tw := params["towgs84"]; tw != "" && strings.Trim(tw, "0,.") != "" {
+		c.Supported = false
+	}
+	switch params["units"] {
+	case "", "m":
+	case "us-ft":
+		c.unit = 1200.0 / 3937
+	case "ft":
+		c.unit = 0.3048
+	default:
+		c.Supported = false
+	}
+
+	switch params["proj"] {
+	case "longlat", "latlong", "lonlat", "latlon":
+		c.Kind = crsGeographic
+	case "geocent":
+		c.Kind = crsGeocentric
+	case "utm":
+		zone, err := strconv.Atoi(params["zone"])
+		if err != nil || zone < 1 || zone > 60 {
+			return nil, fmt.Errorf("invalid UTM zone in %q", def)
+		}
+		_, south := params["south"]
+		c.Kind = crsProjected
+		c.proj = utmProjection(c.ellipsoid, zone, south)
+		if c.EPSG == 0 && c.ellipsoid == wgs84Ellipsoid {
+			c.EPSG = 32600 + zone
+			if south {
+				c.EPSG = 32700 + zone
+			}
+		}
+	case "tmerc":
+		c.Kind = crsProjected
+		c.proj = newTransverseMercator(c.ellipsoid, num("lat_0", 0), num("lon_0", 0),
+			num("k_0", num("k", 1)), num("x_0", 0), num("y_0", 0)) // x_0 and y_0 are always in metres
+	case "merc":
+		c.Kind = crsProjected
+		if c.ellipsoid.f == 0 && c.ellipsoid.a == wgs84Ellipsoid.a {
+			c.proj = webMercator{}
+		} else {
+			c.Supported = false
+		}
+	default:
+		c.Kind = crsProjected
+		c.Supported = false
+	}
+	if c.Kind == crsProjected && c.proj == nil {
+		c.Supported = false
+	}
+	return c, nil
+}
+
+// wktNode is one KEYWORD[...] element of a WKT string
+type wktNode struct {
+	keyword string
+	args    []interface{} // string, float64 or *wktNode
+}
+
+// child returns the first child node with one of the keywords
+func (n *wktNode) child(keywords ...string) *wktNode {
+	for _, a := range n.args {
+		if c, ok := a.(*wktNode); ok {
+			for _, k := range keywords {
+				if strings.EqualFold(c.keyword, k) {
+					return c
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (n *wktNode) str(i int) string {
+	if i < len(n.args) {
+		if s, ok := n.args[i].(string); ok {
+			return s
+		}
+	}
+	return ""
+}
+
+func (n *wktNode) num(i int) float64 {
+	if i < len(n.args) {
+		switch v := n.args[i].(type) {
+		case float64:
+			return v
+		case string:
+			f, _ := strconv.ParseFloat(v, 64)
+			return f
+		}
+	}
+	return 0
+}
+
+// authority returns the EPSG code of an AUTHORITY (WKT1) or ID (WKT2) child
+func (n *wktNode) authority() int {
+	if a := n.child("AUTHORITY", "ID"); a != nil && strings.EqualFold(a.str(0), "EPSG") {
+		return int(a.num(1))
+	}
+	return 0
+}
+
+// parseWKT tokenises OGC WKT into a tree
+func parseWKT(s string) (*wktNode, error) {
+	pos := 0
+	var parseNode func() (*wktNode, error)
+	skip := func() {
+		for pos < len(s) && unicode.IsSpace(rune(s[pos])) {
+			pos++
+		}
+	}
+	parseNode = func() (*wktNode, error) {
+		skip()
+		start := pos
+		for pos < len(s) && (unicode.IsLetter(rune(s[pos])) || unicode.IsDigit(rune(s[pos])) || s[pos] == '_') {
+			pos++
+		}
+		n := &wktNode{keyword: s[start:pos]}
+		skip()
+		if pos >= len(s) || (s[pos] != '[' && s[pos] != '(') {
+			return nil, fmt.Errorf("expected [ after %q at %d", n.keyword, pos)
+		}
+		pos++
+		for {
+			skip()
+			if pos >= len(s) {
+				return nil, errors.New("unterminated WKT")
+			}
+			switch c := s[pos]; {
+			case c == ']' || c == ')':
+				pos++
+				return n, nil
+			case c == ',':
+				pos++
+			case c == '"':
+				end := strings.IndexByte(s[pos+1:], '"')
+				if end < 0 {
+					return nil, errors.New("unterminated WKT string")
+				}
+				n.args = append(n.args, s[pos+1:pos+1+end])
+				pos += end + 2
+			case c == '-' || c == '+' || c == '.' || unicode.IsDigit(rune(c)):
+				start := pos
+				for pos < len(s) && strings.IndexByte("+-.0123456789eE", s[pos]) >= 0 {
+					pos++
+				}
+				f, err := strconv.ParseFloat(s[start:pos], 64)
+				if err != nil {
+					return nil, err
+				}
+				n.args = append(n.args, f)
+			default:
+				// a nested node, or an enumeration value such as EAST
+				save := pos
+				for pos < len(s) && (unicode.IsLetter(rune(s[pos])) || unicode.IsDigit(rune(s[pos])) || s[pos] == '_') {
+					pos++
+				}
+				word := s[save:pos]
+				skip()
+				if pos < len(s) && (s[pos] == '[' || s[pos] == '(') {
+					pos = save
+					child, err := parseNode()
+					if err != nil {
+						return nil, err
+					}
+					n.args = append(n.args, child)
+				} else if word != "" {
+					n.args = append(n.args, word)
+				} else {
+					return nil, fmt.Errorf("unexpected %q in WKT at %d", c, pos)
+				}
+			}
+		}
+	}
+	return parseNode()
+}
+
+// parseWKTCRS interprets WKT1 and WKT2 geographic, geocentric and
+// transverse Mercator systems; other projections are reported unsupported
+func parseWKTCRS(def string) (*crs, error) {
+	root, err := parseWKT(def)
+	if err != nil {
+		return nil, fmt.Errorf("parse WKT: %w", err)
+	}
+	c := &crs{Definition: def, Name: root.str(0), EPSG: root.authority(), unit: 1, ellipsoid: wgs84Ellipsoid}
+
+	// a known EPSG code wins over interpreting the parameters
+	if c.EPSG != 0 {
+		if known, err := epsgCRS(c.EPSG); err == nil {
+			known.Definition, known.Name = def, c.Name
+			return known, nil
+		}
+	}
+
+	switch strings.ToUpper(root.keyword) {
+	case "GEOGCS", "GEOGCRS", "GEOGRAPHICCRS":
+		c.Kind = crsGeographic
+	case "GEOCCS", "GEODCRS", "GEODETICCRS":
+		c.Kind = crsGeocentric
+		// WKT2 uses GEODCRS for both; a geographic one has an ellipsoidal CS
+		if cs := root.child("CS"); cs != nil && strings.EqualFold(cs.str(0), "ellipsoidal") {
+			c.Kind = crsGeographic
+		}
+	case "PROJCS", "PROJCRS", "PROJECTEDCRS":
+		c.Kind = crsProjected
+	default:
+		return nil, fmt.Errorf("unsupported WKT root %s", root.keyword)
+	}
+
+	// find the ellipsoid anywhere below the root
+	var find func(n *wktNode, keywords ...string) *wktNode
+	find = func(n *wktNode, keywords ...string) *wktNode {
+		if c := n.child(keywords...); c != nil {
+			return c
+		}
+		for _, a := range n.args {
+			if child, ok := a.(*wktNode); ok {
+				if c := find(child, keywords...); c != nil {
+					return c
+				}
+			}
+		}
+		return nil
+	}
+	if el := find(root, "SPHEROID", "ELLIPSOID"); el != nil {
+		a, rf := el.num(1), el.num(2)
+		c.ellipsoid = ellipsoid{a: a}
+		if rf != 0 {
+			c.ellipsoid.f = 1 / rf
+		}
+	}
+	if d := find(root, "TOWGS84"); d != nil {
+		for i := range d.args {
+			if d.num(i) != 0 {
+				return c, nil // needs a datum shift
+			}
+		}
+	}
+	if c.Kind != crsProjected {
+		c.Supported = true
+		return c, nil
+	}
+
+	if u := root.child("UNIT", "LENGTHUNIT"); u != nil && u.num(1) > 0 {
+		c.unit = u.num(1)
+	}
+
+	method := ""
+	params := map[string]float64{}
+	if p := root.child("PROJECTION"); p != nil {
+		method = p.str(0)
+	}
+	container := root
+	if conv := root.child("CONVERSION"); conv != nil {
+		container = conv
+		if m := conv.child("METHOD"); m != nil {
+			method = m.str(0)
+		}
+	}
+	for _, a := range container.args {
+		if p, ok := a.(*wktNode); ok && strings.EqualFold(p.keyword, "PARAMETER") {
+			name := strings.ToLower(strings.NewReplacer(" ", "_").Replace(p.str(0)))
+			params[name] = p.num(1)
+		}
+	}
+	param := func(fallback float64, names ...string) float64 {
+		for _, n := range names {
+			if v, ok := params[n]; ok {
+				return v
+			}
+		}
+		return fallback
+	}
+
+	switch strings.ToLower(strings.NewReplacer(" ", "_").Replace(method)) {
+	case "transverse_mercator":
+		c.proj = newTransverseMercator(c.ellipsoid,
+			param(0, "latitude_of_origin", "latitude_of_natural_origin"),
+			param(0, "central_meridian", "longitude_of_natural_origin"),
+			param(1, "scale_factor", "scale_factor_at_natural_origin"),
+			param(0, "false_easting")*c.unit,
+			param(0, "false_northing")*c.unit)
+		c.Supported = true
+	case "popular_visualisation_pseudo_mercator", "mercator_1sp":
+		if c.ellipsoid.a == wgs84Ellipsoid.a && (c.ellipsoid.f == 0 || strings.Contains(strings.ToLower(method), "pseudo")) {
+			c.proj = webMercator{}
+			c.Supported = true
+		}
+	}
+	return c, nil
+}
+
+// toGeodetic converts a coordinate of the CRS to lon, lat in degrees and height
+func (c *crs) toGeodetic(x, y, z float64) (float64, float64, float64) {
+	switch c.Kind {
+	case crsGeocentric:
+		return ecefToGeodetic(c.ellipsoid, x, y, z)
+	case crsProjected:
+		lon, lat := c.proj.inverse(x*c.unit, y*c.unit)
+		return lon, lat, z
+	}
+	return x, y, z
+}
+
+// fromGeodetic is the inverse of toGeodetic
+func (c *crs) fromGeodetic(lon, lat, h float64) (float64, float64, float64) {
+	switch c.Kind {
+	case crsGeocentric:
+		return geodeticToECEF(c.ellipsoid, lon, lat, h)
+	case crsProjected:
+		x, y := c.proj.forward(lon, lat)
+		return x / c.unit, y / c.unit, h
+	}
+	return lon, lat, h
+}
+
+// transformPoints converts points in place between two systems
+func transformPoints(from, to *crs, pts [][3]float64) error {
+	if !from.Supported {
+		return fmt.Errorf("transformations from %s are not supported", from.label())
+	}
+	if !to.Supported {
+		return fmt.Errorf("transformations to %s are not supported", to.label())
+	}
+	for i, p := range pts {
+		lon, lat, h := from.toGeodetic(p[0], p[1], p[2])
+		pts[i][0], pts[i][1], pts[i][2] = to.fromGeodetic(lon, lat, h)
+	}
+	return nil
+}
+
+func (c *crs) label() string {
+	if c.EPSG != 0 {
+		return "EPSG:" + strconv.Itoa(c.EPSG)
+	}
+	if c.Name != "" {
+		return c.Name
+	}
+	return "the dataset CRS"
+}
+
+// crs returns the dataset CRS from metadata.json, falling back to the
+// projection VLRs of LAS/LAZ source files kept in the dataset directory
+func (d *potreeDataset) crs() (*crs, error) {
+	if d.meta.Projection != "" {
+		return parseCRS(d.meta.Projection)
+	}
+	sources, _ := filepath.Glob(filepath.Join(d.dir, "*.la[sz]"))
+	for _, src := range sources {
+		if def, err := lasProjection(src); err == nil && def != "" {
+			return parseCRS(def)
+		}
+	}
+	return nil, errors.New("dataset has no projection")
+}
+
+// lasProjection reads the OGC WKT or GeoTIFF projection VLR of a LAS or LAZ
+// file, whose header and VLRs are never compressed
+func lasProjection(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	header := make([]byte, lasHeaderSize)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return "", err
+	}
+	if string(header[:4]) != "LASF" {
+		return "", errors.New("not a LAS file")
+	}
+	le := binary.LittleEndian
+	headerSize := int64(le.Uint16(header[94:]))
+	numVLRs := int(le.Uint32(header[100:]))
+
+	offset := headerSize
+	geoKeyEPSG := 0
+	for i := 0; i < numVLRs; i++ {
+		vlr := make([]byte, 54)
+		if _, err := f.ReadAt(vlr, offset); err != nil {
+			return "", err
+		}
+		userID := strings.TrimRight(string(vlr[2:18]), "\x00")
+		recordID := le.Uint16(vlr[18:])
+		length := int64(le.Uint16(vlr[20:]))
+		if userID == "LASF_Projection" {
+			data := make([]byte, length)
+			if _, err := f.ReadAt(data, offset+54); err != nil {
+				return "", err
+			}
+			switch recordID {
+			case 2112: // OGC coordinate system WKT
+				return strings.TrimRight(string(data), "\x00"), nil
+			case 34735: // GeoKeyDirectoryTag
+				for k := 4; k+4 <= len(data)/2; k += 4 {
+					key, loc, val := le.Uint16(data[2*k:]), le.Uint16(data[2*k+2:]), le.Uint16(data[2*k+6:])
+					if loc == 0 && (key == projectedCSTypeGeoKey || (key == geographicTypeGeoKey && geoKeyEPSG == 0)) && val != geoKeyUserDefined {
+						geoKeyEPSG = int(val)
+					}
+				}
+			}
+		}
+		offset += 54 + length
+	}
+	if geoKeyEPSG != 0 {
+		return "EPSG:" + strconv.Itoa(geoKeyEPSG), nil
+	}
+	return "", nil
+}
+
+// localizeXY converts request coordinates given in another CRS, typically
+// "EPSG:4326" lon/lat, into the dataset CRS in place. An empty from is a no-op.
+func (d *potreeDataset) localizeXY(from string, pts [][2]float64) error {
+	if from == "" || len(pts) == 0 {
+		return nil
+	}
+	xyz := make([][3]float64, len(pts))
+	for i, p := range pts {
+		xyz[i] = [3]float64{p[0], p[1], 0}
+	}
+	if err := d.localizeXYZ(from, xyz); err != nil {
+		return err
+	}
+	for i := range pts {
+		pts[i] = [2]float64{xyz[i][0], xyz[i][1]}
+	}
+	return nil
+}
+
+// localizeXYZ is localizeXY for 3D coordinates
+func (d *potreeDataset) localizeXYZ(from string, pts [][3]float64) error {
+	if from == "" || len(pts) == 0 {
+		return nil
+	}
+	src, err := parseCRS(from)
+	if err != nil {
+		return err
+	}
+	dst, err := d.crs()
+	if err != nil {
+		return err
+	}
+	return transformPoints(src, dst, pts)
+}
+
+// cameraView is an initial viewer camera, optionally in another CRS than the dataset
+type cameraView struct {
+	Position [3]float64 `json:"position"`
+	Target   [3]float64 `json:"target"`
+	CRS      string     `json:"crs"`
+}
+
+// cameraParam returns the viewer query parameter placing the camera, or "" without one
+func cameraParam(pointCloudURL string, cam *cameraView) (string, error) {
+	if cam == nil {
+		return "", nil
+	}
+	pts := [][3]float64{cam.Position, cam.Target}
+	if cam.CRS != "" {
+		name, ok := datasetNameFromURL(pointCloudURL)
+		if !ok {
+			return "", errors.New("camera crs needs a point cloud served from /file/")
+		}
+		d, err := openDataset(name)
+		if err != nil {
+			return "", err
+		}
+		if err := d.localizeXYZ(cam.CRS, pts); err != nil {
+			return "", err
+		}
+	}
+	return fmt.Sprintf("&camera=%g,%g,%g,%g,%g,%g", pts[0][0], pts[0][1], pts[0][2], pts[1][0], pts[1][1], pts[1][2]), nil
+}
+
+// transformCoordinates handles POST /transform
+func transformCoordinates(w http.ResponseWriter, r *http.Request) {
+	var requestBody struct {
+		From   string       `json:"from"`
+		To     string       `json:"to"`
+		Points [][3]float64 `json:"points"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	from, err := parseCRS(requestBody.From)
+	if err != nil {
+		http.Error(w, "from: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	to, err := parseCRS(requestBody.To)
+	if err != nil {
+		http.Error(w, "to: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := transformPoints(from, to, requestBody.Points); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"from":   from,
+		"to":     to,
+		"points": requestBody.Points,
+	})
+}
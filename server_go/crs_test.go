@@ -0,0 +1,126 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// NAD83 / New Jersey (ftUS), EPSG:3424, as a PROJ string and as WKT
+const (
+	njStatePlaneProj = "+proj=tmerc +lat_0=38.83333333333334 +lon_0=-74.5 +k=0.9999 +x_0=150000 +y_0=0 +ellps=GRS80 +datum=NAD83 +units=us-ft +no_defs"
+	njStatePlaneWKT  = `PROJCS["NAD83 / New Jersey (ftUS)",GEOGCS["NAD83",DATUM["North_American_Datum_1983",SPHEROID["GRS 1980",6378137,298.257222101]],PRIMEM["Greenwich",0],UNIT["degree",0.0174532925199433]],PROJECTION["Transverse_Mercator"],PARAMETER["latitude_of_origin",38.83333333333334],PARAMETER["central_meridian",-74.5],PARAMETER["scale_factor",0.9999],PARAMETER["false_easting",492125],PARAMETER["false_northing",0],UNIT["US survey foot",0.3048006096012192]]`
+)
+
+func TestTransverseMercator(t *testing.T) {
+	tests := []struct {
+		name     string
+		def      string
+		lon, lat float64
+		x, y     float64 // in the units of the CRS
+		tol      float64
+	}{
+		// EPSG Guidance Note 7-2, British National Grid on the Airy ellipsoid
+		{"EPSG example", "+proj=tmerc +lat_0=49 +lon_0=-2 +k=0.9996012717 +x_0=400000 +y_0=-100000 +a=6377563.396 +rf=299.3249646 +units=m",
+			0.5, 50.5, 577274.99, 69740.50, 0.02},
+		{"UTM zone 33N", "EPSG:32633", 15, 52, 500000, 5761038.2, 1},
+		{"UTM zone 33S", "+proj=utm +zone=33 +south +ellps=WGS84", 15, 0, 500000, 10_000_000, 1e-6},
+		{"State Plane origin", njStatePlaneProj, -74.5, 38.83333333333334, 492125, 0, 1e-6},
+		{"State Plane WKT origin", njStatePlaneWKT, -74.5, 38.83333333333334, 492125, 0, 1e-6},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := parseCRS(tt.def)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !c.Supported {
+				t.Fatalf("%s is not supported", tt.def)
+			}
+			x, y, _ := c.fromGeodetic(tt.lon, tt.lat, 0)
+			if math.Abs(x-tt.x) > tt.tol || math.Abs(y-tt.y) > tt.tol {
+				t.Errorf("forward = %.3f, %.3f, want %.3f, %.3f", x, y, tt.x, tt.y)
+			}
+			lon, lat, _ := c.toGeodetic(tt.x, tt.y, 0)
+			if math.Abs(lon-tt.lon) > 1e-6 || math.Abs(lat-tt.lat) > 1e-6 {
+				t.Errorf("inverse = %.9f, %.9f, want %.9f, %.9f", lon, lat, tt.lon, tt.lat)
+			}
+		})
+	}
+}
+
+// TestStatePlaneFeet checks a point away from the origin: the PROJ string
+// in US survey feet, the same system in metres and its WKT must agree
+func TestStatePlaneFeet(t *testing.T) {
+	feet, err := parseCRS(njStatePlaneProj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metres, err := parseCRS("+proj=tmerc +lat_0=38.83333333333334 +lon_0=-74.5 +k=0.9999 +x_0=150000 +y_0=0 +ellps=GRS80 +units=m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wkt, err := parseCRS(njStatePlaneWKT)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Newark
+	const lon, lat = -74.1724, 40.7357
+	fx, fy, _ := feet.fromGeodetic(lon, lat, 0)
+	mx, my, _ := metres.fromGeodetic(lon, lat, 0)
+	wx, wy, _ := wkt.fromGeodetic(lon, lat, 0)
+	if math.Abs(fx*feet.unit-mx) > 1e-6 || math.Abs(fy*feet.unit-my) > 1e-6 {
+		t.Errorf("feet %.3f, %.3f are not metres %.3f, %.3f", fx, fy, mx, my)
+	}
+	if math.Abs(fx-wx) > 1e-6 || math.Abs(fy-wy) > 1e-6 {
+		t.Errorf("PROJ %.3f, %.3f and WKT %.3f, %.3f differ", fx, fy, wx, wy)
+	}
+
+	pts := [][3]float64{{fx, fy, 10}}
+	wgs84, _ := epsgCRS(4326)
+	if err := transformPoints(feet, wgs84, pts); err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(pts[0][0]-lon) > 1e-9 || math.Abs(pts[0][1]-lat) > 1e-9 || pts[0][2] != 10 {
+		t.Errorf("round trip = %v, want %v, %v, 10", pts[0], lon, lat)
+	}
+}
+
+func TestParseCRS(t *testing.T) {
+	tests := []struct {
+		def       string
+		kind      string
+		epsg      int
+		supported bool
+	}{
+		{"EPSG:4326", crsGeographic, 4326, true},
+		{"epsg:3857", crsProjected, 3857, true},
+		{"EPSG:4978", crsGeocentric, 4978, true},
+		{"+proj=utm +zone=33 +ellps=WGS84 +datum=WGS84 +units=m +no_defs", crsProjected, 32633, true},
+		{"+proj=longlat +datum=WGS84", crsGeographic, 0, true},
+		{"+init=epsg:25832 +proj=utm +zone=32 +ellps=GRS80", crsProjected, 25832, true},
+		// datum shifts are not applied
+		{"+proj=tmerc +lat_0=49 +lon_0=-2 +k=0.9996012717 +x_0=400000 +y_0=-100000 +ellps=airy +towgs84=446.448,-125.157,542.06,0.15,0.247,0.842,-20.489 +units=m", crsProjected, 0, false},
+		{"+proj=lcc +lat_1=40 +lat_2=41 +ellps=GRS80", crsProjected, 0, false},
+		{"+proj=utm +zone=33 +units=yd", crsProjected, 32633, false},
+		{`PROJCS["WGS 84 / UTM zone 33N",GEOGCS["WGS 84",DATUM["WGS_1984",SPHEROID["WGS 84",6378137,298.257223563]],PRIMEM["Greenwich",0],UNIT["degree",0.0174532925199433]],PROJECTION["Transverse_Mercator"],PARAMETER["latitude_of_origin",0],PARAMETER["central_meridian",15],PARAMETER["scale_factor",0.9996],PARAMETER["false_easting",500000],PARAMETER["false_northing",0],UNIT["metre",1],AUTHORITY["EPSG","32633"]]`, crsProjected, 32633, true},
+		{`GEOGCS["WGS 84",DATUM["WGS_1984",SPHEROID["WGS 84",6378137,298.257223563]],PRIMEM["Greenwich",0],UNIT["degree",0.0174532925199433]]`, crsGeographic, 0, true},
+	}
+	for _, tt := range tests {
+		c, err := parseCRS(tt.def)
+		if err != nil {
+			t.Errorf("parseCRS(%q): %v", tt.def, err)
+			continue
+		}
+		if c.Kind != tt.kind || c.EPSG != tt.epsg || c.Supported != tt.supported {
+			t.Errorf("parseCRS(%q) = %s EPSG:%d supported %v, want %s EPSG:%d supported %v",
+				tt.def, c.Kind, c.EPSG, c.Supported, tt.kind, tt.epsg, tt.supported)
+		}
+	}
+
+	for _, def := range []string{"", "EPSG:x", "EPSG:1234", "+proj=utm +zone=61", "nonsense", "PROJCS["} {
+		if _, err := parseCRS(def); err == nil {
+			t.Errorf("parseCRS(%q) succeeded", def)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// catalogEntry describes one dataset in GET /datasets
+type catalogEntry struct {
+	Name   string `json:"name"`
+	Format string `json:"format"` // "potree" or "ept"
+	URL    string `json:"url"`
+	Points int64  `json:"points"`
+	Bounds aabb   `json:"bounds"`
+	CRS    *crs   `json:"crs,omitempty"`
+	// CRSError explains why a projection could not be interpreted
+	CRSError string `json:"crsError,omitempty"`
+}
+
+// openDatasetForRequest opens a dataset and writes the matching HTTP error on failure
+func openDatasetForRequest(w http.ResponseWriter, name string) (*potreeDataset, bool) {
+	d, err := openDataset(name)
+	if errors.Is(err, errDatasetNotFound) {
+		http.Error(w, "Dataset not found", http.StatusNotFound)
+		return nil, false
+	}
+	if err != nil {
+		http.Error(w, "Failed to open dataset", http.StatusInternalServerError)
+		slog.Error("Error opening dataset", "dataset", name, "error", err)
+		return nil, false
+	}
+	return d, true
+}
+
+// datasetNameFromURL returns the dataset of a point cloud URL served from /file/
+func datasetNameFromURL(pointCloudURL string) (string, bool) {
+	u, err := url.Parse(pointCloudURL)
+	if err != nil {
+		return "", false
+	}
+	name, ok := strings.CutPrefix(u.Path, "/file/")
+	if !ok {
+		return "", false
+	}
+	name, _, _ = strings.Cut(name, "/")
+	return name, name != ""
+}
+
+// listDatasets handles GET /datasets
+func listDatasets(w http.ResponseWriter, r *http.Request) {
+	entries, err := os.ReadDir(cfg.DataDir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		http.Error(w, "Failed to list datasets", http.StatusInternalServerError)
+		requestLog(r).Error("Error listing datasets", "error", err)
+		return
+	}
+
+	p := principalFrom(r)
+	catalog := []catalogEntry{}
+	for _, e := range entries {
+		// hidden directories are datasets being written or deleted
+		if !e.IsDir() || strings.HasPrefix(e.Name(), ".") || !p.allowed(e.Name(), permView) {
+			continue
+		}
+		var entry catalogEntry
+		var c *crs
+		var crsErr error
+		if d, err := openDataset(e.Name()); err == nil {
+			entry = catalogEntry{
+				Name:   d.name,
+				Format: "potree",
+				URL:    "/file/" + url.PathEscape(d.name) + "/metadata.json",
+				Points: d.meta.Points,
+				Bounds: d.extent(),
+			}
+			c, crsErr = d.crs()
+		} else if ept, err := openEPT(e.Name()); err == nil {
+			b := ept.info.BoundsConforming
+			entry = catalogEntry{
+				Name:   ept.name,
+				Format: "ept",
+				URL:    "/file/" + url.PathEscape(ept.name) + "/ept.json",
+				Points: ept.info.Points,
+				Bounds: aabb{Min: [3]float64{b[0], b[1], b[2]}, Max: [3]float64{b[3], b[4], b[5]}},
+			}
+			crsErr = errors.New("dataset has no projection")
+			if p := ept.projection(); p != "" {
+				c, crsErr = parseCRS(p)
+			}
+		} else {
+			continue // neither a Potree nor an EPT dataset
+		}
+		if crsErr == nil {
+			entry.CRS = c
+		} else {
+			entry.CRSError = crsErr.Error()
+		}
+		catalog = append(catalog, entry)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(catalog)
+}
+
+// deleteDataset handles DELETE /datasets/{name} and removes a Potree or EPT
+// dataset that no stream or unfinished job uses
+func deleteDataset(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	dir, err := datasetDir(name)
+	if err != nil {
+		http.Error(w, "Dataset not found", http.StatusNotFound)
+		return
+	}
+	if _, err := openDataset(name); err != nil {
+		if _, eptErr := openEPT(name); eptErr != nil {
+			if errors.Is(err, errDatasetNotFound) && errors.Is(eptErr, errDatasetNotFound) {
+				http.Error(w, "Dataset not found", http.StatusNotFound)
+				return
+			}
+			if errors.Is(err, errDatasetNotFound) {
+				err = eptErr
+			}
+			http.Error(w, "Failed to read dataset", http.StatusInternalServerError)
+			requestLog(r).Error("Error reading dataset to delete", "error", err)
+			return
+		}
+	}
+
+	// the dataset is moved aside while no session or job can start, and
+	// removed after
+	mu.Lock()
+	jobsMu.Lock()
+	user := datasetUser(name)
+	trash := filepath.Join(cfg.DataDir, "."+name+"-deleted-"+uuid.New().String())
+	if user == "" {
+		err = os.Rename(dir, trash)
+	}
+	jobsMu.Unlock()
+	mu.Unlock()
+	if user != "" {
+		http.Error(w, "Dataset is in use by "+user, http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to delete dataset", http.StatusInternalServerError)
+		requestLog(r).Error("Error deleting dataset", "error", err)
+		return
+	}
+
+	if err := os.RemoveAll(trash); err != nil {
+		requestLog(r).Error("Error removing deleted dataset", "dir", trash, "error", err)
+	}
+	requestLog(r).Info("Dataset deleted")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// datasetUser names a session or unfinished job using a dataset, or returns
+// "" if there is none; callers hold mu and jobsMu
+func datasetUser(name string) string {
+	for _, s := range sessions {
+		if slices.Contains(s.datasets, name) {
+			return "session " + s.ID
+		}
+	}
+	for _, j := range jobs {
+		if j.Dataset == name && (j.Status == jobQueued || j.Status == jobRunning) {
+			return "job " + j.ID
+		}
+	}
+	return ""
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDeleteDataset(t *testing.T) {
+	withDataDir(t, t.TempDir())
+	for _, name := range []string{"free", "streamed", "converting", "queued", "converted"} {
+		writeTiny(t, name)
+	}
+	os.Mkdir(filepath.Join(cfg.DataDir, "broken"), 0o755)
+	os.WriteFile(filepath.Join(cfg.DataDir, "broken", "metadata.json"), []byte("{"), 0o644)
+
+	mu.Lock()
+	sessions["delete-test"] = &streamSession{ID: "delete-test", datasets: []string{"other", "streamed"}}
+	mu.Unlock()
+	jobsMu.Lock()
+	jobs["delete-running"] = &job{ID: "delete-running", Dataset: "converting", Status: jobRunning}
+	jobs["delete-queued"] = &job{ID: "delete-queued", Dataset: "queued", Status: jobQueued}
+	jobs["delete-done"] = &job{ID: "delete-done", Dataset: "converted", Status: jobDone}
+	jobsMu.Unlock()
+	t.Cleanup(func() {
+		mu.Lock()
+		delete(sessions, "delete-test")
+		mu.Unlock()
+		jobsMu.Lock()
+		delete(jobs, "delete-running")
+		delete(jobs, "delete-queued")
+		delete(jobs, "delete-done")
+		jobsMu.Unlock()
+	})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("DELETE /datasets/{name}", deleteDataset)
+	tests := []struct {
+		name string
+		want int
+		gone bool
+	}{
+		{"free", http.StatusNoContent, true},
+		{"free", http.StatusNotFound, true},
+		{"streamed", http.StatusConflict, false},
+		{"converting", http.StatusConflict, false},
+		{"queued", http.StatusConflict, false},
+		{"converted", http.StatusNoContent, true}, // finished jobs do not hold datasets
+		{"broken", http.StatusInternalServerError, false},
+		{"missing", http.StatusNotFound, true},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("DELETE", "/datasets/"+tt.name, nil))
+		if rec.Code != tt.want {
+			t.Errorf("DELETE %s = %d %q, want %d", tt.name, rec.Code, rec.Body.String(), tt.want)
+		}
+		if _, err := os.Stat(filepath.Join(cfg.DataDir, tt.name)); os.IsNotExist(err) != tt.gone {
+			t.Errorf("after DELETE %s the dataset exists = %v", tt.name, !tt.gone)
+		}
+	}
+
+	// nothing is left of the deleted datasets
+	entries, _ := os.ReadDir(cfg.DataDir)
+	var left []string
+	for _, e := range entries {
+		left = append(left, e.Name())
+	}
+	if len(left) != 4 {
+		t.Errorf("data directory holds %v, want broken, converting, queued and streamed", left)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chromedp/cdproto/network"
+	cdpruntime "github.com/chromedp/cdproto/runtime"
+	"github.com/chromedp/chromedp"
+)
+
+// maxDiagnostics is how many viewer problems a session keeps
+const maxDiagnostics = 50
+
+// browserDiagnostic is a console warning or error, an uncaught exception or
+// a failed request of the viewer
+type browserDiagnostic struct {
+	Time    time.Time `json:"time"`
+	Kind    string    `json:"kind"` // console, exception or network
+	Level   string    `json:"level"`
+	Message string    `json:"message"`
+	URL     string    `json:"url,omitempty"`
+}
+
+// browserDiagnostics collects the problems of a session's viewer
+type browserDiagnostics struct {
+	mu      sync.Mutex
+	entries []browserDiagnostic // the latest maxDiagnostics, oldest first
+}
+
+// add records a problem
+func (d *browserDiagnostics) add(kind string, level slog.Level, message, url string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.entries = append(d.entries, browserDiagnostic{
+		Time: time.Now(), Kind: kind, Level: strings.ToLower(level.String()), Message: message, URL: url,
+	})
+	if over := len(d.entries) - maxDiagnostics; over > 0 {
+		d.entries = slices.Delete(d.entries, 0, over)
+	}
+}
+
+// list returns the recorded problems
+func (d *browserDiagnostics) list() []browserDiagnostic {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]browserDiagnostic{}, d.entries...)
+}
+
+// firstNetworkFailure returns the first failed request, which usually
+// explains a point cloud that did not load
+func (d *browserDiagnostics) firstNetworkFailure() (browserDiagnostic, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, e := range d.entries {
+		if e.Kind == "network" {
+			return e, true
+		}
+	}
+	return browserDiagnostic{}, false
+}
+
+// watchBrowser writes the console messages, uncaught exceptions and failed
+// requests of the viewer in a session's Chrome to the session log, and
+// records the warnings and errors among them as diagnostics
+func watchBrowser(ctx context.Context, s *streamSession) {
+	// events arrive in order on one goroutine, so requests needs no lock
+	requests := map[network.RequestID]string{}
+	report := func(kind string, level slog.Level, message, url string) {
+		args := []any{"source", "chrome", "kind", kind}
+		if url != "" {
+			args = append(args, "url", url)
+		}
+		s.log.Log(context.Background(), level, message, args...)
+		if level >= slog.LevelWarn {
+			s.diagnostics.add(kind, level, message, url)
+		}
+	}
+
+	chromedp.ListenTarget(ctx, func(ev interface{}) {
+		switch ev := ev.(type) {
+		case *cdpruntime.EventConsoleAPICalled:
+			var url string
+			if ev.StackTrace != nil && len(ev.StackTrace.CallFrames) > 0 {
+				url = ev.StackTrace.CallFrames[0].URL
+			}
+			report("console", consoleLevel(ev.Type), consoleText(ev.Args), url)
+		case *cdpruntime.EventExceptionThrown:
+			report("exception", slog.LevelError, ev.ExceptionDetails.Error(), ev.ExceptionDetails.URL)
+		case *network.EventRequestWillBeSent:
+			requests[ev.RequestID] = ev.Request.Method + " " + ev.Request.URL
+		case *network.EventResponseReceived:
+			// requests of type Other, such as the favicon, do not affect the viewer
+			if ev.Response.Status >= 400 && ev.Type != network.ResourceTypeOther {
+				report("network", slog.LevelWarn, fmt.Sprintf("%s: %d %s", requests[ev.RequestID], ev.Response.Status, ev.Response.StatusText), ev.Response.URL)
+			}
+		case *network.EventLoadingFinished:
+			delete(requests, ev.RequestID)
+		case *network.EventLoadingFailed:
+			request := requests[ev.RequestID]
+			delete(requests, ev.RequestID)
+			// Potree cancels the requests of nodes that went out of view
+			if ev.Canceled || ev.Type == network.ResourceTypeOther {
+				return
+			}
+			message := request + ": " + ev.ErrorText
+			if ev.CorsErrorStatus != nil {
+				message += " (CORS " + ev.CorsErrorStatus.CorsError.String() + ")"
+			} else if ev.BlockedReason != "" {
+				message += " (blocked: " + ev.BlockedReason.String() + ")"
+			}
+			_, url, _ := strings.Cut(request, " ")
+			report("network", slog.LevelError, message, url)
+		}
+	})
+}
+
+// consoleLevel maps a console call to a log level
+func consoleLevel(t cdpruntime.APIType) slog.Level {
+	switch t {
+	case cdpruntime.APITypeError, cdpruntime.APITypeAssert:
+		return slog.LevelError
+	case cdpruntime.APITypeWarning:
+		return slog.LevelWarn
+	case cdpruntime.APITypeDebug, cdpruntime.APITypeTrace:
+		return slog.LevelDebug
+	}
+	return slog.LevelInfo
+}
+
+// consoleText joins the arguments of a console call like the console does
+func consoleText(args []*cdpruntime.RemoteObject) string {
+	parts := make([]string, 0, len(args))
+	for _, a := range args {
+		var text string
+		switch {
+		case a.Type == cdpruntime.TypeString:
+			json.Unmarshal(a.Value, &text)
+		case len(a.Value) > 0:
+			text = string(a.Value)
+		case a.UnserializableValue != "":
+			text = string(a.UnserializableValue)
+		case a.Description != "":
+			text = a.Description
+		default:
+			text = a.Type.String()
+		}
+		parts = append(parts, text)
+	}
+	return strings.Join(parts, " ")
+}
+
+// waitForPointClouds waits until the viewer has loaded every point cloud
+// or reports that one failed, and publishes when they are loaded. The error
+// gives the failure the viewer reported and the first failed request.
+func waitForPointClouds(ctx context.Context, s *streamSession) error {
+	var result struct {
+		Loaded bool   `json:"loaded"`
+		Error  string `json:"error"`
+	}
+	err := chromedp.Run(ctx, chromedp.Poll(
+		`(window.pointcloudsLoaded === true || window.pointcloudError) && {loaded: window.pointcloudsLoaded === true, error: String(window.pointcloudError || "")}`,
+		&result,
+		chromedp.WithPollingInterval(250*time.Millisecond),
+		chromedp.WithPollingTimeout(cfg.Browser.LoadTimeout),
+	))
+	if err == nil && result.Loaded {
+		publishSession(s, sessionPointCloudLoaded, "")
+		return nil
+	}
+
+	message := result.Error
+	if errors.Is(err, chromedp.ErrPollingTimeout) {
+		message = "not loaded within " + cfg.Browser.LoadTimeout.String()
+	} else if err != nil {
+		message = err.Error()
+	}
+	if failed, ok := s.diagnostics.firstNetworkFailure(); ok {
+		message += " (" + failed.Message + ")"
+	}
+	return errors.New(message)
+}
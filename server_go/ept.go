@@ -0,0 +1,691 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// eptInfo is the ept.json of an Entwine Point Tile dataset
+type eptInfo struct {
+	Bounds           [6]float64     `json:"bounds"`
+	BoundsConforming [6]float64     `json:"boundsConforming"`
+	DataType         string         `json:"dataType"` // "binary", "laszip" or "zstandard"
+	HierarchyType    string         `json:"hierarchyType"`
+	Points           int64          `json:"points"`
+	Schema           []eptDimension `json:"schema"`
+	Span             int            `json:"span"`
+	SRS              *eptSRS        `json:"srs,omitempty"`
+	Version          string         `json:"version"`
+}
+
+type eptDimension struct {
+	Name   string  `json:"name"`
+	Type   string  `json:"type"` // "signed", "unsigned" or "floating"
+	Size   int     `json:"size"`
+	Scale  float64 `json:"scale,omitempty"`
+	Offset float64 `json:"offset,omitempty"`
+}
+
+type eptSRS struct {
+	Authority  string `json:"authority,omitempty"`
+	Horizontal string `json:"horizontal,omitempty"`
+	Vertical   string `json:"vertical,omitempty"`
+	WKT        string `json:"wkt,omitempty"`
+}
+
+// eptNames maps Potree attribute names to EPT dimension names, one per element
+var eptNames = map[string][]string{
+	"position":          {"X", "Y", "Z"},
+	"intensity":         {"Intensity"},
+	"return number":     {"ReturnNumber"},
+	"number of returns": {"NumberOfReturns"},
+	"classification":    {"Classification"},
+	"scan angle rank":   {"ScanAngleRank"},
+	"scan angle":        {"ScanAngle"},
+	"user data":         {"UserData"},
+	"point source id":   {"PointSourceId"},
+	"gps-time":          {"GpsTime"},
+	"rgb":               {"Red", "Green", "Blue"},
+}
+
+// eptDataset is an opened EPT dataset under data/
+type eptDataset struct {
+	name string
+	dir  string
+	info eptInfo
+}
+
+// openEPT reads ept.json of a dataset, errDatasetNotFound if there is none
+func openEPT(name string) (*eptDataset, error) {
+	dir, err := datasetDir(name)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := os.ReadFile(filepath.Join(dir, "ept.json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errDatasetNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	e := &eptDataset{name: name, dir: dir}
+	if err := json.Unmarshal(raw, &e.info); err != nil {
+		return nil, fmt.Errorf("parse ept.json: %w", err)
+	}
+	if e.info.Span <= 0 {
+		return nil, errors.New("ept.json has no span")
+	}
+	return e, nil
+}
+
+func (e *eptDataset) cube() aabb {
+	b := e.info.Bounds
+	return aabb{Min: [3]float64{b[0], b[1], b[2]}, Max: [3]float64{b[3], b[4], b[5]}}
+}
+
+// projection returns the SRS as a definition parseCRS understands
+func (e *eptDataset) projection() string {
+	srs := e.info.SRS
+	if srs == nil {
+		return ""
+	}
+	if strings.EqualFold(srs.Authority, "EPSG") && srs.Horizontal != "" {
+		return "EPSG:" + srs.Horizontal
+	}
+	return srs.WKT
+}
+
+// srsFromProjection builds an EPT srs object from a Potree projection string
+func srsFromProjection(projection string) *eptSRS {
+	if projection == "" {
+		return nil
+	}
+	srs := &eptSRS{}
+	if c, err := parseCRS(projection); err == nil && c.EPSG != 0 {
+		srs.Authority, srs.Horizontal = "EPSG", strconv.Itoa(c.EPSG)
+	}
+	if strings.Contains(projection, "[") {
+		srs.WKT = projection
+	}
+	if *srs == (eptSRS{}) {
+		return nil
+	}
+	return srs
+}
+
+// eptKeyToNode converts an EPT key "D-X-Y-Z" to a Potree node name such as "r042"
+func eptKeyToNode(key string) (string, error) {
+	parts := strings.Split(key, "-")
+	if len(parts) != 4 {
+		return "", fmt.Errorf("invalid EPT key %q", key)
+	}
+	var v [4]int
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return "", fmt.Errorf("invalid EPT key %q", key)
+		}
+		v[i] = n
+	}
+	depth := v[0]
+	name := []byte{'r'}
+	for level := depth - 1; level >= 0; level-- {
+		index := (v[1]>>level&1)<<2 | (v[2]>>level&1)<<1 | v[3]>>level&1
+		name = append(name, byte('0'+index))
+	}
+	return string(name), nil
+}
+
+// nodeToEPTKey is the inverse of eptKeyToNode
+func nodeToEPTKey(name string) string {
+	var x, y, z int
+	for _, c := range name[1:] {
+		i := int(c - '0')
+		x, y, z = x<<1|i>>2&1, y<<1|i>>1&1, z<<1|i&1
+	}
+	return fmt.Sprintf("%d-%d-%d-%d", len(name)-1, x, y, z)
+}
+
+// hierarchy returns the point count of every node, following sub-hierarchy
+// files referenced with a count of -1
+func (e *eptDataset) hierarchy() (map[string]int64, error) {
+	out := map[string]int64{}
+	pending := []string{"0-0-0-0"}
+	for len(pending) > 0 {
+		page := pending[0]
+		pending = pending[1:]
+
+		raw, err := os.ReadFile(filepath.Join(e.dir, "ept-hierarchy", page+".json"))
+		if err != nil {
+			return nil, err
+		}
+		var counts map[string]int64
+		if err := json.Unmarshal(raw, &counts); err != nil {
+			return nil, fmt.Errorf("parse hierarchy page %s: %w", page, err)
+		}
+		for key, count := range counts {
+			if count == -1 {
+				pending = append(pending, key)
+				continue
+			}
+			out[key] = count
+		}
+	}
+	return out, nil
+}
+
+// eptFieldSource reads one EPT dimension of a point as a float64
+type eptFieldSource func(dim int) float64
+
+// eptDimensionType returns the Potree type of an EPT dimension
+func eptDimensionType(d eptDimension) (string, error) {
+	switch {
+	case d.Type == "floating" && d.Size == 4:
+		return "float", nil
+	case d.Type == "floating" && d.Size == 8:
+		return "double", nil
+	case d.Type == "signed" || d.Type == "unsigned":
+		bits := strconv.Itoa(8 * d.Size)
+		if d.Size != 1 && d.Size != 2 && d.Size != 4 && d.Size != 8 {
+			break
+		}
+		if d.Type == "unsigned" {
+			return "uint" + bits, nil
+		}
+		return "int" + bits, nil
+	}
+	return "", fmt.Errorf("unsupported EPT dimension %s of type %s/%d", d.Name, d.Type, d.Size)
+}
+
+// potreeLayout derives Potree attributes from the EPT schema. Each element
+// of each attribute is filled from the schema dimension at the same position
+// in the returned sources.
+func (e *eptDataset) potreeLayout() ([]potreeAttribute, [][]int, error) {
+	dims := map[string]int{}
+	for i, d := range e.info.Schema {
+		dims[d.Name] = i
+	}
+	for _, axis := range []string{"X", "Y", "Z"} {
+		if _, ok := dims[axis]; !ok {
+			return nil, nil, fmt.Errorf("EPT schema has no %s dimension", axis)
+		}
+	}
+
+	attrs := []potreeAttribute{newAttribute("position", "int32", 3)}
+	sources := [][]int{{dims["X"], dims["Y"], dims["Z"]}}
+	used := map[int]bool{dims["X"]: true, dims["Y"]: true, dims["Z"]: true}
+
+	// well known dimensions get the names PotreeConverter uses
+	for _, potreeName := range []string{"intensity", "return number", "number of returns", "classification",
+		"scan angle rank", "scan angle", "user data", "point source id", "gps-time", "rgb"} {
+		var src []int
+		for _, n := range eptNames[potreeName] {
+			if i, ok := dims[n]; ok {
+				src = append(src, i)
+			}
+		}
+		if len(src) != len(eptNames[potreeName]) {
+			continue
+		}
+		typ, err := eptDimensionType(e.info.Schema[src[0]])
+		if err != nil {
+			return nil, nil, err
+		}
+		if potreeName == "rgb" {
+			typ = "uint16"
+		}
+		attrs = append(attrs, newAttribute(potreeName, typ, len(src)))
+		sources = append(sources, src)
+		for _, i := range src {
+			used[i] = true
+		}
+	}
+	// everything else is kept as an extra attribute of the same name
+	for i, d := range e.info.Schema {
+		if used[i] {
+			continue
+		}
+		typ, err := eptDimensionType(d)
+		if err != nil {
+			return nil, nil, err
+		}
+		attrs = append(attrs, newAttribute(d.Name, typ, 1))
+		sources = append(sources, []int{i})
+	}
+	return attrs, sources, nil
+}
+
+// binaryOffsets returns the offset of each dimension in an EPT binary record and the record size
+func (e *eptDataset) binaryOffsets() ([]int, int) {
+	offsets := make([]int, len(e.info.Schema))
+	size := 0
+	for i, d := range e.info.Schema {
+		offsets[i] = size
+		size += d.Size
+	}
+	return offsets, size
+}
+
+// forEachNodePoint decodes every point of an EPT node
+func (e *eptDataset) forEachNodePoint(ctx context.Context, key string, fn func(src eptFieldSource) error) error {
+	switch e.info.DataType {
+	case "binary":
+		raw, err := os.ReadFile(filepath.Join(e.dir, "ept-data", key+".bin"))
+		if err != nil {
+			return err
+		}
+		offsets, size := e.binaryOffsets()
+		attrs := make([]potreeAttribute, len(e.info.Schema))
+		for i, d := range e.info.Schema {
+			typ, err := eptDimensionType(d)
+			if err != nil {
+				return err
+			}
+			attrs[i] = newAttribute(d.Name, typ, 1)
+		}
+		var rec []byte
+		src := func(dim int) float64 {
+			v := attrs[dim].value(rec[offsets[dim]:], 0)
+			if d := e.info.Schema[dim]; d.Scale != 0 {
+				v = v*d.Scale + d.Offset
+			}
+			return v
+		}
+		for r := 0; r+size <= len(raw); r += size {
+			rec = raw[r : r+size]
+			if err := fn(src); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case "laszip":
+		return e.forEachLAZPoint(ctx, filepath.Join(e.dir, "ept-data", key+".laz"), fn)
+	}
+	return fmt.Errorf("EPT data type %q is not supported", e.info.DataType)
+}
+
+// forEachLAZPoint decompresses a node with the laszip CLI and maps LAS
+// fields onto the schema dimensions
+func (e *eptDataset) forEachLAZPoint(ctx context.Context, path string, fn func(src eptFieldSource) error) error {
+	if !laszipFound {
+		return errNoLASzip
+	}
+	tmp, err := os.MkdirTemp("", "ept-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	las := filepath.Join(tmp, "node.las")
+	if out, err := exec.CommandContext(ctx, cfg.LASzip, "-i", path, "-o", las).CombinedOutput(); err != nil {
+		return fmt.Errorf("laszip: %w: %s", err, out)
+	}
+
+	var p point
+	fields := make([]func() float64, len(e.info.Schema))
+	for i, d := range e.info.Schema {
+		switch d.Name {
+		case "X":
+			fields[i] = func() float64 { return p.X }
+		case "Y":
+			fields[i] = func() float64 { return p.Y }
+		case "Z":
+			fields[i] = func() float64 { return p.Z }
+		case "Intensity":
+			fields[i] = func() float64 { return float64(p.Intensity) }
+		case "ReturnNumber":
+			fields[i] = func() float64 { return float64(p.ReturnNumber) }
+		case "NumberOfReturns":
+			fields[i] = func() float64 { return float64(p.NumberOfReturns) }
+		case "Classification":
+			fields[i] = func() float64 { return float64(p.Classification) }
+		case "ScanAngleRank", "ScanAngle":
+			fields[i] = func() float64 { return float64(p.ScanAngle) }
+		case "UserData":
+			fields[i] = func() float64 { return float64(p.UserData) }
+		case "PointSourceId":
+			fields[i] = func() float64 { return float64(p.PointSourceID) }
+		case "GpsTime":
+			fields[i] = func() float64 { return p.GPSTime }
+		case "Red":
+			fields[i] = func() float64 { return float64(p.R) }
+		case "Green":
+			fields[i] = func() float64 { return float64(p.G) }
+		case "Blue":
+			fields[i] = func() float64 { return float64(p.B) }
+		default:
+			// flags and extra bytes are not decoded
+			fields[i] = func() float64 { return 0 }
+		}
+	}
+	src := func(dim int) float64 { return fields[dim]() }
+	return readLAS(las, func(lp *point) error {
+		p = *lp
+		return fn(src)
+	})
+}
+
+// readLAS streams the points of an uncompressed LAS 1.0 to 1.4 file
+func readLAS(path string, fn func(p *point) error) error {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if len(raw) < lasHeaderSize || string(raw[:4]) != "LASF" {
+		return errors.New("not a LAS file")
+	}
+	le := binary.LittleEndian
+	dataOffset := int(le.Uint32(raw[96:]))
+	format := raw[104] & 0x3f // the top bits flag compression
+	recordLength := int(le.Uint16(raw[105:]))
+	count := int(le.Uint32(raw[107:]))
+	if count == 0 && le.Uint16(raw[94:]) >= 375 {
+		count = int(le.Uint64(raw[247:]))
+	}
+	var scale, offset [3]float64
+	for i := 0; i < 3; i++ {
+		scale[i] = math.Float64frombits(le.Uint64(raw[131+8*i:]))
+		offset[i] = math.Float64frombits(le.Uint64(raw[155+8*i:]))
+	}
+
+	// offsets of GPS time and RGB per point data record format, -1 if absent
+	gpsAt, rgbAt := -1, -1
+	switch format {
+	case 0:
+	case 1, 4:
+		gpsAt = 20
+	case 2:
+		rgbAt = 20
+	case 3, 5:
+		gpsAt, rgbAt = 20, 28
+	case 6, 9:
+		gpsAt = 22
+	case 7, 8, 10:
+		gpsAt, rgbAt = 22, 30
+	default:
+		return fmt.Errorf("unsupported LAS point format %d", format)
+	}
+
+	var p point
+	for i := 0; i < count; i++ {
+		start := dataOffset + i*recordLength
+		if start+recordLength > len(raw) {
+			return errors.New("LAS file is truncated")
+		}
+		rec := raw[start:]
+		p = point{
+			X:         float64(int32(le.Uint32(rec[0:])))*scale[0] + offset[0],
+			Y:         float64(int32(le.Uint32(rec[4:])))*scale[1] + offset[1],
+			Z:         float64(int32(le.Uint32(rec[8:])))*scale[2] + offset[2],
+			Intensity: le.Uint16(rec[12:]),
+		}
+		if format < 6 {
+			p.ReturnNumber = rec[14] & 0x07
+			p.NumberOfReturns = rec[14] >> 3 & 0x07
+			p.Classification = rec[15] & 0x1f
+			p.ScanAngle = int16(int8(rec[16]))
+			p.UserData = rec[17]
+			p.PointSourceID = le.Uint16(rec[18:])
+		} else {
+			p.ReturnNumber = rec[14] & 0x0f
+			p.NumberOfReturns = rec[14] >> 4
+			p.Classification = rec[16]
+			p.UserData = rec[17]
+			p.ScanAngle = int16(le.Uint16(rec[18:]))
+			p.PointSourceID = le.Uint16(rec[20:])
+		}
+		if gpsAt >= 0 {
+			p.GPSTime = math.Float64frombits(le.Uint64(rec[gpsAt:]))
+		}
+		if rgbAt >= 0 {
+			p.R, p.G, p.B = le.Uint16(rec[rgbAt:]), le.Uint16(rec[rgbAt+2:]), le.Uint16(rec[rgbAt+4:])
+		}
+		if err := fn(&p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// eptToPotree writes an EPT dataset as a new Potree 2.0 dataset. Positions
+// keep the EPT scale and offset when X, Y and Z are scaled integers.
+func eptToPotree(ctx context.Context, e *eptDataset, output string) error {
+	attrs, sources, err := e.potreeLayout()
+	if err != nil {
+		return err
+	}
+	hierarchy, err := e.hierarchy()
+	if err != nil {
+		return err
+	}
+
+	cube := e.cube()
+	var meta potreeMetadata
+	meta.Description = "Converted from EPT dataset " + e.name
+	meta.Projection = e.projection()
+	meta.Spacing = (cube.Max[0] - cube.Min[0]) / float64(e.info.Span)
+	meta.BoundingBox.Min, meta.BoundingBox.Max = cube.Min, cube.Max
+	meta.Attributes = attrs
+	meta.Scale, meta.Offset = [3]float64{0.001, 0.001, 0.001}, cube.Min
+	for i, axis := range sources[0] {
+		if d := e.info.Schema[axis]; d.Type == "signed" && d.Size == 4 && d.Scale != 0 {
+			meta.Scale[i], meta.Offset[i] = d.Scale, d.Offset
+		}
+	}
+
+	w, err := createDataset(output, meta)
+	if err != nil {
+		return err
+	}
+	done := 0
+	for key, count := range hierarchy {
+		if err := ctx.Err(); err != nil {
+			w.abort()
+			return err
+		}
+		reportProgress(ctx, done, len(hierarchy))
+		done++
+		if count == 0 {
+			continue
+		}
+		name, err := eptKeyToNode(key)
+		if err != nil {
+			w.abort()
+			return err
+		}
+
+		records := make([]byte, 0, count*int64(w.pointSize))
+		rec := make([]byte, w.pointSize)
+		err = e.forEachNodePoint(ctx, key, func(src eptFieldSource) error {
+			for a := range attrs {
+				attr := &w.meta.Attributes[a]
+				for el, dim := range sources[a] {
+					v := src(dim)
+					if a == 0 {
+						v = (v - meta.Offset[el]) / meta.Scale[el]
+					}
+					attr.putValue(rec[w.offsets[a]:], el, v)
+				}
+			}
+			records = append(records, rec...)
+			return nil
+		})
+		if err == nil {
+			err = w.writeNode(name, records)
+		}
+		if err != nil {
+			w.abort()
+			return fmt.Errorf("node %s: %w", key, err)
+		}
+	}
+	return w.close()
+}
+
+// potreeToEPT writes a Potree dataset as a new EPT dataset with binary
+// data. EPT binary records share Potree's interleaved layout, so node data
+// is copied unchanged and the schema describes each attribute element.
+func potreeToEPT(ctx context.Context, d *potreeDataset, output string) error {
+	dir, err := datasetDir(output)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(dir); err == nil {
+		return errDatasetExists
+	}
+	staging, err := os.MkdirTemp(cfg.DataDir, "."+output+"-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+
+	var schema []eptDimension
+	for _, a := range d.meta.Attributes {
+		kind := "unsigned"
+		switch {
+		case a.Type == "float" || a.Type == "double":
+			kind = "floating"
+		case strings.HasPrefix(a.Type, "int"):
+			kind = "signed"
+		}
+		names := eptNames[a.Name]
+		if len(names) != a.NumElements {
+			names = nil
+			for e := 0; e < a.NumElements; e++ {
+				if a.NumElements == 1 {
+					names = append(names, a.Name)
+				} else {
+					names = append(names, a.Name+strconv.Itoa(e))
+				}
+			}
+		}
+		for e, n := range names {
+			dim := eptDimension{Name: n, Type: kind, Size: a.ElementSize}
+			if a.Name == "position" {
+				dim.Scale, dim.Offset = d.meta.Scale[e], d.meta.Offset[e]
+			}
+			schema = append(schema, dim)
+		}
+	}
+
+	for _, sub := range []string{"ept-data", "ept-hierarchy"} {
+		if err := os.MkdirAll(filepath.Join(staging, sub), os.ModePerm); err != nil {
+			return err
+		}
+	}
+	octree, err := d.openOctree()
+	if err != nil {
+		return err
+	}
+	defer octree.Close()
+
+	counts := map[string]int64{}
+	nodes := d.nodes(-1, nil)
+	for i, n := range nodes {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		reportProgress(ctx, i, len(nodes))
+		records, err := octree.readNode(n)
+		if err != nil {
+			return err
+		}
+		key := nodeToEPTKey(n.name)
+		if err := os.WriteFile(filepath.Join(staging, "ept-data", key+".bin"), records, 0o644); err != nil {
+			return err
+		}
+		counts[key] = int64(n.numPoints)
+	}
+	raw, err := json.Marshal(counts)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(staging, "ept-hierarchy", "0-0-0-0.json"), raw, 0o644); err != nil {
+		return err
+	}
+
+	cube, ext := d.bounds(), d.extent()
+	info := eptInfo{
+		Bounds:           [6]float64{cube.Min[0], cube.Min[1], cube.Min[2], cube.Max[0], cube.Max[1], cube.Max[2]},
+		BoundsConforming: [6]float64{ext.Min[0], ext.Min[1], ext.Min[2], ext.Max[0], ext.Max[1], ext.Max[2]},
+		DataType:         "binary",
+		HierarchyType:    "json",
+		Points:           d.meta.Points,
+		Schema:           schema,
+		Span:             int(math.Round((cube.Max[0] - cube.Min[0]) / d.meta.Spacing)),
+		SRS:              srsFromProjection(d.meta.Projection),
+		Version:          "1.0.0",
+	}
+	raw, err = json.MarshalIndent(info, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(staging, "ept.json"), raw, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(staging, dir)
+}
+
+// convertDataset handles POST /datasets/{name}/convert and starts a job
+// converting between Potree 2.0 and EPT into a new dataset under data/
+func convertDataset(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+
+	var requestBody struct {
+		To     string `json:"to"`     // "ept" or "potree"
+		Output string `json:"output"` // name of the new dataset
+	}
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	outputDir, err := datasetDir(requestBody.Output)
+	if err != nil {
+		http.Error(w, "output must be a valid dataset name", http.StatusBadRequest)
+		return
+	}
+	if _, err := os.Stat(outputDir); err == nil {
+		http.Error(w, "Output dataset already exists", http.StatusConflict)
+		return
+	}
+
+	switch requestBody.To {
+	case "ept":
+		d, ok := openDatasetForRequest(w, name)
+		if !ok {
+			return
+		}
+		j := startJob("convert", name, func(ctx context.Context, dir string) ([]string, error) {
+			return []string{}, potreeToEPT(ctx, d, requestBody.Output)
+		})
+		writeJob(w, http.StatusAccepted, j)
+
+	case "potree":
+		e, err := openEPT(name)
+		if errors.Is(err, errDatasetNotFound) {
+			http.Error(w, "EPT dataset not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		j := startJob("convert", name, func(ctx context.Context, dir string) ([]string, error) {
+			return []string{}, eptToPotree(ctx, e, requestBody.Output)
+		})
+		writeJob(w, http.StatusAccepted, j)
+
+	default:
+		http.Error(w, "to must be ept or potree", http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Session lifecycle states, published as session events
+const (
+	sessionIdle             = "idle"
+	sessionBrowserLaunched  = "browser-launched"
+	sessionPointCloudLoaded = "pointcloud-loaded"
+	sessionEncoderStarted   = "encoder-started"
+	sessionSegmentWritten   = "segment-written" // the first segment is available
+	sessionEncoderCrashed   = "encoder-crashed"
+	sessionStopped          = "stopped"
+)
+
+// maxEventHistory is how many events are kept for clients that reconnect
+// with Last-Event-ID
+const maxEventHistory = 256
+
+// event is pushed to /events subscribers
+type event struct {
+	ID      int64     `json:"id"`
+	Type    string    `json:"type"` // "session" or "job"
+	Session string    `json:"session,omitempty"`
+	State   string    `json:"state,omitempty"`
+	Message string    `json:"message,omitempty"`
+	Job     *job      `json:"job,omitempty"`
+	Time    time.Time `json:"time"`
+
+	owner *principal // who started the session
+}
+
+var (
+	eventsMu     sync.Mutex
+	eventSeq     int64
+	eventHistory []event
+	subscribers  = map[chan event]struct{}{}
+
+	// the last event of each running session, sent to new subscribers
+	sessionEvents = map[string]event{}
+)
+
+// publish sends an event to every subscriber. Subscribers that fall behind
+// are dropped and reconnect with Last-Event-ID.
+func publish(e event) {
+	eventsMu.Lock()
+	defer eventsMu.Unlock()
+	publishLocked(e)
+}
+
+// publishLocked is publish for callers that hold eventsMu
+func publishLocked(e event) {
+	eventSeq++
+	e.ID = eventSeq
+	e.Time = time.Now()
+	eventHistory = append(eventHistory, e)
+	if len(eventHistory) > maxEventHistory {
+		eventHistory = eventHistory[len(eventHistory)-maxEventHistory:]
+	}
+	if e.Type == "session" {
+		if e.State == sessionStopped || e.State == sessionEncoderCrashed {
+			delete(sessionEvents, e.Session)
+		} else {
+			sessionEvents[e.Session] = e
+		}
+	}
+	for ch := range subscribers {
+		select {
+		case ch <- e:
+		default:
+			delete(subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// publishSession publishes a session lifecycle event. Events of a start
+// step that lost the race with the end of the session are dropped, so they
+// do not bring the ended session back for subscribers.
+func publishSession(s *streamSession, state, message string) {
+	eventsMu.Lock()
+	if s.ended {
+		eventsMu.Unlock()
+		return
+	}
+	s.ended = state == sessionStopped || state == sessionEncoderCrashed
+	publishLocked(event{Type: "session", Session: s.ID, State: state, Message: message, owner: s.Owner})
+	eventsMu.Unlock()
+
+	level, args := slog.LevelInfo, []any{"state", state}
+	if state == sessionEncoderCrashed {
+		level = slog.LevelWarn
+	}
+	if message != "" {
+		args = append(args, "message", message)
+	}
+	s.log.Log(context.Background(), level, "Session "+state, args...)
+	observeSessionState(s.ID, state)
+}
+
+// sessionState returns the last published state of a running session
+func sessionState(session string) string {
+	eventsMu.Lock()
+	defer eventsMu.Unlock()
+	if e, ok := sessionEvents[session]; ok {
+		return e.State
+	}
+	return "starting" // admitted, Chrome not launched yet
+}
+
+// publishJob publishes a snapshot of a job without its log; callers hold jobsMu
+func publishJob(j *job) {
+	snapshot := *j
+	snapshot.Log = nil
+	publish(event{Type: "job", Job: &snapshot})
+}
+
+// subscribe returns a channel of new events, preceded by the events after
+// lastID or, without one, by the state of the running sessions or idle
+func subscribe(lastID int64) (chan event, []event) {
+	eventsMu.Lock()
+	defer eventsMu.Unlock()
+	var backlog []event
+	if lastID > 0 {
+		for _, e := range eventHistory {
+			if e.ID > lastID {
+				backlog = append(backlog, e)
+			}
+		}
+	} else {
+		for _, e := range sessionEvents {
+			backlog = append(backlog, e)
+		}
+		slices.SortFunc(backlog, func(a, b event) int { return cmp.Compare(a.ID, b.ID) })
+		if len(backlog) == 0 {
+			backlog = append(backlog, event{Type: "session", State: sessionIdle, Time: time.Now()})
+		}
+	}
+	ch := make(chan event, 64)
+	subscribers[ch] = struct{}{}
+	return ch, backlog
+}
+
+// unsubscribe stops delivery to ch
+func unsubscribe(ch chan event) {
+	eventsMu.Lock()
+	defer eventsMu.Unlock()
+	if _, ok := subscribers[ch]; ok {
+		delete(subscribers, ch)
+		close(ch)
+	}
+}
+
+// closeSubscribers ends every event stream
+func closeSubscribers() {
+	eventsMu.Lock()
+	defer eventsMu.Unlock()
+	for ch := range subscribers {
+		delete(subscribers, ch)
+		close(ch)
+	}
+}
+
+// streamEvents handles GET /events, a Server-Sent Events feed of session
+// and job events. ?type=session or ?type=job limits the feed to one kind.
+func streamEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	kind := r.URL.Query().Get("type")
+	if kind != "" && kind != "session" && kind != "job" {
+		http.Error(w, "type must be session or job", http.StatusBadRequest)
+		return
+	}
+	lastID, _ := strconv.ParseInt(r.Header.Get("Last-Event-ID"), 10, 64)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	ch, backlog := subscribe(lastID)
+	defer unsubscribe(ch)
+
+	// callers only see their own sessions and jobs of datasets they can view
+	p := principalFrom(r)
+	visible := func(e event) bool {
+		switch {
+		case kind != "" && e.Type != kind:
+			return false
+		case e.Type == "job":
+			return p.allowed(e.Job.Dataset, permView)
+		default:
+			return e.Session == "" || p.owns(e.owner)
+		}
+	}
+	send := func(e event) error {
+		if !visible(e) {
+			return nil
+		}
+		raw, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, raw); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+	for _, e := range backlog {
+		if err := send(e); err != nil {
+			return
+		}
+	}
+
+	// comments keep idle connections open through proxies
+	ping := time.NewTicker(15 * time.Second)
+	defer ping.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e, ok := <-ch:
+			if !ok {
+				return
+			}
+			if err := send(e); err != nil {
+				return
+			}
+		case <-ping.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
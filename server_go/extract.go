@@ -0,0 +1,417 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"mime"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// region selects points by a 3D box or a 2D polygon with a Z range
+type region struct {
+	bounds  aabb
+	polygon [][2]float64
+}
+
+// newRegion builds a region from a request; zRange is only used with polygons
+func newRegion(box *aabb, polygon [][2]float64, zRange *[2]float64, datasetBounds aabb) (*region, error) {
+	switch {
+	case box != nil && polygon != nil:
+		return nil, errors.New("specify either box or polygon, not both")
+	case box != nil:
+		for i := 0; i < 3; i++ {
+			if box.Min[i] > box.Max[i] {
+				return nil, errors.New("box min must not exceed max")
+			}
+		}
+		return &region{bounds: *box}, nil
+	case polygon != nil:
+		if len(polygon) < 3 {
+			return nil, errors.New("polygon needs at least 3 vertices")
+		}
+		r := &region{polygon: polygon}
+		r.bounds.Min = [3]float64{math.Inf(1), math.Inf(1), datasetBounds.Min[2]}
+		r.bounds.Max = [3]float64{math.Inf(-1), math.Inf(-1), datasetBounds.Max[2]}
+		for _, v := range polygon {
+			r.bounds.Min[0] = math.Min(r.bounds.Min[0], v[0])
+			r.bounds.Min[1] = math.Min(r.bounds.Min[1], v[1])
+			r.bounds.Max[0] = math.Max(r.bounds.Max[0], v[0])
+			r.bounds.Max[1] = math.Max(r.bounds.Max[1], v[1])
+		}
+		if zRange != nil {
+			if zRange[0] > zRange[1] {
+				return nil, errors.New("zRange min must not exceed max")
+			}
+			r.bounds.Min[2], r.bounds.Max[2] = zRange[0], zRange[1]
+		}
+		return r, nil
+	}
+	return nil, errors.New("either box or polygon is required")
+}
+
+func (r *region) contains(x, y, z float64) bool {
+	if !r.bounds.contains(x, y, z) {
+		return false
+	}
+	return r.polygon == nil || pointInPolygon(r.polygon, x, y)
+}
+
+// pointInPolygon is the even-odd ray casting test
+func pointInPolygon(poly [][2]float64, x, y float64) bool {
+	inside := false
+	for i, j := 0, len(poly)-1; i < len(poly); j, i = i, i+1 {
+		xi, yi := poly[i][0], poly[i][1]
+		xj, yj := poly[j][0], poly[j][1]
+		if (yi > y) != (yj > y) && x < (xj-xi)*(y-yi)/(yj-yi)+xi {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// extractSummary describes the points written to an extract body
+type extractSummary struct {
+	count          int64
+	bounds         aabb
+	pointsByReturn [5]uint32
+	scale          [3]float64
+	offset         [3]float64
+}
+
+func (s *extractSummary) add(p *point) {
+	if s.count == 0 {
+		s.bounds = aabb{Min: [3]float64{p.X, p.Y, p.Z}, Max: [3]float64{p.X, p.Y, p.Z}}
+	}
+	for i, v := range [3]float64{p.X, p.Y, p.Z} {
+		s.bounds.Min[i] = math.Min(s.bounds.Min[i], v)
+		s.bounds.Max[i] = math.Max(s.bounds.Max[i], v)
+	}
+	if p.ReturnNumber >= 1 && p.ReturnNumber <= 5 {
+		s.pointsByReturn[p.ReturnNumber-1]++
+	}
+	s.count++
+}
+
+// pointEncoder writes points in one output format; the header is written
+// after all points are known so that counts and bounds are exact
+type pointEncoder interface {
+	contentType() string
+	extension() string
+	writeHeader(w io.Writer, s *extractSummary) error
+	writePoint(w io.Writer, s *extractSummary, p *point) error
+}
+
+var pointEncoders = map[string]pointEncoder{
+	"las": lasEncoder{},
+	"laz": lasEncoder{},
+	"csv": csvEncoder{},
+	"ply": plyEncoder{},
+}
+
+// lasEncoder writes LAS 1.2 with point data record format 3
+type lasEncoder struct{}
+
+const (
+	lasHeaderSize   = 227
+	lasRecordLength = 34
+)
+
+func (lasEncoder) contentType() string { return "application/vnd.las" }
+func (lasEncoder) extension() string   { return "las" }
+
+func (lasEncoder) writeHeader(w io.Writer, s *extractSummary) error {
+	h := make([]byte, lasHeaderSize)
+	le := binary.LittleEndian
+	copy(h[0:], "LASF")
+	h[24], h[25] = 1, 2 // version 1.2
+	copy(h[26:58], "gis-poc")
+	copy(h[58:90], "gis-poc extract")
+	now := time.Now().UTC()
+	le.PutUint16(h[90:], uint16(now.YearDay()))
+	le.PutUint16(h[92:], uint16(now.Year()))
+	le.PutUint16(h[94:], lasHeaderSize)
+	le.PutUint32(h[96:], lasHeaderSize) // offset to point data, no VLRs
+	le.PutUint32(h[100:], 0)
+	h[104] = 3
+	le.PutUint16(h[105:], lasRecordLength)
+	if s.count > math.MaxUint32 {
+		return errors.New("too many points for LAS 1.2")
+	}
+	le.PutUint32(h[107:], uint32(s.count))
+	for i, n := range s.pointsByReturn {
+		le.PutUint32(h[111+4*i:], n)
+	}
+	for i := 0; i < 3; i++ {
+		le.PutUint64(h[131+8*i:], math.Float64bits(s.scale[i]))
+		le.PutUint64(h[155+8*i:], math.Float64bits(s.offset[i]))
+		le.PutUint64(h[179+16*i:], math.Float64bits(s.bounds.Max[i]))
+		le.PutUint64(h[187+16*i:], math.Float64bits(s.bounds.Min[i]))
+	}
+	_, err := w.Write(h)
+	return err
+}
+
+func (lasEncoder) writePoint(w io.Writer, s *extractSummary, p *point) error {
+	var rec [lasRecordLength]byte
+	le := binary.LittleEndian
+	for i, v := range [3]float64{p.X, p.Y, p.Z} {
+		le.PutUint32(rec[4*i:], uint32(int32(math.Round((v-s.offset[i])/s.scale[i]))))
+	}
+	le.PutUint16(rec[12:], p.Intensity)
+	rec[14] = p.ReturnNumber&0x07 | (p.NumberOfReturns&0x07)<<3
+	rec[15] = p.Classification
+	rec[16] = byte(int8(max(-90, min(90, p.ScanAngle))))
+	rec[17] = p.UserData
+	le.PutUint16(rec[18:], p.PointSourceID)
+	le.PutUint64(rec[20:], math.Float64bits(p.GPSTime))
+	le.PutUint16(rec[28:], p.R)
+	le.PutUint16(rec[30:], p.G)
+	le.PutUint16(rec[32:], p.B)
+	_, err := w.Write(rec[:])
+	return err
+}
+
+// csvEncoder writes one point per line with a column header
+type csvEncoder struct{}
+
+func (csvEncoder) contentType() string { return "text/csv" }
+func (csvEncoder) extension() string   { return "csv" }
+
+func (csvEncoder) writeHeader(w io.Writer, s *extractSummary) error {
+	_, err := io.WriteString(w, "x,y,z,intensity,classification,return_number,number_of_returns,red,green,blue,gps_time\n")
+	return err
+}
+
+func (csvEncoder) writePoint(w io.Writer, s *extractSummary, p *point) error {
+	_, err := fmt.Fprintf(w, "%s,%s,%s,%d,%d,%d,%d,%d,%d,%d,%s\n",
+		strconv.FormatFloat(p.X, 'f', scaleDecimals(s.scale[0]), 64),
+		strconv.FormatFloat(p.Y, 'f', scaleDecimals(s.scale[1]), 64),
+		strconv.FormatFloat(p.Z, 'f', scaleDecimals(s.scale[2]), 64),
+		p.Intensity, p.Classification, p.ReturnNumber, p.NumberOfReturns,
+		p.R, p.G, p.B,
+		strconv.FormatFloat(p.GPSTime, 'f', -1, 64),
+	)
+	return err
+}
+
+// scaleDecimals returns the number of decimals needed to print a coordinate quantized to scale
+func scaleDecimals(scale float64) int {
+	if scale <= 0 || scale >= 1 {
+		return 0
+	}
+	return int(math.Ceil(-math.Log10(scale) - 1e-9))
+}
+
+// plyEncoder writes binary little endian PLY with double precision coordinates
+type plyEncoder struct{}
+
+func (plyEncoder) contentType() string { return "application/octet-stream" }
+func (plyEncoder) extension() string   { return "ply" }
+
+func (plyEncoder) writeHeader(w io.Writer, s *extractSummary) error {
+	_, err := fmt.Fprintf(w, "ply\nformat binary_little_endian 1.0\ncomment generated by gis-poc\n"+
+		"element vertex %d\n"+
+		"property double x\nproperty double y\nproperty double z\n"+
+		"property uchar red\nproperty uchar green\nproperty uchar blue\n"+
+		"property ushort intensity\nproperty uchar classification\n"+
+		"end_header\n", s.count)
+	return err
+}
+
+func (plyEncoder) writePoint(w io.Writer, s *extractSummary, p *point) error {
+	var rec [30]byte
+	le := binary.LittleEndian
+	le.PutUint64(rec[0:], math.Float64bits(p.X))
+	le.PutUint64(rec[8:], math.Float64bits(p.Y))
+	le.PutUint64(rec[16:], math.Float64bits(p.Z))
+	rec[24], rec[25], rec[26] = colorByte(p.R), colorByte(p.G), colorByte(p.B)
+	le.PutUint16(rec[27:], p.Intensity)
+	rec[29] = p.Classification
+	_, err := w.Write(rec[:])
+	return err
+}
+
+// colorByte converts a Potree rgb channel to 8 bits, the way Potree's shaders do
+func colorByte(c uint16) byte {
+	if c > 255 {
+		return byte(c / 256)
+	}
+	return byte(c)
+}
+
+// extractPoints handles POST /datasets/{name}/extract
+func extractPoints(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+
+	var requestBody struct {
+		Box     *aabb        `json:"box"`
+		Polygon [][2]float64 `json:"polygon"`
+		ZRange  *[2]float64  `json:"zRange"`
+		LOD     *int         `json:"lod"`
+		Format  string       `json:"format"`
+		// CRS of box and polygon, e.g. "EPSG:4326" for lon/lat; the dataset CRS if empty
+		CRS string `json:"crs"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	format := requestBody.Format
+	if format == "" {
+		format = "las"
+	}
+	enc, ok := pointEncoders[format]
+	if !ok {
+		http.Error(w, "Unsupported format, use las, laz, csv or ply", http.StatusBadRequest)
+		return
+	}
+	if format == "laz" && !laszipFound {
+		http.Error(w, "LAZ output needs laszip, which is not installed", http.StatusNotImplemented)
+		return
+	}
+
+	d, ok := openDatasetForRequest(w, name)
+	if !ok {
+		return
+	}
+
+	if requestBody.CRS != "" {
+		// a box is only axis aligned in its own CRS, transform its corners as a polygon
+		if b := requestBody.Box; b != nil && requestBody.Polygon == nil {
+			requestBody.Polygon = [][2]float64{{b.Min[0], b.Min[1]}, {b.Max[0], b.Min[1]}, {b.Max[0], b.Max[1]}, {b.Min[0], b.Max[1]}}
+			if requestBody.ZRange == nil {
+				requestBody.ZRange = &[2]float64{b.Min[2], b.Max[2]}
+			}
+			requestBody.Box = nil
+		}
+		if err := d.localizeXY(requestBody.CRS, requestBody.Polygon); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	reg, err := newRegion(requestBody.Box, requestBody.Polygon, requestBody.ZRange, d.bounds())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	maxLevel := -1
+	if requestBody.LOD != nil {
+		maxLevel = *requestBody.LOD
+	}
+
+	// Points are encoded into a temporary body first, headers need the final count
+	body, err := os.CreateTemp("", "extract-*."+enc.extension())
+	if err != nil {
+		http.Error(w, "Failed to create extract", http.StatusInternalServerError)
+		requestLog(r).Error("Error creating extract file", "error", err)
+		return
+	}
+	defer os.Remove(body.Name())
+	defer body.Close()
+
+	summary := &extractSummary{scale: d.meta.Scale, offset: d.meta.Offset}
+	bw := bufio.NewWriter(body)
+	err = d.forEachPointIn(r.Context(), reg, maxLevel, func(p *point) error {
+		summary.add(p)
+		return enc.writePoint(bw, summary, p)
+	})
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err != nil {
+		http.Error(w, "Failed to extract points", http.StatusInternalServerError)
+		requestLog(r).Error("Error extracting points", "error", err)
+		return
+	}
+
+	out := io.Reader(body)
+	if format == "laz" {
+		laz, err := compressLAZ(r.Context(), enc, summary, body)
+		if err != nil {
+			http.Error(w, "Failed to compress LAZ", http.StatusInternalServerError)
+			requestLog(r).Error("Error compressing LAZ", "error", err)
+			return
+		}
+		defer os.Remove(laz.Name())
+		defer laz.Close()
+		out = laz
+	} else if _, err := body.Seek(0, io.SeekStart); err != nil {
+		http.Error(w, "Failed to read extract", http.StatusInternalServerError)
+		requestLog(r).Error("Error rewinding extract", "error", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", enc.contentType())
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name + "-extract." + format}))
+	w.Header().Set("X-Point-Count", strconv.FormatInt(summary.count, 10))
+	if format != "laz" {
+		if err := enc.writeHeader(w, summary); err != nil {
+			requestLog(r).Error("Error writing extract header", "error", err)
+			return
+		}
+	}
+	if _, err := io.Copy(w, out); err != nil {
+		requestLog(r).Error("Error sending extract", "error", err)
+	}
+}
+
+// laszipFound tells whether the laszip executable exists, see checkLASzip
+var laszipFound bool
+
+// errNoLASzip is returned for LAZ data when laszip is not installed
+var errNoLASzip = errors.New("laszip is not installed, see the laszip setting")
+
+// checkLASzip looks up the configured laszip executable once at startup
+func checkLASzip() {
+	path, err := exec.LookPath(cfg.LASzip)
+	if err != nil {
+		slog.Warn("LAZ output is disabled, laszip was not found", "laszip", cfg.LASzip, "error", err)
+		return
+	}
+	cfg.LASzip, laszipFound = path, true
+}
+
+// compressLAZ writes a complete LAS file and compresses it with the laszip tool
+func compressLAZ(ctx context.Context, enc pointEncoder, summary *extractSummary, body *os.File) (*os.File, error) {
+	las, err := os.CreateTemp("", "extract-*.las")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(las.Name())
+	defer las.Close()
+
+	if err := enc.writeHeader(las, summary); err != nil {
+		return nil, err
+	}
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(las, body); err != nil {
+		return nil, err
+	}
+	if err := las.Close(); err != nil {
+		return nil, err
+	}
+
+	lazPath := strings.TrimSuffix(las.Name(), ".las") + ".laz"
+	out, err := exec.CommandContext(ctx, cfg.LASzip, "-i", las.Name(), "-o", lazPath).CombinedOutput()
+	if err != nil {
+		os.Remove(lazPath)
+		return nil, fmt.Errorf("laszip: %w: %s", err, out)
+	}
+	return os.Open(lazPath)
+}
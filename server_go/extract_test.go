@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// lasHeader12 is the LAS 1.2 public header block as laid out in the
+// specification, read independently of lasEncoder
+type lasHeader12 struct {
+	Signature          [4]byte
+	FileSourceID       uint16
+	GlobalEncoding     uint16
+	GUID               [16]byte
+	VersionMajor       uint8
+	VersionMinor       uint8
+	SystemIdentifier   [32]byte
+	GeneratingSoftware [32]byte
+	CreationDay        uint16
+	CreationYear       uint16
+	HeaderSize         uint16
+	OffsetToPoints     uint32
+	NumberOfVLRs       uint32
+	PointFormat        uint8
+	PointRecordLength  uint16
+	NumberOfPoints     uint32
+	PointsByReturn     [5]uint32
+	Scale              [3]float64
+	Offset             [3]float64
+	MaxX, MinX         float64
+	MaxY, MinY         float64
+	MaxZ, MinZ         float64
+}
+
+func TestLASHeader(t *testing.T) {
+	s := &extractSummary{scale: [3]float64{0.01, 0.01, 0.001}, offset: [3]float64{500000, 5000000, 0}}
+	for _, p := range []point{
+		{X: 500010.25, Y: 5000020.5, Z: 101.125, ReturnNumber: 1},
+		{X: 500001, Y: 5000030, Z: 99.5, ReturnNumber: 1},
+		{X: 500005, Y: 5000025, Z: 100, ReturnNumber: 2},
+		{X: 500006, Y: 5000026, Z: 100, ReturnNumber: 0}, // not counted by return
+	} {
+		s.add(&p)
+	}
+
+	var buf bytes.Buffer
+	if err := (lasEncoder{}).writeHeader(&buf, s); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != 227 {
+		t.Fatalf("header is %d bytes, want 227", buf.Len())
+	}
+	var h lasHeader12
+	if err := binary.Read(bytes.NewReader(buf.Bytes()), binary.LittleEndian, &h); err != nil {
+		t.Fatal(err)
+	}
+
+	year, day := time.Now().UTC().Year(), time.Now().UTC().YearDay()
+	checks := []struct {
+		field     string
+		got, want any
+	}{
+		{"signature", string(h.Signature[:]), "LASF"},
+		{"version", [2]uint8{h.VersionMajor, h.VersionMinor}, [2]uint8{1, 2}},
+		{"creation year", h.CreationYear, uint16(year)},
+		{"creation day", h.CreationDay, uint16(day)},
+		{"header size", h.HeaderSize, uint16(227)},
+		{"offset to points", h.OffsetToPoints, uint32(227)},
+		{"VLRs", h.NumberOfVLRs, uint32(0)},
+		{"point format", h.PointFormat, uint8(3)},
+		{"record length", h.PointRecordLength, uint16(34)},
+		{"points", h.NumberOfPoints, uint32(4)},
+		{"points by return", h.PointsByReturn, [5]uint32{2, 1, 0, 0, 0}},
+		{"scale", h.Scale, s.scale},
+		{"offset", h.Offset, s.offset},
+		{"x range", [2]float64{h.MinX, h.MaxX}, [2]float64{500001, 500010.25}},
+		{"y range", [2]float64{h.MinY, h.MaxY}, [2]float64{5000020.5, 5000030}},
+		{"z range", [2]float64{h.MinZ, h.MaxZ}, [2]float64{99.5, 101.125}},
+	}
+	for _, c := range checks {
+		if c.got != c.want {
+			t.Errorf("%s = %v, want %v", c.field, c.got, c.want)
+		}
+	}
+
+	s.count = math.MaxUint32 + 1
+	if err := (lasEncoder{}).writeHeader(&bytes.Buffer{}, s); err == nil {
+		t.Error("more points than LAS 1.2 can count were accepted")
+	}
+}
+
+func TestLASPointRecord(t *testing.T) {
+	s := &extractSummary{scale: [3]float64{0.01, 0.01, 0.01}, offset: [3]float64{1000, 2000, 0}}
+	p := point{
+		X: 1012.345, Y: 1990, Z: -3.5,
+		Intensity: 0x1234, ReturnNumber: 2, NumberOfReturns: 3, Classification: 6,
+		ScanAngle: -120, UserData: 7, PointSourceID: 42, GPSTime: 123456.789,
+		R: 65535, G: 256, B: 1,
+	}
+	var buf bytes.Buffer
+	if err := (lasEncoder{}).writePoint(&buf, s, &p); err != nil {
+		t.Fatal(err)
+	}
+	var rec struct {
+		X, Y, Z        int32
+		Intensity      uint16
+		Returns        uint8
+		Classification uint8
+		ScanAngle      int8
+		UserData       uint8
+		PointSourceID  uint16
+		GPSTime        float64
+		R, G, B        uint16
+	}
+	if buf.Len() != 34 {
+		t.Fatalf("record is %d bytes, want 34", buf.Len())
+	}
+	binary.Read(&buf, binary.LittleEndian, &rec)
+	if rec.X != 1235 || rec.Y != -1000 || rec.Z != -350 {
+		t.Errorf("position = %d %d %d, want 1235 -1000 -350", rec.X, rec.Y, rec.Z)
+	}
+	if rec.Returns != 2|3<<3 || rec.ScanAngle != -90 {
+		t.Errorf("returns %#x scan angle %d, want %#x and -90", rec.Returns, rec.ScanAngle, 2|3<<3)
+	}
+	if rec.Intensity != 0x1234 || rec.Classification != 6 || rec.UserData != 7 || rec.PointSourceID != 42 ||
+		rec.GPSTime != 123456.789 || rec.R != 65535 || rec.G != 256 || rec.B != 1 {
+		t.Errorf("record = %+v", rec)
+	}
+}
+
+func TestRegion(t *testing.T) {
+	dataset := aabb{Min: [3]float64{0, 0, -10}, Max: [3]float64{100, 100, 10}}
+	triangle := [][2]float64{{0, 0}, {10, 0}, {0, 10}}
+	tests := []struct {
+		name    string
+		box     *aabb
+		polygon [][2]float64
+		zRange  *[2]float64
+		x, y, z float64
+		want    bool
+		wantErr bool
+	}{
+		{"inside box", &aabb{Max: [3]float64{1, 1, 1}}, nil, nil, 0.5, 0.5, 0.5, true, false},
+		{"on box edge", &aabb{Max: [3]float64{1, 1, 1}}, nil, nil, 1, 1, 1, true, false},
+		{"outside box", &aabb{Max: [3]float64{1, 1, 1}}, nil, nil, 0.5, 0.5, 1.5, false, false},
+		{"inside polygon", nil, triangle, nil, 2, 2, 5, true, false},
+		{"outside polygon", nil, triangle, nil, 6, 6, 0, false, false},
+		{"polygon below z range", nil, triangle, &[2]float64{0, 1}, 2, 2, -1, false, false},
+		{"polygon spans dataset heights", nil, triangle, nil, 2, 2, -10, true, false},
+		{"both", &aabb{}, triangle, nil, 0, 0, 0, false, true},
+		{"neither", nil, nil, nil, 0, 0, 0, false, true},
+		{"inverted box", &aabb{Min: [3]float64{1, 0, 0}}, nil, nil, 0, 0, 0, false, true},
+		{"two vertices", nil, triangle[:2], nil, 0, 0, 0, false, true},
+		{"inverted z range", nil, triangle, &[2]float64{1, 0}, 0, 0, 0, false, true},
+	}
+	for _, tt := range tests {
+		r, err := newRegion(tt.box, tt.polygon, tt.zRange, dataset)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if err == nil && r.contains(tt.x, tt.y, tt.z) != tt.want {
+			t.Errorf("%s: contains(%v, %v, %v) = %v, want %v", tt.name, tt.x, tt.y, tt.z, !tt.want, tt.want)
+		}
+	}
+}
+
+func TestScaleDecimals(t *testing.T) {
+	for scale, want := range map[float64]int{1: 0, 0.1: 1, 0.01: 2, 0.001: 3, 0.0025: 3, 0.00025: 4, 0: 0, 10: 0} {
+		if got := scaleDecimals(scale); got != want {
+			t.Errorf("scaleDecimals(%v) = %d, want %d", scale, got, want)
+		}
+	}
+}
+
+func TestExtractFilename(t *testing.T) {
+	withDataDir(t, t.TempDir())
+	for _, name := range []string{"tiny", `survey "north"; 2024`, "höhen,daten"} {
+		writeTiny(t, name)
+
+		r := httptest.NewRequest("POST", "/datasets/x/extract", strings.NewReader(`{"box": {"min": [0, 0, 0], "max": [8, 8, 8]}, "format": "csv"}`))
+		r.SetPathValue("name", name)
+		rec := httptest.NewRecorder()
+		extractPoints(rec, r)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: status %d %q", name, rec.Code, rec.Body.String())
+		}
+		disposition, params, err := mime.ParseMediaType(rec.Header().Get("Content-Disposition"))
+		if err != nil || disposition != "attachment" || params["filename"] != name+"-extract.csv" {
+			t.Errorf("%s: Content-Disposition %q parses as %q %q, %v", name, rec.Header().Get("Content-Disposition"), disposition, params, err)
+		}
+	}
+}
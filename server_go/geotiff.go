@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+)
+
+// TIFF field types
+const (
+	tiffShort  = 3
+	tiffLong   = 4
+	tiffASCII  = 2
+	tiffDouble = 12
+)
+
+// TIFF field values used for float32 elevation rasters
+const (
+	tiffSampleFormatIEEEFP  = 3
+	tiffPhotometricMinBlack = 1
+)
+
+// GeoTIFF tags and keys, see the OGC GeoTIFF 1.1 standard
+const (
+	modelPixelScaleTag    = 33550
+	modelTiepointTag      = 33922
+	geoKeyDirectoryTag    = 34735
+	geoAsciiParamsTag     = 34737
+	gdalNoDataTag         = 42113
+	gtModelTypeGeoKey     = 1024
+	gtRasterTypeGeoKey    = 1025
+	gtCitationGeoKey      = 1026
+	geographicTypeGeoKey  = 2048
+	projectedCSTypeGeoKey = 3072
+	modelTypeProjected    = 1
+	modelTypeGeographic   = 2
+	rasterPixelIsArea     = 1
+	geoKeyUserDefined     = 32767
+)
+
+// grid is a north-up float raster; row 0 is the northern edge
+type grid struct {
+	cols, rows int
+	minX, maxY float64
+	cellSize   float64
+	noData     float32
+	values     []float32
+}
+
+func newGrid(cols, rows int, minX, maxY, cellSize float64, noData float32) *grid {
+	g := &grid{cols: cols, rows: rows, minX: minX, maxY: maxY, cellSize: cellSize, noData: noData}
+	g.values = make([]float32, cols*rows)
+	for i := range g.values {
+		g.values[i] = noData
+	}
+	return g
+}
+
+func (g *grid) at(col, row int) float32     { return g.values[row*g.cols+col] }
+func (g *grid) set(col, row int, v float32) { g.values[row*g.cols+col] = v }
+
+// cell returns the column and row containing a model coordinate
+func (g *grid) cell(x, y float64) (int, int, bool) {
+	col := int(math.Floor((x - g.minX) / g.cellSize))
+	row := int(math.Floor((g.maxY - y) / g.cellSize))
+	if col < 0 || row < 0 || col >= g.cols || row >= g.rows {
+		return 0, 0, false
+	}
+	return col, row, true
+}
+
+// centre returns the model coordinate of a cell centre
+func (g *grid) centre(col, row int) (float64, float64) {
+	return g.minX + (float64(col)+0.5)*g.cellSize, g.maxY - (float64(row)+0.5)*g.cellSize
+}
+
+type tiffEntry struct {
+	tag, typ uint16
+	count    uint32
+	data     []byte
+}
+
+func shortEntry(tag uint16, vals ...uint16) tiffEntry {
+	b := make([]byte, 2*len(vals))
+	for i, v := range vals {
+		binary.LittleEndian.PutUint16(b[2*i:], v)
+	}
+	return tiffEntry{tag, tiffShort, uint32(len(vals)), b}
+}
+
+func longEntry(tag uint16, vals ...uint32) tiffEntry {
+	b := make([]byte, 4*len(vals))
+	for i, v := range vals {
+		binary.LittleEndian.PutUint32(b[4*i:], v)
+	}
+	return tiffEntry{tag, tiffLong, uint32(len(vals)), b}
+}
+
+func doubleEntry(tag uint16, vals ...float64) tiffEntry {
+	b := make([]byte, 8*len(vals))
+	for i, v := range vals {
+		binary.LittleEndian.PutUint64(b[8*i:], math.Float64bits(v))
+	}
+	return tiffEntry{tag, tiffDouble, uint32(len(vals)), b}
+}
+
+func asciiEntry(tag uint16, s string) tiffEntry {
+	b := append([]byte(s), 0)
+	return tiffEntry{tag, tiffASCII, uint32(len(b)), b}
+}
+
+// writeGeoTIFF writes the grid as a single strip float32 GeoTIFF; epsg may be 0
+// when the CRS is unknown, in which case projection is stored as a citation
+func writeGeoTIFF(path string, g *grid, epsg int, projection string) error {
+	keys := [][4]uint16{{gtRasterTypeGeoKey, 0, 1, rasterPixelIsArea}}
+	var ascii string
+	switch {
+	case epsg >= 4000 && epsg < 5000:
+		keys = append(keys,
+			[4]uint16{gtModelTypeGeoKey, 0, 1, modelTypeGeographic},
+			[4]uint16{geographicTypeGeoKey, 0, 1, uint16(epsg)})
+	case epsg > 0:
+		keys = append(keys,
+			[4]uint16{gtModelTypeGeoKey, 0, 1, modelTypeProjected},
+			[4]uint16{projectedCSTypeGeoKey, 0, 1, uint16(epsg)})
+	default:
+		keys = append(keys, [4]uint16{gtModelTypeGeoKey, 0, 1, modelTypeProjected},
+			[4]uint16{projectedCSTypeGeoKey, 0, 1, geoKeyUserDefined})
+		if projection != "" {
+			ascii = projection + "|"
+			keys = append(keys, [4]uint16{gtCitationGeoKey, geoAsciiParamsTag, uint16(len(ascii)), 0})
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i][0] < keys[j][0] })
+	// GeoKeyDirectory header: version 1.1.0 followed by the key count
+	dir := []uint16{1, 1, 0, uint16(len(keys))}
+	for _, k := range keys {
+		dir = append(dir, k[:]...)
+	}
+
+	stripSize := uint32(4 * len(g.values))
+	entries := []tiffEntry{
+		longEntry(256, uint32(g.cols)),
+		longEntry(257, uint32(g.rows)),
+		shortEntry(258, 32),
+		shortEntry(259, 1),
+		shortEntry(262, tiffPhotometricMinBlack),
+		longEntry(273, 0), // strip offset, patched below
+		shortEntry(277, 1),
+		longEntry(278, uint32(g.rows)),
+		longEntry(279, stripSize),
+		shortEntry(284, 1),
+		shortEntry(339, tiffSampleFormatIEEEFP),
+		doubleEntry(modelPixelScaleTag, g.cellSize, g.cellSize, 0),
+		doubleEntry(modelTiepointTag, 0, 0, 0, g.minX, g.maxY, 0),
+		shortEntry(geoKeyDirectoryTag, dir...),
+		asciiEntry(gdalNoDataTag, strconv.FormatFloat(float64(g.noData), 'f', -1, 32)),
+	}
+	if ascii != "" {
+		entries = append(entries, asciiEntry(geoAsciiParamsTag, ascii))
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].tag < entries[j].tag })
+
+	// Layout: header, IFD, out of line values, pixel strip
+	const headerSize = 8
+	ifdSize := 2 + 12*len(entries) + 4
+	extraOffset := uint32(headerSize + ifdSize)
+	var extra []byte
+	for i := range entries {
+		if len(entries[i].data) > 4 && len(extra)%2 == 1 {
+			extra = append(extra, 0)
+		}
+		if len(entries[i].data) > 4 {
+			extra = append(extra, entries[i].data...)
+		}
+	}
+	stripOffset := extraOffset + uint32(len(extra))
+	for i := range entries {
+		if entries[i].tag == 273 {
+			binary.LittleEndian.PutUint32(entries[i].data, stripOffset)
+		}
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+
+	le := binary.LittleEndian
+	head := make([]byte, headerSize)
+	copy(head, "II")
+	le.PutUint16(head[2:], 42)
+	le.PutUint32(head[4:], headerSize)
+	w.Write(head)
+
+	ifd := make([]byte, ifdSize)
+	le.PutUint16(ifd, uint16(len(entries)))
+	next := extraOffset
+	for i, e := range entries {
+		rec := ifd[2+12*i:]
+		le.PutUint16(rec[0:], e.tag)
+		le.PutUint16(rec[2:], e.typ)
+		le.PutUint32(rec[4:], e.count)
+		if len(e.data) <= 4 {
+			copy(rec[8:12], e.data)
+			continue
+		}
+		if next%2 == 1 {
+			next++
+		}
+		le.PutUint32(rec[8:], next)
+		next += uint32(len(e.data))
+	}
+	w.Write(ifd)
+	w.Write(extra)
+
+	px := make([]byte, 4)
+	for _, v := range g.values {
+		le.PutUint32(px, math.Float32bits(v))
+		if _, err := w.Write(px); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// readTIFFTags reads the first IFD of a little endian TIFF into tag values:
+// []uint32 for SHORT and LONG, []float64 for DOUBLE and string for ASCII
+func readTIFFTags(t *testing.T, raw []byte) map[uint16]any {
+	t.Helper()
+	le := binary.LittleEndian
+	if string(raw[:2]) != "II" || le.Uint16(raw[2:]) != 42 {
+		t.Fatalf("not a little endian TIFF: % x", raw[:4])
+	}
+	ifd := raw[le.Uint32(raw[4:]):]
+	tags := map[uint16]any{}
+	for i := 0; i < int(le.Uint16(ifd)); i++ {
+		rec := ifd[2+12*i:]
+		tag, typ, count := le.Uint16(rec), le.Uint16(rec[2:]), int(le.Uint32(rec[4:]))
+		size := map[uint16]int{tiffASCII: 1, tiffShort: 2, tiffLong: 4, tiffDouble: 8}[typ] * count
+		data := rec[8:12]
+		if size > 4 {
+			off := le.Uint32(rec[8:])
+			if off%2 == 1 {
+				t.Errorf("tag %d at odd offset %d", tag, off)
+			}
+			data = raw[off : int(off)+size]
+		}
+		switch typ {
+		case tiffShort:
+			v := make([]uint32, count)
+			for j := range v {
+				v[j] = uint32(le.Uint16(data[2*j:]))
+			}
+			tags[tag] = v
+		case tiffLong:
+			v := make([]uint32, count)
+			for j := range v {
+				v[j] = le.Uint32(data[4*j:])
+			}
+			tags[tag] = v
+		case tiffDouble:
+			v := make([]float64, count)
+			for j := range v {
+				v[j] = math.Float64frombits(le.Uint64(data[8*j:]))
+			}
+			tags[tag] = v
+		case tiffASCII:
+			tags[tag] = string(data[:count])
+		default:
+			t.Errorf("tag %d has type %d", tag, typ)
+		}
+	}
+	return tags
+}
+
+func TestWriteGeoTIFF(t *testing.T) {
+	g := newGrid(3, 2, 500000, 5000002, 1, -9999)
+	g.set(0, 0, 10)
+	g.set(2, 1, 12.5)
+
+	tests := []struct {
+		name       string
+		epsg       int
+		projection string
+		keys       []uint32
+		citation   any
+	}{
+		{"projected", 32632, "", []uint32{1, 1, 0, 3,
+			gtModelTypeGeoKey, 0, 1, modelTypeProjected,
+			gtRasterTypeGeoKey, 0, 1, rasterPixelIsArea,
+			projectedCSTypeGeoKey, 0, 1, 32632}, nil},
+		{"geographic", 4326, "", []uint32{1, 1, 0, 3,
+			gtModelTypeGeoKey, 0, 1, modelTypeGeographic,
+			gtRasterTypeGeoKey, 0, 1, rasterPixelIsArea,
+			geographicTypeGeoKey, 0, 1, 4326}, nil},
+		{"user defined", 0, "+proj=tmerc +lat_0=0", []uint32{1, 1, 0, 4,
+			gtModelTypeGeoKey, 0, 1, modelTypeProjected,
+			gtRasterTypeGeoKey, 0, 1, rasterPixelIsArea,
+			gtCitationGeoKey, geoAsciiParamsTag, 21, 0,
+			projectedCSTypeGeoKey, 0, 1, geoKeyUserDefined}, "+proj=tmerc +lat_0=0|\x00"},
+		{"unknown", 0, "", []uint32{1, 1, 0, 3,
+			gtModelTypeGeoKey, 0, 1, modelTypeProjected,
+			gtRasterTypeGeoKey, 0, 1, rasterPixelIsArea,
+			projectedCSTypeGeoKey, 0, 1, geoKeyUserDefined}, nil},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "out.tif")
+		if err := writeGeoTIFF(path, g, tt.epsg, tt.projection); err != nil {
+			t.Fatal(err)
+		}
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tags := readTIFFTags(t, raw)
+
+		want := map[uint16]any{
+			256:                []uint32{3},
+			257:                []uint32{2},
+			258:                []uint32{32},
+			259:                []uint32{1},
+			262:                []uint32{tiffPhotometricMinBlack},
+			277:                []uint32{1},
+			278:                []uint32{2},
+			279:                []uint32{24},
+			284:                []uint32{1},
+			339:                []uint32{tiffSampleFormatIEEEFP},
+			modelPixelScaleTag: []float64{1, 1, 0},
+			modelTiepointTag:   []float64{0, 0, 0, 500000, 5000002, 0},
+			geoKeyDirectoryTag: tt.keys,
+			gdalNoDataTag:      "-9999\x00",
+		}
+		if tt.citation != nil {
+			want[geoAsciiParamsTag] = tt.citation
+		}
+		offset := tags[273]
+		delete(tags, 273)
+		for tag, v := range want {
+			if !reflect.DeepEqual(tags[tag], v) {
+				t.Errorf("%s: tag %d = %v, want %v", tt.name, tag, tags[tag], v)
+			}
+			delete(tags, tag)
+		}
+		for tag, v := range tags {
+			t.Errorf("%s: unexpected tag %d = %v", tt.name, tag, v)
+		}
+
+		strip, ok := offset.([]uint32)
+		if !ok || len(strip) != 1 || int(strip[0])+24 != len(raw) {
+			t.Fatalf("%s: strip at %v in a %d byte file", tt.name, offset, len(raw))
+		}
+		px := raw[strip[0]:]
+		for i, v := range []float32{10, -9999, -9999, -9999, -9999, 12.5} {
+			if got := math.Float32frombits(binary.LittleEndian.Uint32(px[4*i:])); got != v {
+				t.Errorf("%s: pixel %d = %v, want %v", tt.name, i, got, v)
+			}
+		}
+	}
+}
+
+func TestGridCell(t *testing.T) {
+	g := newGrid(4, 3, 100, 230, 10, 0)
+	tests := []struct {
+		x, y     float64
+		col, row int
+		ok       bool
+	}{
+		{100, 230, 0, 0, true},
+		{105, 225, 0, 0, true},
+		{139.9, 200.1, 3, 2, true},
+		{140, 225, 0, 0, false}, // eastern edge belongs to no cell
+		{105, 200, 0, 0, false}, // nor does the southern edge
+		{99.9, 225, 0, 0, false},
+		{105, 230.1, 0, 0, false},
+	}
+	for _, tt := range tests {
+		col, row, ok := g.cell(tt.x, tt.y)
+		if col != tt.col || row != tt.row || ok != tt.ok {
+			t.Errorf("cell(%v, %v) = %d, %d, %v, want %d, %d, %v", tt.x, tt.y, col, row, ok, tt.col, tt.row, tt.ok)
+		}
+	}
+	if x, y := g.centre(3, 2); x != 135 || y != 205 {
+		t.Errorf("centre(3, 2) = %v, %v, want 135, 205", x, y)
+	}
+}
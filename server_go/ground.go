@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// LAS classification codes written by ground classification
+const (
+	lasClassNeverClassified = 0
+	lasClassUnclassified    = 1
+)
+
+// groundOptions configures a progressive morphological filter (Zhang et al. 2003)
+type groundOptions struct {
+	Output   string  `json:"output"`   // name of the new dataset
+	CellSize float64 `json:"cellSize"` // of the minimum surface, in dataset units
+	// MaxWindow is the largest opening window, about the size of the largest building
+	MaxWindow float64 `json:"maxWindow"`
+	Slope     float64 `json:"slope"` // terrain slope, rise over run
+	// InitialDistance and MaxDistance bound the elevation threshold between windows
+	InitialDistance float64 `json:"initialDistance"`
+	MaxDistance     float64 `json:"maxDistance"`
+	// GroundThreshold is the height above the ground surface up to which points are ground
+	GroundThreshold float64 `json:"groundThreshold"`
+}
+
+func (o *groundOptions) validate() error {
+	for _, v := range []struct {
+		value    *float64
+		fallback float64
+	}{
+		{&o.CellSize, 1},
+		{&o.MaxWindow, 33},
+		{&o.Slope, 0.15},
+		{&o.InitialDistance, 0.15},
+		{&o.MaxDistance, 2.5},
+		{&o.GroundThreshold, 0.3},
+	} {
+		if *v.value < 0 {
+			return errors.New("parameters must not be negative")
+		}
+		if *v.value == 0 {
+			*v.value = v.fallback
+		}
+	}
+	if o.MaxWindow < 3*o.CellSize {
+		return errors.New("maxWindow must be at least three cells")
+	}
+	return nil
+}
+
+// groundReport summarises a ground classification job
+type groundReport struct {
+	Dataset   string        `json:"dataset"`
+	Output    string        `json:"output"`
+	Options   groundOptions `json:"options"`
+	Windows   []int         `json:"windows"` // opening window sizes in cells
+	Points    int64         `json:"points"`
+	Ground    int64         `json:"ground"`
+	NonGround int64         `json:"nonGround"`
+}
+
+// minFilter replaces each cell by the minimum (or maximum) of a square
+// window, separably by rows and then columns
+func minFilter(src []float32, cols, rows, window int, maximum bool) []float32 {
+	half := window / 2
+	pick := func(a, b float32) float32 {
+		if maximum {
+			return max(a, b)
+		}
+		return min(a, b)
+	}
+	tmp := make([]float32, len(src))
+	for r := 0; r < rows; r++ {
+		for c := 0; c < cols; c++ {
+			v := src[r*cols+c]
+			for k := max(0, c-half); k <= min(cols-1, c+half); k++ {
+				v = pick(v, src[r*cols+k])
+			}
+			tmp[r*cols+c] = v
+		}
+	}
+	out := make([]float32, len(src))
+	for r := 0; r < rows; r++ {
+		for c := 0; c < cols; c++ {
+			v := tmp[r*cols+c]
+			for k := max(0, r-half); k <= min(rows-1, r+half); k++ {
+				v = pick(v, tmp[k*cols+c])
+			}
+			out[r*cols+c] = v
+		}
+	}
+	return out
+}
+
+// fillAll fills every empty cell by repeatedly averaging populated neighbours
+func fillAll(g *grid) {
+	for {
+		src := append([]float32(nil), g.values...)
+		empty := 0
+		for row := 0; row < g.rows; row++ {
+			for col := 0; col < g.cols; col++ {
+				if src[row*g.cols+col] != g.noData {
+					continue
+				}
+				var sum float32
+				var n int
+				for dr := -1; dr <= 1; dr++ {
+					for dc := -1; dc <= 1; dc++ {
+						r, c := row+dr, col+dc
+						if r < 0 || c < 0 || r >= g.rows || c >= g.cols || src[r*g.cols+c] == g.noData {
+							continue
+						}
+						sum += src[r*g.cols+c]
+						n++
+					}
+				}
+				if n > 0 {
+					g.set(col, row, sum/float32(n))
+				} else {
+					empty++
+				}
+			}
+		}
+		if empty == 0 || empty == len(g.values) {
+			return
+		}
+	}
+}
+
+// sample interpolates the grid bilinearly between cell centres
+func (g *grid) sample(x, y float64) float64 {
+	fc := (x-g.minX)/g.cellSize - 0.5
+	fr := (g.maxY-y)/g.cellSize - 0.5
+	c0 := max(0, min(g.cols-1, int(math.Floor(fc))))
+	r0 := max(0, min(g.rows-1, int(math.Floor(fr))))
+	c1, r1 := min(g.cols-1, c0+1), min(g.rows-1, r0+1)
+	tc := math.Max(0, math.Min(1, fc-float64(c0)))
+	tr := math.Max(0, math.Min(1, fr-float64(r0)))
+	top := float64(g.at(c0, r0))*(1-tc) + float64(g.at(c1, r0))*tc
+	bottom := float64(g.at(c0, r1))*(1-tc) + float64(g.at(c1, r1))*tc
+	return top*(1-tr) + bottom*tr
+}
+
+// groundSurface runs the progressive morphological filter on the minimum
+// surface and returns the filled ground elevation grid
+func groundSurface(ctx context.Context, d *potreeDataset, opts groundOptions, report *groundReport) (*grid, error) {
+	ext := d.extent()
+	cols := int(math.Ceil((ext.Max[0]-ext.Min[0])/opts.CellSize)) + 1
+	rows := int(math.Ceil((ext.Max[1]-ext.Min[1])/opts.CellSize)) + 1
+	if cols*rows > maxRasterCells {
+		return nil, fmt.Errorf("grid of %dx%d cells is too large, increase cellSize", cols, rows)
+	}
+	g := newGrid(cols, rows, ext.Min[0], ext.Min[1]+float64(rows)*opts.CellSize, opts.CellSize, rasterNoData)
+
+	err := d.forEachPointIn(ctx, &region{bounds: d.bounds()}, -1, func(p *point) error {
+		col, row, ok := g.cell(p.X, p.Y)
+		if !ok {
+			return nil
+		}
+		if z := float32(p.Z); g.at(col, row) == rasterNoData || z < g.at(col, row) {
+			g.set(col, row, z)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	fillAll(g)
+
+	// windows grow exponentially, 3, 5, 9, 17... cells
+	surface := g.values
+	ground := make([]bool, len(surface))
+	for i := range ground {
+		ground[i] = true
+	}
+	prevWindow := 1
+	for k := 1; ; k++ {
+		window := 1<<k + 1
+		if float64(window)*opts.CellSize > opts.MaxWindow {
+			break
+		}
+		threshold := opts.InitialDistance
+		if k > 1 {
+			threshold = math.Min(opts.MaxDistance, opts.Slope*float64(window-prevWindow)*opts.CellSize+opts.InitialDistance)
+		}
+		opened := minFilter(minFilter(surface, cols, rows, window, false), cols, rows, window, true)
+		for i := range surface {
+			if float64(surface[i]-opened[i]) > threshold {
+				ground[i] = false
+			}
+		}
+		surface = opened
+		prevWindow = window
+		report.Windows = append(report.Windows, window)
+	}
+
+	// the ground surface keeps the minimum of ground cells and interpolates the rest
+	dtm := newGrid(cols, rows, g.minX, g.maxY, g.cellSize, rasterNoData)
+	for i, isGround := range ground {
+		if isGround {
+			dtm.values[i] = g.values[i]
+		}
+	}
+	fillAll(dtm)
+	return dtm, nil
+}
+
+// classifyGround writes a copy of the dataset with ground points classified
+// and a height above ground attribute
+func classifyGround(ctx context.Context, d *potreeDataset, opts groundOptions, dir string) (*groundReport, error) {
+	report := &groundReport{Dataset: d.name, Output: opts.Output, Options: opts}
+	jobLogf(ctx, "Filtering the minimum surface of %s", d.name)
+	dtm, err := groundSurface(progressStage(ctx, 0, 0.3), d, opts, report)
+	if err != nil {
+		return nil, err
+	}
+	jobLogf(ctx, "Classifying points with opening windows %v", report.Windows)
+
+	classification := newAttribute("classification", "uint8", 1)
+	if a, _, ok := d.attribute("classification"); ok {
+		classification = *a
+	}
+	hag := newAttribute("height above ground", "float", 1)
+	hag.Description = "Height above the ground surface"
+
+	err = deriveDataset(progressStage(ctx, 0.3, 1), d, opts.Output, "Ground classification of "+d.name,
+		[]potreeAttribute{classification, hag},
+		func(n *octreeNode, pts []point, records [][]byte, offsets map[string]int) error {
+			for i, p := range pts {
+				h := p.Z - dtm.sample(p.X, p.Y)
+				class := p.Classification
+				if h <= opts.GroundThreshold {
+					class = lasClassGround
+					report.Ground++
+				} else {
+					// other existing classes, such as buildings, are kept
+					if class == lasClassGround || class == lasClassNeverClassified {
+						class = lasClassUnclassified
+					}
+					report.NonGround++
+				}
+				classification.putValue(records[i][offsets["classification"]:], 0, float64(class))
+				hag.putValue(records[i][offsets["height above ground"]:], 0, h)
+				report.Points++
+			}
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	epsg := 0
+	if c, err := d.crs(); err == nil {
+		epsg = c.EPSG
+	}
+	return report, writeGeoTIFF(filepath.Join(dir, "dtm.tif"), dtm, epsg, d.meta.Projection)
+}
+
+// groundDataset handles POST /datasets/{name}/ground and starts a ground classification job
+func groundDataset(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+
+	var opts groundOptions
+	if err := json.NewDecoder(r.Body).Decode(&opts); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := opts.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	outputDir, err := datasetDir(opts.Output)
+	if err != nil {
+		http.Error(w, "output must be a valid dataset name", http.StatusBadRequest)
+		return
+	}
+	if _, err := os.Stat(outputDir); err == nil {
+		http.Error(w, "Output dataset already exists", http.StatusConflict)
+		return
+	}
+
+	d, ok := openDatasetForRequest(w, name)
+	if !ok {
+		return
+	}
+
+	j := startJob("ground", name, func(ctx context.Context, dir string) ([]string, error) {
+		report, err := classifyGround(ctx, d, opts, dir)
+		if err != nil {
+			return nil, err
+		}
+		raw, err := json.MarshalIndent(report, "", "\t")
+		if err != nil {
+			return nil, err
+		}
+		return []string{"report.json", "dtm.tif"}, os.WriteFile(filepath.Join(dir, "report.json"), raw, 0o644)
+	})
+	writeJob(w, http.StatusAccepted, j)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// healthWindow is how many progress reports degradation is judged on;
+	// FFmpeg reports twice a second
+	healthWindow = 10
+	// staleProgress is how long without a report marks the encoder stalled
+	staleProgress = 5 * time.Second
+)
+
+// progressSample is one block of FFmpeg's -progress output
+type progressSample struct {
+	frame, dupFrames, dropFrames int64
+	fps, bitrateKbps, speed      float64
+	outTime                      time.Duration
+	at                           time.Time
+}
+
+// encoderHealth collects the progress reports of a session's FFmpeg
+type encoderHealth struct {
+	mu      sync.Mutex
+	samples []progressSample // the last healthWindow reports, oldest first
+}
+
+// streamHealth is the encoder state reported by GET /sessions/{id}
+type streamHealth struct {
+	Frame       int64     `json:"frame"`
+	FPS         float64   `json:"fps"`
+	BitrateKbps float64   `json:"bitrateKbps"`
+	Speed       float64   `json:"speed"`
+	DupFrames   int64     `json:"dupFrames"`
+	DropFrames  int64     `json:"dropFrames"`
+	OutTime     float64   `json:"outTimeSeconds"`
+	Updated     time.Time `json:"updated"`
+	// Degraded is set when the stream is likely to stutter, for the reasons given
+	Degraded bool     `json:"degraded"`
+	Reasons  []string `json:"reasons,omitempty"`
+}
+
+// read parses FFmpeg's -progress output, blocks of key=value lines that
+// end with a progress= line
+func (h *encoderHealth) read(session string, r io.Reader) {
+	sample := progressSample{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch key {
+		case "frame":
+			sample.frame, _ = strconv.ParseInt(value, 10, 64)
+		case "fps":
+			sample.fps, _ = strconv.ParseFloat(value, 64)
+		case "bitrate":
+			sample.bitrateKbps, _ = strconv.ParseFloat(strings.TrimSuffix(value, "kbits/s"), 64)
+		case "speed":
+			sample.speed, _ = strconv.ParseFloat(strings.TrimSuffix(value, "x"), 64)
+		case "dup_frames":
+			sample.dupFrames, _ = strconv.ParseInt(value, 10, 64)
+		case "drop_frames":
+			sample.dropFrames, _ = strconv.ParseInt(value, 10, 64)
+		case "out_time_us":
+			us, _ := strconv.ParseInt(value, 10, 64)
+			sample.outTime = time.Duration(us) * time.Microsecond
+		case "progress":
+			sample.at = time.Now()
+			h.mu.Lock()
+			h.samples = append(h.samples, sample)
+			if len(h.samples) > healthWindow {
+				h.samples = h.samples[1:]
+			}
+			h.mu.Unlock()
+			observeEncoderHealth(session, h.report())
+			sample = progressSample{}
+		}
+	}
+}
+
+// report summarizes the latest progress and judges whether the stream is
+// degraded: encoding slower than real time, duplicating or dropping frames
+// within the window, or no progress at all
+func (h *encoderHealth) report() streamHealth {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.samples) == 0 {
+		return streamHealth{}
+	}
+	first, last := h.samples[0], h.samples[len(h.samples)-1]
+	health := streamHealth{
+		Frame:       last.frame,
+		FPS:         last.fps,
+		BitrateKbps: last.bitrateKbps,
+		Speed:       last.speed,
+		DupFrames:   last.dupFrames,
+		DropFrames:  last.dropFrames,
+		OutTime:     last.outTime.Seconds(),
+		Updated:     last.at,
+	}
+
+	// a full window keeps the slow start of the encoder from counting
+	if len(h.samples) == healthWindow {
+		slow := true
+		for _, s := range h.samples {
+			slow = slow && s.speed > 0 && s.speed < 1
+		}
+		if slow {
+			health.Reasons = append(health.Reasons, fmt.Sprintf("encoding at %.2fx, slower than real time", last.speed))
+		}
+	}
+	window := last.at.Sub(first.at).Round(time.Second)
+	if dup := last.dupFrames - first.dupFrames; dup > 0 {
+		health.Reasons = append(health.Reasons, fmt.Sprintf("%d frames duplicated in %s, the capture is not keeping up", dup, window))
+	}
+	if drop := last.dropFrames - first.dropFrames; drop > 0 {
+		health.Reasons = append(health.Reasons, fmt.Sprintf("%d frames dropped in %s", drop, window))
+	}
+	if stale := time.Since(last.at); stale > staleProgress {
+		health.Reasons = append(health.Reasons, "no encoder progress for "+stale.Round(time.Second).String())
+	}
+	health.Degraded = len(health.Reasons) > 0
+	return health
+}
+
+// getSession handles GET /sessions/{id}
+func getSession(w http.ResponseWriter, r *http.Request) {
+	s, ok := lookupSession(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	if !principalFrom(r).owns(s.Owner) {
+		http.Error(w, "Session belongs to another user", http.StatusForbidden)
+		return
+	}
+
+	info := struct {
+		ID          string              `json:"id"`
+		Owner       string              `json:"owner"`
+		State       string              `json:"state"`
+		Started     time.Time           `json:"started"`
+		Idle        float64             `json:"idleSeconds"`
+		Health      *streamHealth       `json:"health,omitempty"`
+		Diagnostics []browserDiagnostic `json:"diagnostics"`
+	}{
+		ID:          s.ID,
+		State:       sessionState(s.ID),
+		Started:     s.Started,
+		Idle:        s.idle().Seconds(),
+		Diagnostics: s.diagnostics.list(),
+	}
+	if s.Owner != nil {
+		info.Owner = s.Owner.Subject
+	}
+	if health := s.health.report(); !health.Updated.IsZero() {
+		info.Health = &health
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&info)
+}
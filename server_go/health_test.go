@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// ffmpegProgress is two blocks of FFmpeg -progress output
+const ffmpegProgress = `frame=48
+fps=23.98
+stream_0_0_q=28.0
+bitrate=1520.3kbits/s
+total_size=380928
+out_time_us=2000000
+out_time_ms=2000000
+out_time=00:00:02.000000
+dup_frames=0
+drop_frames=0
+speed=0.998x
+progress=continue
+frame=97
+fps=24.10
+bitrate=N/A
+out_time_us=4041667
+dup_frames=3
+drop_frames=1
+speed= 1.01x
+progress=end
+frame=1000
+`
+
+func TestEncoderHealthRead(t *testing.T) {
+	var h encoderHealth
+	h.read("health-test", strings.NewReader(ffmpegProgress))
+
+	if len(h.samples) != 2 {
+		t.Fatalf("%d samples, want 2 (the unterminated block is ignored)", len(h.samples))
+	}
+	want := []progressSample{
+		{frame: 48, fps: 23.98, bitrateKbps: 1520.3, outTime: 2 * time.Second, speed: 0.998},
+		{frame: 97, fps: 24.10, outTime: 4041667 * time.Microsecond, dupFrames: 3, dropFrames: 1, speed: 1.01},
+	}
+	for i, s := range h.samples {
+		if s.at.IsZero() || time.Since(s.at) > time.Minute {
+			t.Errorf("sample %d taken at %v", i, s.at)
+		}
+		s.at = time.Time{}
+		if s != want[i] {
+			t.Errorf("sample %d = %+v, want %+v", i, s, want[i])
+		}
+	}
+	got := h.report()
+	if got.Frame != 97 || got.OutTime != 4.041667 || got.DupFrames != 3 || got.DropFrames != 1 || !got.Degraded {
+		t.Errorf("report = %+v", got)
+	}
+}
+
+func TestEncoderHealthWindow(t *testing.T) {
+	var h encoderHealth
+	var out strings.Builder
+	for i := 1; i <= healthWindow+5; i++ {
+		fmt.Fprintf(&out, "frame=%d\nspeed=1x\nprogress=continue\n", i)
+	}
+	h.read("health-test", strings.NewReader(out.String()))
+	if len(h.samples) != healthWindow || h.samples[0].frame != 6 || h.samples[healthWindow-1].frame != healthWindow+5 {
+		t.Errorf("window holds frames %d to %d in %d samples", h.samples[0].frame, h.samples[len(h.samples)-1].frame, len(h.samples))
+	}
+}
+
+func TestEncoderHealthReport(t *testing.T) {
+	now := time.Now()
+	// samples returns n reports half a second apart ending now
+	samples := func(n int, speed float64, dup, drop func(i int) int64) []progressSample {
+		s := make([]progressSample, n)
+		for i := range s {
+			s[i] = progressSample{frame: int64(12 * i), speed: speed, dupFrames: dup(i), dropFrames: drop(i),
+				at: now.Add(-time.Duration(n-1-i) * 500 * time.Millisecond)}
+		}
+		return s
+	}
+	none := func(int) int64 { return 0 }
+	growing := func(i int) int64 { return int64(i) }
+
+	stale := samples(3, 1, none, none)
+	for i := range stale {
+		stale[i].at = stale[i].at.Add(-time.Minute)
+	}
+	tests := []struct {
+		name    string
+		samples []progressSample
+		reasons []string
+	}{
+		{"healthy", samples(healthWindow, 1.02, none, none), nil},
+		{"slow", samples(healthWindow, 0.8, none, none), []string{"encoding at 0.80x, slower than real time"}},
+		{"slow start", samples(healthWindow-1, 0.5, none, none), nil},
+		{"one slow report", append(samples(healthWindow-1, 0.8, none, none), progressSample{speed: 1, at: now}), nil},
+		{"speed unknown", samples(healthWindow, 0, none, none), nil},
+		{"duplicating", samples(healthWindow, 1, growing, none), []string{"9 frames duplicated in 5s, the capture is not keeping up"}},
+		{"earlier duplicates", samples(healthWindow, 1, func(int) int64 { return 40 }, none), nil},
+		{"dropping", samples(3, 1, none, growing), []string{"2 frames dropped in 1s"}},
+		{"stalled", stale, []string{"no encoder progress for 1m0s"}},
+	}
+	for _, tt := range tests {
+		h := encoderHealth{samples: tt.samples}
+		got := h.report()
+		if !reflect.DeepEqual(got.Reasons, tt.reasons) || got.Degraded != (len(tt.reasons) > 0) {
+			t.Errorf("%s: degraded %v reasons %q, want %q", tt.name, got.Degraded, got.Reasons, tt.reasons)
+		}
+	}
+
+	var empty encoderHealth
+	if got := empty.report(); !reflect.DeepEqual(got, streamHealth{}) {
+		t.Errorf("report without progress = %+v", got)
+	}
+}
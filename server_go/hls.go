@@ -1,412 +1,632 @@
-package main
-
-import (
-	"bufio"
-	"context"
-	"encoding/json"
-	"fmt"
-	"log"
-	"net/http"
-	"net/url"
-	"os"
-	"os/exec"
-	"sync"
-	"time"
-
-	"github.com/chromedp/chromedp"
-	"github.com/rs/cors"
-)
-
-var (
-	gstCmd        *exec.Cmd
-	ffmpegCmd     *exec.Cmd
-	mu            sync.Mutex
-	browserCtx    context.Context
-	browserCancel context.CancelFunc
-)
-
-func main() {
-	c := cors.New(cors.Options{
-		AllowedOrigins: []string{"http://localhost:5173"},
-		AllowedMethods: []string{"GET", "POST", "PUT", "DELETE", "OPTIONS", "HEAD"},
-		AllowedHeaders: []string{"*"},
-	})
-
-	// Mux for routing
-	mux := http.NewServeMux()
-
-	// Serve HLS files
-	mux.Handle("/file/", http.StripPrefix("/file/", http.FileServer(http.Dir("data"))))
-	mux.Handle("/potree/", http.StripPrefix("/potree/", http.FileServer(http.Dir("potree"))))
-	mux.Handle("/hls/", http.StripPrefix("/hls/", http.FileServer(http.Dir("hls"))))
-
-	// API routes
-	mux.HandleFunc("/start", startStream)
-	mux.HandleFunc("/stop", stopStream)
-
-	log.Println("Server started at http://localhost:8080")
-	log.Fatal(http.ListenAndServe(":8080", c.Handler(mux)))
-}
-
-// startStream starts FFmpeg to capture video and output HLS
-func startStream(w http.ResponseWriter, r *http.Request) {
-	mu.Lock()
-	defer mu.Unlock()
-
-	if ffmpegCmd != nil {
-		http.Error(w, "Stream already running", http.StatusConflict)
-		return
-	}
-
-	// Ensure HLS directory exists
-	os.MkdirAll("hls", os.ModePerm)
-
-	// Get pointCloudUrl, viewportHeight, and viewportWidth from request parameters
-	var requestBody struct {
-		PointCloudURL  string `json:"pointCloudUrl"`
-		ViewportHeight int    `json:"viewportHeight"`
-		ViewportWidth  int    `json:"viewportWidth"`
-	}
-	err := json.NewDecoder(r.Body).Decode(&requestBody)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
-
-	pointCloudUrl := requestBody.PointCloudURL
-	viewportHeight := requestBody.ViewportHeight
-	viewportWidth := requestBody.ViewportWidth
-	ctx := openBrowser(pointCloudUrl, viewportHeight, viewportWidth)
-
-	// Get window position and size using chromedp
-	var x, y, width, height int
-	// ctx, cancel := chromedp.NewContext(context.Background())
-
-	err = chromedp.Run(ctx,
-		chromedp.Evaluate(`window.screenX + window.outerWidth - window.innerWidth`, &x),
-		chromedp.Evaluate(`window.screenY + window.outerHeight - window.innerHeight`, &y),
-		chromedp.Evaluate(`window.innerWidth`, &width),
-		chromedp.Evaluate(`window.innerHeight`, &height),
-	)
-	if err != nil {
-		http.Error(w, "Failed to get Chrome window position", http.StatusInternalServerError)
-		log.Println("Error getting Chrome window position:", err)
-		return
-	}
-
-	log.Printf("Capturing window at X:%d, Y:%d, Width:%d, Height:%d\n", x, y, width, height)
-
-	// Keep the original commented code as requested
-	// err := chromedp.Run(ctx,
-	// 	chromedp.Evaluate(`document.title = "`+fullWindowTitle+`"`, nil),
-	// )
-	// if err != nil {
-	// 	log.Fatal(err)
-	// }
-
-	ffmpegCmd = exec.Command("ffmpeg",
-		"-f", "dshow",
-		"-i", "video=screen-capture-recorder",
-		"-r", "40",
-		"-vf", fmt.Sprintf("crop=%d:%d:%d:%d,format=yuv420p,scale=%d:%d", width, height, x, y+50, 1280, 720),
-		"-c:v", "libvpx-vp9",
-		"-b:v", "6M",
-		"-g", "40",
-		"-quality", "realtime",
-		"-rtbufsize", "40M",
-		"-speed", "6",
-		"-threads", "8",
-		"-deadline", "realtime",
-		"-frame-parallel", "1",
-		"-tile-columns", "4",
-		"-row-mt", "1",
-		"-hls_time", "1",
-		"-hls_list_size", "5",
-		"-hls_flags", "append_list+delete_segments+split_by_time",
-		"-hls_segment_filename", "hls/segment_%03d.m4s",
-		"-hls_segment_type", "fmp4",
-		"-f", "hls",
-		"hls/output.m3u8",
-	)
-
-	_, err = ffmpegCmd.StdoutPipe()
-	if err != nil {
-		http.Error(w, "Failed to get FFmpeg stdout", http.StatusInternalServerError)
-		log.Println("Error getting FFmpeg stdout:", err)
-		return
-	}
-
-	stderr, err := ffmpegCmd.StderrPipe()
-	if err != nil {
-		http.Error(w, "Failed to get FFmpeg stderr", http.StatusInternalServerError)
-		log.Println("Error getting FFmpeg stderr:", err)
-		return
-	}
-
-	// go func() {
-	// 	log.Println("FFmpeg stdout:")
-	// 	defer stdout.Close()
-	// 	scanner := bufio.NewScanner(stdout)
-	// 	for scanner.Scan() {
-	// 		log.Println(scanner.Text())
-	// 	}
-	// }()
-
-	go func() {
-		log.Println("FFmpeg stderr:")
-		defer stderr.Close()
-		scanner := bufio.NewScanner(stderr)
-		for scanner.Scan() {
-			log.Println(scanner.Text())
-		}
-	}()
-
-	if err := ffmpegCmd.Start(); err != nil {
-		http.Error(w, "Failed to start stream", http.StatusInternalServerError)
-		log.Println("FFmpeg error:", err)
-		return
-	}
-
-	log.Println("Streaming started")
-	w.Write([]byte("Stream started"))
-}
-
-// // stopStream stops the FFmpeg process
-// func stopStream(w http.ResponseWriter, r *http.Request) {
-// 	mu.Lock()
-// 	defer mu.Unlock()
-
-// 	if ffmpegCmd == nil {
-// 		http.Error(w, "No active stream", http.StatusNotFound)
-// 		return
-// 	}
-
-// 	if err := ffmpegCmd.Process.Kill(); err != nil {
-// 		http.Error(w, "Failed to stop stream", http.StatusInternalServerError)
-// 		log.Println("Error stopping FFmpeg:", err)
-// 		return
-// 	}
-
-// 	ffmpegCmd = nil
-
-// 	closeBrowser()
-
-// 	// Clear the contents of the /hls/ folder
-// 	hlsDir := "hls/"
-// 	dir, err := os.Open(hlsDir)
-// 	if err != nil {
-// 		log.Println("Error opening HLS directory:", err)
-// 	} else {
-// 		defer dir.Close()
-// 		files, err := dir.Readdirnames(-1)
-// 		if err != nil {
-// 			log.Println("Error reading HLS directory:", err)
-// 		} else {
-// 			for _, file := range files {
-// 				err := os.Remove(hlsDir + file)
-// 				if err != nil {
-// 					log.Println("Error removing file:", err)
-// 				}
-// 			}
-// 		}
-// 	}
-
-// 	log.Println("Streaming stopped")
-// 	w.Write([]byte("Stream stopped"))
-// }
-
-// func startStream(w http.ResponseWriter, r *http.Request) {
-// 	mu.Lock()
-// 	defer mu.Unlock()
-
-// 	if gstCmd != nil {
-// 		http.Error(w, "Stream already running", http.StatusConflict)
-// 		return
-// 	}
-
-// 	os.MkdirAll("hls", os.ModePerm)
-
-// 	var requestBody struct {
-// 		PointCloudURL string `json:"pointCloudUrl"`
-// 	}
-// 	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
-// 		http.Error(w, err.Error(), http.StatusBadRequest)
-// 		return
-// 	}
-
-// 	pointCloudUrl := requestBody.PointCloudURL
-// 	go openBrowser(pointCloudUrl)
-
-// 	gstCmd = exec.Command("gst-launch-1.0",
-// 		"d3d11screencapturesrc", "!", "videoconvert", "!", "videoscale", "!",
-// 		"video/x-raw,framerate=40/1,width=1920,height=1080", "!", "vp9enc",
-// 		"target-bitrate=6000000", "cpu-used=6", "deadline=1", "threads=8", "tile-columns=4", "row-mt=true", "!",
-// 		"filesink", "location=NUL",
-// 	)
-
-// 	// gstCmd.Stdout = os.Stdout
-// 	// gstCmd.Stderr = os.Stderr
-
-// 	ffmpegCmd = exec.Command("ffmpeg",
-// 		"-i", "-",
-// 		"-c:v", "libvpx-vp9",
-// 		"-c:a", "opus",
-// 		"-hls_time", "1",
-// 		"-hls_list_size", "5",
-// 		"-hls_flags", "append_list+delete_segments+split_by_time",
-// 		"-hls_segment_filename", "hls/segment_%03d.m4s",
-// 		"-hls_segment_type", "fmp4",
-// 		"-f", "hls",
-// 		"-loglevel", "debug",
-// 	)
-
-// 	ffmpegIn, err := ffmpegCmd.StdinPipe()
-// 	if err != nil {
-// 		http.Error(w, "Failed to get FFmpeg stdin", http.StatusInternalServerError)
-// 		log.Println("Error getting FFmpeg stdin:", err)
-// 		return
-// 	}
-
-// 	gstOut, err := gstCmd.StdoutPipe()
-// 	if err != nil {
-// 		http.Error(w, "Failed to get GStreamer stdout", http.StatusInternalServerError)
-// 		log.Println("Error getting GStreamer stdout:", err)
-// 		return
-// 	}
-
-// 	gstErr, err := gstCmd.StderrPipe()
-// 	if err != nil {
-// 		http.Error(w, "Failed to get GStreamer stderr", http.StatusInternalServerError)
-// 		log.Println("Error getting GStreamer stderr:", err)
-// 		return
-// 	}
-
-// 	go func() {
-// 		defer ffmpegIn.Close()
-// 		log.Println("Copying from GStreamer to FFmpeg...")
-// 		_, err := io.Copy(ffmpegIn, gstOut)
-// 		if err != nil {
-// 			log.Println("Error copying from GStreamer to FFmpeg:", err)
-// 		}
-// 	}()
-
-// 	go func() {
-// 		log.Println("GStreamer stderr:")
-// 		defer gstErr.Close()
-// 		scanner := bufio.NewScanner(gstErr)
-// 		for scanner.Scan() {
-// 			log.Println(scanner.Text())
-// 		}
-// 	}()
-
-// 	if err := ffmpegCmd.Start(); err != nil {
-// 		http.Error(w, "Failed to start FFmpeg", http.StatusInternalServerError)
-// 		log.Println("FFmpeg error:", err)
-// 		return
-// 	}
-
-// 	if err := gstCmd.Start(); err != nil {
-// 		http.Error(w, "Failed to start GStreamer", http.StatusInternalServerError)
-// 		log.Println("GStreamer error:", err)
-// 		return
-// 	}
-
-// 	log.Println("Streaming started")
-// 	w.Write([]byte("Stream started"))
-// }
-
-func stopStream(w http.ResponseWriter, r *http.Request) {
-	mu.Lock()
-	defer mu.Unlock()
-
-	if ffmpegCmd == nil {
-		http.Error(w, "No active stream", http.StatusNotFound)
-		return
-	}
-
-	if err := ffmpegCmd.Process.Kill(); err != nil {
-		http.Error(w, "Failed to stop stream", http.StatusInternalServerError)
-		log.Println("Error stopping FFmpeg:", err)
-		return
-	}
-
-	ffmpegCmd = nil
-
-	closeBrowser()
-
-	// Clear the contents of the /hls/ folder
-	hlsDir := "hls/"
-	dir, err := os.Open(hlsDir)
-	if err != nil {
-		log.Println("Error opening HLS directory:", err)
-	} else {
-		defer dir.Close()
-		files, err := dir.Readdirnames(-1)
-		if err != nil {
-			log.Println("Error reading HLS directory:", err)
-		} else {
-			for _, file := range files {
-				err := os.Remove(hlsDir + file)
-				if err != nil {
-					log.Println("Error removing file:", err)
-				}
-			}
-		}
-	}
-
-	log.Println("Streaming stopped")
-	w.Write([]byte("Stream stopped"))
-}
-
-// openBrowser launches Chrome using chromedp
-func openBrowser(pointCloudUrl string, viewportHeight int, viewportWidth int) context.Context {
-
-	// Disable headless mode and configure visible window
-	opts := append(chromedp.DefaultExecAllocatorOptions[:],
-		chromedp.Flag("headless", false), // Disable headless mode
-		chromedp.Flag("hide-scrollbars", false),
-		chromedp.Flag("window-position", "0,0"), // Position window
-		// chromedp.Flag("window-title", fullWindowTitle),
-		chromedp.Flag("app", "http://localhost:8080/potree/viewer.html?pointcloudURL="+url.QueryEscape(pointCloudUrl)),
-		chromedp.Flag("disable-gpu", false), // Enable GPU acceleration
-		chromedp.Flag("disable-infobars", true),
-		chromedp.WindowSize(viewportWidth, viewportHeight),
-	)
-
-	// Force window to foreground
-	opts = append(opts, chromedp.Flag("start-maximized", true))
-
-	browserCtx, browserCancel = chromedp.NewExecAllocator(context.Background(),
-		opts...,
-	)
-
-	// Create new Chrome context
-	browserCtx, browserCancel = chromedp.NewContext(browserCtx)
-
-	// Add explicit window focus commands
-	if err := chromedp.Run(browserCtx,
-		chromedp.Navigate("http://localhost:8080/potree/viewer.html?pointcloudURL="+url.QueryEscape(pointCloudUrl)),
-		// chromedp.WaitVisible(`#potree_render_area`, chromedp.ByID),
-		chromedp.ActionFunc(func(ctx context.Context) error {
-			// JavaScript to ensure window focus
-			return chromedp.Evaluate(`window.focus()`, nil).Do(ctx)
-		}),
-		// chromedp.ActionFunc(func(ctx context.Context) error {
-		// 	// JavaScript to ensure window focus
-		// 	return chromedp.Evaluate(`document.title = "`+fullWindowTitle+`"`, nil).Do(ctx)
-		// }),
-		chromedp.Sleep(2*time.Second), // Allow window to render
-	); err != nil {
-		log.Fatal("Chrome initialization failed:", err)
-	}
-
-	return browserCtx
-}
-
-// closeBrowser closes the Chromedp session
-func closeBrowser() {
-	if browserCancel != nil {
-		browserCancel() // Cancels the Chrome context
-		log.Println("Chrome closed")
-	}
-}
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/chromedp/cdproto/cdp"
+	"github.com/chromedp/cdproto/fetch"
+	"github.com/chromedp/cdproto/network"
+	"github.com/chromedp/chromedp"
+	"github.com/rs/cors"
+)
+
+var (
+	gstCmd *exec.Cmd
+	mu     sync.Mutex // guards sessions
+)
+
+func main() {
+	var err error
+	cfg, err = loadConfig(os.Args[1:])
+	if err != nil {
+		log.Fatal("Invalid configuration: ", err)
+	}
+	initLogging(cfg.Log)
+	checkLASzip()
+	if err := initRunState(); err != nil {
+		slog.Error("Error reading server state", "error", err)
+		os.Exit(1)
+	}
+	if err := initAuth(&cfg.Auth); err != nil {
+		slog.Error("Error setting up authentication", "error", err)
+		os.Exit(1)
+	}
+
+	c := cors.New(cors.Options{
+		AllowedOrigins: cfg.CORSOrigins,
+		AllowedMethods: []string{"GET", "POST", "PUT", "DELETE", "OPTIONS", "HEAD"},
+		AllowedHeaders: []string{"Authorization", "Content-Type", "X-API-Key", "Last-Event-ID", "X-Request-ID"},
+		ExposedHeaders: []string{"Retry-After", "X-Request-ID"},
+	})
+
+	workers := cfg.JobWorkers
+	if workers == 0 {
+		workers = max(1, runtime.NumCPU()/2)
+	}
+	if err := initJobs(filepath.Join(cfg.JobsDir, "jobs.db"), workers); err != nil {
+		slog.Error("Error opening job store", "error", err)
+		os.Exit(1)
+	}
+	go reapSessions()
+
+	// Mux for routing
+	mux := http.NewServeMux()
+
+	// Serve HLS files
+	mux.Handle("/file/", requireDataFile(countFileBytes(http.StripPrefix("/file/", http.FileServer(http.Dir(cfg.DataDir))))))
+	mux.Handle("/potree/", http.StripPrefix("/potree/", http.FileServer(http.Dir(cfg.PotreeDir))))
+	mux.HandleFunc("GET /hls/{session}/{file}", serveSegment)
+
+	// API routes
+	mux.HandleFunc("/start", requireUser(startStream))
+	mux.HandleFunc("/stop", requireUser(stopStream))
+	mux.HandleFunc("GET /sessions/{id}", requireUser(getSession))
+	mux.HandleFunc("GET /sessions/{id}/logs", requireUser(getSessionLogs))
+	mux.HandleFunc("POST /sessions/{id}/heartbeat", requireUser(sessionHeartbeat))
+	mux.HandleFunc("PUT /ingest/{session}/{secret}/{file}", ingestSegment)
+	mux.HandleFunc("DELETE /ingest/{session}/{secret}/{file}", ingestSegment)
+	mux.HandleFunc("GET /datasets", requireUser(listDatasets))
+	mux.HandleFunc("POST /datasets/{name}/extract", requireDataset(permExtract, extractPoints))
+	mux.HandleFunc("POST /datasets/{name}/profile", requireDataset(permExtract, elevationProfile))
+	mux.HandleFunc("POST /datasets/{name}/raster", requireDataset(permExtract, rasterizeDataset))
+	mux.HandleFunc("POST /datasets/{name}/volume", requireDataset(permExtract, computeVolume))
+	mux.HandleFunc("GET /datasets/{name}/stats", requireDataset(permView, datasetStatistics))
+	mux.HandleFunc("POST /datasets/{name}/3dtiles", requireDataset(permExtract, export3DTiles))
+	mux.HandleFunc("POST /datasets/{name}/convert", requireDataset(permExtract, convertDataset))
+	mux.HandleFunc("POST /datasets/{name}/changes", requireDataset(permExtract, compareDatasets))
+	mux.HandleFunc("POST /datasets/{name}/ground", requireDataset(permExtract, groundDataset))
+	mux.HandleFunc("DELETE /datasets/{name}", requireDataset(permDelete, deleteDataset))
+	mux.HandleFunc("GET /datasets/{name}/3dtiles/{file}", requireDataset(permView, serve3DTiles))
+	mux.HandleFunc("POST /transform", requireUser(transformCoordinates))
+	mux.HandleFunc("POST /signed-urls", requireUser(signURL))
+	mux.HandleFunc("GET /metrics", requireUser(serveMetrics()))
+	mux.HandleFunc("GET /events", requireUser(streamEvents))
+	mux.HandleFunc("GET /jobs", requireUser(listJobs))
+	mux.HandleFunc("GET /jobs/{id}", requireUser(getJob))
+	mux.HandleFunc("POST /jobs/{id}/cancel", requireUser(stopJob))
+	mux.HandleFunc("DELETE /jobs/{id}", requireUser(deleteJob))
+	mux.HandleFunc("GET /jobs/{id}/files/{file}", requireUser(getJobFile))
+
+	srv := &http.Server{Addr: cfg.Listen, Handler: c.Handler(traceRequests(authenticate(instrument(mux))))}
+	signals, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	stopped := make(chan struct{})
+	go func() {
+		<-signals.Done()
+		stop() // a second signal exits at once
+		shutdown(srv)
+		close(stopped)
+	}()
+
+	slog.Info("Server started", "url", cfg.PublicURL, "listen", cfg.Listen)
+	if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("Error serving HTTP", "error", err)
+		os.Exit(1)
+	}
+	<-stopped
+}
+
+// startStream starts FFmpeg to capture video and output HLS
+func startStream(w http.ResponseWriter, r *http.Request) {
+	// Get the point clouds, viewportHeight, and viewportWidth from request parameters
+	var requestBody struct {
+		PointCloudURL  string       `json:"pointCloudUrl"`
+		PointClouds    []sceneCloud `json:"pointClouds"`
+		ViewportHeight int          `json:"viewportHeight"`
+		ViewportWidth  int          `json:"viewportWidth"`
+		Camera         *cameraView  `json:"camera"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&requestBody)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	clouds, err := sceneClouds(requestBody.PointCloudURL, requestBody.PointClouds)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// clouds from elsewhere than /file/ fall under the default access list
+	var datasets []string
+	for _, cloud := range clouds {
+		name, ok := datasetNameFromURL(cloud.URL)
+		if !ok {
+			if !authorizeExternal(w, r, permStream) {
+				return
+			}
+			continue
+		}
+		if !authorize(w, r, name, permStream) {
+			return
+		}
+		datasets = append(datasets, name)
+	}
+	viewportHeight := requestBody.ViewportHeight
+	viewportWidth := requestBody.ViewportWidth
+	// camera coordinates in another CRS are mapped into the first cloud's
+	camera, err := cameraParam(clouds[0].URL, requestBody.Camera)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	scene, err := sceneParam(clouds)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s, ok := admitSession(w, r, datasets)
+	if !ok {
+		return
+	}
+	s.log.Info("Session admitted", "request", requestID(r))
+	ctx, err := openBrowser(s, scene+camera, viewportHeight, viewportWidth)
+	if err != nil {
+		s.end(sessionStopped, "Chrome failed to start")
+		http.Error(w, "Failed to start Chrome", http.StatusInternalServerError)
+		s.log.Error("Error starting Chrome", "error", err)
+		return
+	}
+	publishSession(s, sessionBrowserLaunched, "")
+	if err := waitForPointClouds(ctx, s); err != nil {
+		s.end(sessionStopped, "Point clouds failed to load: "+err.Error())
+		http.Error(w, "Point clouds failed to load: "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	// Get window position and size using chromedp
+	var x, y, width, height int
+	// ctx, cancel := chromedp.NewContext(context.Background())
+
+	err = chromedp.Run(ctx,
+		chromedp.Evaluate(`window.screenX + window.outerWidth - window.innerWidth`, &x),
+		chromedp.Evaluate(`window.screenY + window.outerHeight - window.innerHeight`, &y),
+		chromedp.Evaluate(`window.innerWidth`, &width),
+		chromedp.Evaluate(`window.innerHeight`, &height),
+	)
+	if err != nil {
+		s.end(sessionStopped, "Chrome window not found")
+		http.Error(w, "Failed to get Chrome window position", http.StatusInternalServerError)
+		s.log.Error("Error getting Chrome window position", "error", err)
+		return
+	}
+
+	s.log.Info("Capturing window", "x", x, "y", y, "width", width, "height", height)
+
+	// Keep the original commented code as requested
+	// err := chromedp.Run(ctx,
+	// 	chromedp.Evaluate(`document.title = "`+fullWindowTitle+`"`, nil),
+	// )
+	// if err != nil {
+	// 	log.Fatal(err)
+	// }
+
+	// FFmpeg uploads the stream to the in-memory segment store
+	store := newSegmentStore(s.ID, s.Owner, func() { publishSession(s, sessionSegmentWritten, "") })
+
+	ffmpegCmd := exec.Command(cfg.FFmpeg.Path, cfg.FFmpeg.args(x, y, width, height, ingestURL(s.ID, store))...)
+	ffmpegStarted, release, err := confine(ffmpegCmd, "ffmpeg-"+s.ID, cfg.Limits.FFmpeg)
+	if err != nil {
+		s.end(sessionStopped, "FFmpeg could not be limited")
+		http.Error(w, "Failed to limit FFmpeg", http.StatusInternalServerError)
+		s.log.Error("Error limiting FFmpeg", "error", err)
+		return
+	}
+	s.attach(release)
+
+	stdout, err := ffmpegCmd.StdoutPipe()
+	if err != nil {
+		s.end(sessionStopped, "FFmpeg failed to start")
+		http.Error(w, "Failed to get FFmpeg stdout", http.StatusInternalServerError)
+		s.log.Error("Error getting FFmpeg stdout", "error", err)
+		return
+	}
+
+	stderr, err := ffmpegCmd.StderrPipe()
+	if err != nil {
+		s.end(sessionStopped, "FFmpeg failed to start")
+		http.Error(w, "Failed to get FFmpeg stderr", http.StatusInternalServerError)
+		s.log.Error("Error getting FFmpeg stderr", "error", err)
+		return
+	}
+
+	// stdout carries -progress reports, stderr the log
+	var output sync.WaitGroup
+	output.Add(2)
+	go func() {
+		defer output.Done()
+		s.health.read(s.ID, stdout)
+	}()
+	go func() {
+		defer output.Done()
+		defer stderr.Close()
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			s.log.Info(scanner.Text(), "source", "ffmpeg")
+		}
+	}()
+	outputDone := make(chan struct{})
+	go func() {
+		output.Wait()
+		close(outputDone)
+	}()
+
+	if err := ffmpegCmd.Start(); err != nil {
+		s.end(sessionStopped, "FFmpeg failed to start")
+		http.Error(w, "Failed to start stream", http.StatusInternalServerError)
+		s.log.Error("Error starting FFmpeg", "error", err)
+		return
+	}
+	ffmpegStarted(ffmpegCmd.Process.Pid)
+	s.attach(trackProcess("ffmpeg-"+s.ID, ffmpegCmd.Process.Pid))
+	mu.Lock()
+	s.ffmpeg, s.starting = ffmpegCmd, false
+	stopped := s.stopped
+	mu.Unlock()
+	if !stopped {
+		// before the watcher, which ends the session when FFmpeg exits at once
+		publishSession(s, sessionEncoderStarted, "")
+	}
+	go watchEncoder(s, ffmpegCmd, outputDone)
+	if stopped {
+		// the server shut down while the session started
+		ffmpegCmd.Process.Kill()
+		http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	s.log.Info("Streaming started")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"session": s.ID,
+	})
+}
+
+// // stopStream stops the FFmpeg process
+// func stopStream(w http.ResponseWriter, r *http.Request) {
+// 	mu.Lock()
+// 	defer mu.Unlock()
+
+// 	if ffmpegCmd == nil {
+// 		http.Error(w, "No active stream", http.StatusNotFound)
+// 		return
+// 	}
+
+// 	if err := ffmpegCmd.Process.Kill(); err != nil {
+// 		http.Error(w, "Failed to stop stream", http.StatusInternalServerError)
+// 		log.Println("Error stopping FFmpeg:", err)
+// 		return
+// 	}
+
+// 	ffmpegCmd = nil
+
+// 	closeBrowser()
+
+// 	// Clear the contents of the /hls/ folder
+// 	hlsDir := "hls/"
+// 	dir, err := os.Open(hlsDir)
+// 	if err != nil {
+// 		log.Println("Error opening HLS directory:", err)
+// 	} else {
+// 		defer dir.Close()
+// 		files, err := dir.Readdirnames(-1)
+// 		if err != nil {
+// 			log.Println("Error reading HLS directory:", err)
+// 		} else {
+// 			for _, file := range files {
+// 				err := os.Remove(hlsDir + file)
+// 				if err != nil {
+// 					log.Println("Error removing file:", err)
+// 				}
+// 			}
+// 		}
+// 	}
+
+// 	log.Println("Streaming stopped")
+// 	w.Write([]byte("Stream stopped"))
+// }
+
+// func startStream(w http.ResponseWriter, r *http.Request) {
+// 	mu.Lock()
+// 	defer mu.Unlock()
+
+// 	if gstCmd != nil {
+// 		http.Error(w, "Stream already running", http.StatusConflict)
+// 		return
+// 	}
+
+// 	os.MkdirAll("hls", os.ModePerm)
+
+// 	var requestBody struct {
+// 		PointCloudURL string `json:"pointCloudUrl"`
+// 	}
+// 	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+// 		http.Error(w, err.Error(), http.StatusBadRequest)
+// 		return
+// 	}
+
+// 	pointCloudUrl := requestBody.PointCloudURL
+// 	go openBrowser(pointCloudUrl)
+
+// 	gstCmd = exec.Command("gst-launch-1.0",
+// 		"d3d11screencapturesrc", "!", "videoconvert", "!", "videoscale", "!",
+// 		"video/x-raw,framerate=40/1,width=1920,height=1080", "!", "vp9enc",
+// 		"target-bitrate=6000000", "cpu-used=6", "deadline=1", "threads=8", "tile-columns=4", "row-mt=true", "!",
+// 		"filesink", "location=NUL",
+// 	)
+
+// 	// gstCmd.Stdout = os.Stdout
+// 	// gstCmd.Stderr = os.Stderr
+
+// 	ffmpegCmd = exec.Command("ffmpeg",
+// 		"-i", "-",
+// 		"-c:v", "libvpx-vp9",
+// 		"-c:a", "opus",
+// 		"-hls_time", "1",
+// 		"-hls_list_size", "5",
+// 		"-hls_flags", "append_list+delete_segments+split_by_time",
+// 		"-hls_segment_filename", "hls/segment_%03d.m4s",
+// 		"-hls_segment_type", "fmp4",
+// 		"-f", "hls",
+// 		"-loglevel", "debug",
+// 	)
+
+// 	ffmpegIn, err := ffmpegCmd.StdinPipe()
+// 	if err != nil {
+// 		http.Error(w, "Failed to get FFmpeg stdin", http.StatusInternalServerError)
+// 		log.Println("Error getting FFmpeg stdin:", err)
+// 		return
+// 	}
+
+// 	gstOut, err := gstCmd.StdoutPipe()
+// 	if err != nil {
+// 		http.Error(w, "Failed to get GStreamer stdout", http.StatusInternalServerError)
+// 		log.Println("Error getting GStreamer stdout:", err)
+// 		return
+// 	}
+
+// 	gstErr, err := gstCmd.StderrPipe()
+// 	if err != nil {
+// 		http.Error(w, "Failed to get GStreamer stderr", http.StatusInternalServerError)
+// 		log.Println("Error getting GStreamer stderr:", err)
+// 		return
+// 	}
+
+// 	go func() {
+// 		defer ffmpegIn.Close()
+// 		log.Println("Copying from GStreamer to FFmpeg...")
+// 		_, err := io.Copy(ffmpegIn, gstOut)
+// 		if err != nil {
+// 			log.Println("Error copying from GStreamer to FFmpeg:", err)
+// 		}
+// 	}()
+
+// 	go func() {
+// 		log.Println("GStreamer stderr:")
+// 		defer gstErr.Close()
+// 		scanner := bufio.NewScanner(gstErr)
+// 		for scanner.Scan() {
+// 			log.Println(scanner.Text())
+// 		}
+// 	}()
+
+// 	if err := ffmpegCmd.Start(); err != nil {
+// 		http.Error(w, "Failed to start FFmpeg", http.StatusInternalServerError)
+// 		log.Println("FFmpeg error:", err)
+// 		return
+// 	}
+
+// 	if err := gstCmd.Start(); err != nil {
+// 		http.Error(w, "Failed to start GStreamer", http.StatusInternalServerError)
+// 		log.Println("GStreamer error:", err)
+// 		return
+// 	}
+
+// 	log.Println("Streaming started")
+// 	w.Write([]byte("Stream started"))
+// }
+
+// stopStream stops the session named in the body, or the caller's only one
+func stopStream(w http.ResponseWriter, r *http.Request) {
+	var requestBody struct {
+		Session string `json:"session"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	p := principalFrom(r)
+	mu.Lock()
+	s, ok := sessions[requestBody.Session]
+	if requestBody.Session == "" {
+		owned := ownedSessions(p)
+		if len(owned) > 1 {
+			mu.Unlock()
+			http.Error(w, "Several streams are running, name one in session", http.StatusBadRequest)
+			return
+		}
+		s, ok = nil, len(owned) == 1
+		if ok {
+			s = owned[0]
+		}
+	}
+	starting := ok && s.starting
+	mu.Unlock()
+
+	if !ok {
+		http.Error(w, "No active stream", http.StatusNotFound)
+		return
+	}
+	if !p.owns(s.Owner) {
+		http.Error(w, "Stream was started by another user", http.StatusForbidden)
+		return
+	}
+	if starting {
+		http.Error(w, "Stream is still starting", http.StatusConflict)
+		return
+	}
+
+	s.end(sessionStopped, "")
+	s.log.Info("Streaming stopped")
+	w.Write([]byte("Stream stopped"))
+}
+
+// watchEncoder reports FFmpeg exiting without /stop as a crash
+func watchEncoder(s *streamSession, cmd *exec.Cmd, outputDone <-chan struct{}) {
+	// Wait closes stdout and stderr, so let their readers drain them first
+	<-outputDone
+	err := cmd.Wait()
+
+	message := "FFmpeg exited"
+	if err != nil {
+		message = err.Error()
+	}
+	// a session stopped through /stop has already ended
+	s.end(sessionEncoderCrashed, message)
+}
+
+// openBrowser launches Chrome using chromedp for a session. The browser
+// loads the datasets with the permissions of the session's owner.
+func openBrowser(s *streamSession, viewerQuery string, viewportHeight int, viewportWidth int) (context.Context, error) {
+	viewerURL := cfg.viewerURL(viewerQuery)
+
+	// the profile is removed once Chrome exits, or after a crash on the next start
+	profile, err := os.MkdirTemp("", "gis-chrome-")
+	if err != nil {
+		return nil, err
+	}
+	untrackProfile := trackDir(profile)
+	if !s.attach(func() {
+		if err := os.RemoveAll(profile); err != nil {
+			s.log.Error("Error removing Chrome profile", "dir", profile, "error", err)
+		}
+		untrackProfile()
+	}) {
+		return nil, errSessionEnded
+	}
+	token := browserTokens.issue(s.Owner)
+
+	// Disable headless mode and configure visible window
+	opts := append(chromedp.DefaultExecAllocatorOptions[:],
+		chromedp.Flag("headless", false), // Disable headless mode
+		chromedp.Flag("hide-scrollbars", false),
+		chromedp.Flag("window-position", "0,0"), // Position window
+		// chromedp.Flag("window-title", fullWindowTitle),
+		chromedp.Flag("app", viewerURL),
+		chromedp.Flag("disable-gpu", false), // Enable GPU acceleration
+		chromedp.Flag("disable-infobars", true),
+		chromedp.WindowSize(viewportWidth, viewportHeight),
+		chromedp.UserDataDir(profile),
+	)
+
+	// Force window to foreground
+	opts = append(opts, chromedp.Flag("start-maximized", true))
+
+	// Chrome and its helper processes run within the browser limits
+	var browserStarted func(pid int)
+	var confineErr error
+	opts = append(opts, chromedp.ModifyCmdFunc(func(cmd *exec.Cmd) {
+		var release func()
+		browserStarted, release, confineErr = confine(cmd, "chrome-"+s.ID, cfg.Limits.Browser)
+		if confineErr == nil {
+			s.attach(release)
+		}
+	}))
+
+	allocCtx, allocCancel := chromedp.NewExecAllocator(context.Background(),
+		opts...,
+	)
+
+	// Create new Chrome context
+	browserCtx, browserCancel := chromedp.NewContext(allocCtx)
+	watchBrowser(browserCtx, s)
+	authorizeViewerRequests(browserCtx, s, token)
+	mu.Lock()
+	s.browserToken = token
+	s.browserCancel = func() {
+		browserCancel()
+		allocCancel() // waits for Chrome to exit
+	}
+	stopped := s.stopped
+	mu.Unlock()
+	if stopped {
+		browserTokens.revoke(token)
+		browserCancel()
+		allocCancel()
+		return nil, errSessionEnded
+	}
+
+	// Add explicit window focus commands
+	if err := chromedp.Run(browserCtx,
+		network.Enable(),
+		fetch.Enable().WithPatterns([]*fetch.RequestPattern{{URLPattern: cfg.PublicURL + "/*", RequestStage: fetch.RequestStageRequest}}),
+		chromedp.Navigate(viewerURL),
+		// chromedp.WaitVisible(`#potree_render_area`, chromedp.ByID),
+		chromedp.ActionFunc(func(ctx context.Context) error {
+			// JavaScript to ensure window focus
+			return chromedp.Evaluate(`window.focus()`, nil).Do(ctx)
+		}),
+		// chromedp.ActionFunc(func(ctx context.Context) error {
+		// 	// JavaScript to ensure window focus
+		// 	return chromedp.Evaluate(`document.title = "`+fullWindowTitle+`"`, nil).Do(ctx)
+		// }),
+		chromedp.Sleep(cfg.Browser.SettleTime), // Allow window to render
+	); err != nil {
+		return nil, err
+	}
+	if confineErr != nil {
+		return nil, confineErr
+	}
+	pid := chromedp.FromContext(browserCtx).Browser.Process().Pid
+	browserStarted(pid)
+	s.attach(trackProcess("chrome-"+s.ID, pid))
+
+	return browserCtx, nil
+}
+
+// authorizeViewerRequests adds the session's token to the requests the
+// viewer makes to this server, which fetch.Enable pauses. Requests to other
+// hosts are not paused and never see the token.
+func authorizeViewerRequests(ctx context.Context, s *streamSession, token string) {
+	chromedp.ListenTarget(ctx, func(ev interface{}) {
+		paused, ok := ev.(*fetch.EventRequestPaused)
+		if !ok {
+			return
+		}
+		// handlers must not block the event loop that answers the command
+		go func() {
+			req := fetch.ContinueRequest(paused.RequestID)
+			if strings.HasPrefix(paused.Request.URL, cfg.PublicURL+"/") {
+				headers := []*fetch.HeaderEntry{{Name: "Authorization", Value: "Bearer " + token}}
+				for name, value := range paused.Request.Headers {
+					if !strings.EqualFold(name, "Authorization") {
+						headers = append(headers, &fetch.HeaderEntry{Name: name, Value: fmt.Sprint(value)})
+					}
+				}
+				req = req.WithHeaders(headers)
+			}
+			c := chromedp.FromContext(ctx)
+			if err := req.Do(cdp.WithExecutor(ctx, c.Target)); err != nil && ctx.Err() == nil {
+				s.log.Error("Error continuing viewer request", "url", paused.Request.URL, "error", err)
+			}
+		}()
+	})
+}
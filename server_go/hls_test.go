@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestStartStreamExternalCloud(t *testing.T) {
+	defer func(enabled bool) { authEnabled = enabled }(authEnabled)
+	h := authenticate(http.HandlerFunc(startStream))
+
+	// the camera CRS needs a dataset, so /start answers 400 right after
+	// authorizing an external cloud instead of launching Chrome
+	const body = `{"pointCloudUrl": "https://example.com/ept/ept.json",
+		"camera": {"position": [0, 0, 0], "target": [1, 1, 1], "crs": "EPSG:4326"}}`
+	tests := []struct {
+		name string
+		auth bool
+		acls map[string]datasetACL
+		p    *principal
+		want int
+	}{
+		{"auth off", false, nil, nil, http.StatusBadRequest},
+		{"auth off with ACLs", false, map[string]datasetACL{"*": {}}, nil, http.StatusBadRequest},
+		{"admin", true, nil, &principal{Subject: "root", admin: true}, http.StatusBadRequest},
+		{"streamer", true, map[string]datasetACL{"*": {Stream: []string{"alice"}}}, &principal{Subject: "alice"}, http.StatusBadRequest},
+		{"viewer", true, map[string]datasetACL{"*": {View: []string{"*"}}}, &principal{Subject: "alice"}, http.StatusForbidden},
+		{"no fallback ACL", true, map[string]datasetACL{"survey": {Stream: []string{"*"}}}, &principal{Subject: "alice"}, http.StatusForbidden},
+		{"anonymous", true, map[string]datasetACL{"*": {Stream: []string{"*"}}}, nil, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		authEnabled = tt.auth
+		withACLs(t, tt.acls)
+		r := httptest.NewRequest("POST", "/start", strings.NewReader(body))
+		if tt.p != nil {
+			r = withPrincipal(r, tt.p)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		if rec.Code != tt.want {
+			t.Errorf("%s: POST /start = %d %q, want %d", tt.name, rec.Code, rec.Body.String(), tt.want)
+		}
+	}
+}
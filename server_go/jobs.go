@@ -0,0 +1,383 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Job states
+const (
+	jobQueued   = "queued"
+	jobRunning  = "running"
+	jobDone     = "done"
+	jobFailed   = "failed"
+	jobCanceled = "canceled"
+)
+
+// maxJobLogLines bounds the log kept for each job
+const maxJobLogLines = 500
+
+// job is a long running processing task whose outputs are written to jobs/{id}/
+type job struct {
+	ID       string     `json:"id"`
+	Type     string     `json:"type"`
+	Dataset  string     `json:"dataset"`
+	Status   string     `json:"status"`
+	Progress float64    `json:"progress"` // percent
+	Error    string     `json:"error,omitempty"`
+	Outputs  []string   `json:"outputs"`
+	Log      []string   `json:"log,omitempty"`
+	Created  time.Time  `json:"created"`
+	Started  *time.Time `json:"started,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+
+	fn            func(ctx context.Context, dir string) ([]string, error)
+	ctx           context.Context
+	cancel        context.CancelFunc
+	lastSaved     time.Time
+	lastPublished time.Time
+}
+
+var (
+	jobsMu   sync.Mutex
+	jobs     = map[string]*job{}
+	jobQueue []*job
+	jobReady = sync.NewCond(&jobsMu)
+)
+
+// jobDir returns the output directory of a job
+func jobDir(id string) string {
+	return filepath.Join(cfg.JobsDir, id)
+}
+
+// finished reports whether the job has stopped for good
+func (j *job) finished() bool {
+	return j.Status == jobDone || j.Status == jobFailed || j.Status == jobCanceled
+}
+
+// initJobs restores jobs from the store at path and starts workers that
+// run queued jobs, at most workers at a time. Jobs that were queued or
+// running when the server stopped cannot be resumed and are marked failed.
+func initJobs(path string, workers int) error {
+	restored, err := openJobStore(path)
+	if err != nil {
+		return err
+	}
+
+	jobsMu.Lock()
+	for _, j := range restored {
+		if !j.finished() {
+			now := time.Now()
+			j.Status = jobFailed
+			j.Error = "interrupted by a server restart"
+			j.Finished = &now
+			saveJob(j)
+		}
+		jobs[j.ID] = j
+	}
+	jobsMu.Unlock()
+
+	for i := 0; i < max(1, workers); i++ {
+		go jobWorker()
+	}
+	slog.Info("Jobs restored", "jobs", len(restored), "workers", max(1, workers))
+	return nil
+}
+
+// startJob queues fn to run in the background; fn writes its files into dir
+// and returns their names relative to it. ctx is canceled when the job is,
+// and carries the job for reportProgress and jobLogf.
+func startJob(kind, dataset string, fn func(ctx context.Context, dir string) ([]string, error)) *job {
+	j := &job{
+		ID:      uuid.New().String(),
+		Type:    kind,
+		Dataset: dataset,
+		Status:  jobQueued,
+		Outputs: []string{},
+		Created: time.Now(),
+		fn:      fn,
+	}
+	j.ctx, j.cancel = context.WithCancel(context.WithValue(context.Background(), jobKey{}, &jobStage{j: j, to: 1}))
+
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	jobs[j.ID] = j
+	jobQueue = append(jobQueue, j)
+	saveJob(j)
+	publishJob(j)
+	jobReady.Signal()
+	return j
+}
+
+// jobWorker runs queued jobs one after another
+func jobWorker() {
+	for {
+		jobsMu.Lock()
+		for len(jobQueue) == 0 {
+			jobReady.Wait()
+		}
+		j := jobQueue[0]
+		jobQueue = jobQueue[1:]
+		now := time.Now()
+		j.Status = jobRunning
+		j.Started = &now
+		saveJob(j)
+		publishJob(j)
+		jobsMu.Unlock()
+
+		runJob(j)
+	}
+}
+
+// runJob runs a job and records how it ended
+func runJob(j *job) {
+	dir := jobDir(j.ID)
+	outputs, err := func() ([]string, error) {
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			return nil, err
+		}
+		return j.fn(j.ctx, dir)
+	}()
+	canceled := j.ctx.Err() != nil
+	j.cancel()
+
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	now := time.Now()
+	j.Finished = &now
+	j.fn = nil
+	switch {
+	case canceled:
+		j.Status = jobCanceled
+		os.RemoveAll(dir)
+		j.logger().Info("Job canceled")
+	case err != nil:
+		j.Status = jobFailed
+		j.Error = err.Error()
+		j.logger().Error("Job failed", "error", err)
+	default:
+		j.Status = jobDone
+		j.Progress = 100
+		j.Outputs = outputs
+		j.logger().Info("Job finished")
+	}
+	saveJob(j)
+	publishJob(j)
+}
+
+// logger returns a logger tagged with the job
+func (j *job) logger() *slog.Logger {
+	return slog.With("job", j.ID, "type", j.Type, "dataset", j.Dataset)
+}
+
+// jobKey is the context key of the running job
+type jobKey struct{}
+
+// jobStage is the part of a job's progress that a step of it covers
+type jobStage struct {
+	j        *job
+	from, to float64
+}
+
+// progressStage returns a context whose progress reports cover the
+// fraction from..to of the job's progress, for jobs with several steps
+func progressStage(ctx context.Context, from, to float64) context.Context {
+	s, ok := ctx.Value(jobKey{}).(*jobStage)
+	if !ok {
+		return ctx
+	}
+	span := s.to - s.from
+	return context.WithValue(ctx, jobKey{}, &jobStage{j: s.j, from: s.from + from*span, to: s.from + to*span})
+}
+
+// reportProgress records that done of total units of work of the job
+// running with ctx are complete. It does nothing outside a job.
+func reportProgress(ctx context.Context, done, total int) {
+	s, ok := ctx.Value(jobKey{}).(*jobStage)
+	if !ok || total <= 0 {
+		return
+	}
+	percent := 100 * (s.from + (s.to-s.from)*float64(min(done, total))/float64(total))
+
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	s.j.Progress = percent
+	if time.Since(s.j.lastSaved) > jobSaveInterval {
+		saveJob(s.j)
+	}
+	if time.Since(s.j.lastPublished) > 250*time.Millisecond {
+		s.j.lastPublished = time.Now()
+		publishJob(s.j)
+	}
+}
+
+// jobLogf adds a line to the log of the job running with ctx, or to the
+// server log outside a job
+func jobLogf(ctx context.Context, format string, args ...any) {
+	line := fmt.Sprintf(format, args...)
+	s, ok := ctx.Value(jobKey{}).(*jobStage)
+	if !ok {
+		slog.Info(line)
+		return
+	}
+	s.j.logger().Info(line)
+
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	s.j.Log = append(s.j.Log, time.Now().Format(time.RFC3339)+" "+line)
+	if len(s.j.Log) > maxJobLogLines {
+		s.j.Log = s.j.Log[len(s.j.Log)-maxJobLogLines:]
+	}
+	// the final save of runJob keeps lines logged since the last one
+	if time.Since(s.j.lastSaved) > jobSaveInterval {
+		saveJob(s.j)
+	}
+}
+
+// cancelJob stops a queued or running job; running jobs stop at their
+// next cancellation check
+func cancelJob(j *job) error {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	switch j.Status {
+	case jobQueued:
+		jobQueue = slices.DeleteFunc(jobQueue, func(q *job) bool { return q == j })
+		now := time.Now()
+		j.Status = jobCanceled
+		j.Finished = &now
+		j.fn = nil
+		j.cancel()
+		saveJob(j)
+		publishJob(j)
+		j.logger().Info("Job canceled")
+	case jobRunning:
+		j.cancel()
+	default:
+		return errors.New("job has already finished")
+	}
+	return nil
+}
+
+// writeJob responds with a snapshot of the job
+func writeJob(w http.ResponseWriter, status int, j *job) {
+	jobsMu.Lock()
+	snapshot := *j
+	snapshot.Log = slices.Clone(j.Log)
+	jobsMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(&snapshot)
+}
+
+// lookupJob returns the job of the request's {id} if the caller holds perm
+// on its dataset, or responds with an error
+func lookupJob(w http.ResponseWriter, r *http.Request, perm string) (*job, bool) {
+	jobsMu.Lock()
+	j, ok := jobs[r.PathValue("id")]
+	jobsMu.Unlock()
+	if !ok {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return nil, false
+	}
+	return j, authorize(w, r, j.Dataset, perm)
+}
+
+// listJobs handles GET /jobs, newest first, optionally filtered by the
+// status, type and dataset query parameters. Logs are left out.
+func listJobs(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	p := principalFrom(r)
+	list := []job{}
+	jobsMu.Lock()
+	for _, j := range jobs {
+		if (q.Has("status") && q.Get("status") != j.Status) ||
+			(q.Has("type") && q.Get("type") != j.Type) ||
+			(q.Has("dataset") && q.Get("dataset") != j.Dataset) || !p.allowed(j.Dataset, permView) {
+			continue
+		}
+		snapshot := *j
+		snapshot.Log = nil
+		list = append(list, snapshot)
+	}
+	jobsMu.Unlock()
+	slices.SortFunc(list, func(a, b job) int { return b.Created.Compare(a.Created) })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// getJob handles GET /jobs/{id}
+func getJob(w http.ResponseWriter, r *http.Request) {
+	if j, ok := lookupJob(w, r, permView); ok {
+		writeJob(w, http.StatusOK, j)
+	}
+}
+
+// stopJob handles POST /jobs/{id}/cancel
+func stopJob(w http.ResponseWriter, r *http.Request) {
+	j, ok := lookupJob(w, r, permExtract)
+	if !ok {
+		return
+	}
+	if err := cancelJob(j); err != nil {
+		http.Error(w, "Job has already finished", http.StatusConflict)
+		return
+	}
+	writeJob(w, http.StatusAccepted, j)
+}
+
+// deleteJob handles DELETE /jobs/{id} and removes a finished job with its files
+func deleteJob(w http.ResponseWriter, r *http.Request) {
+	j, ok := lookupJob(w, r, permExtract)
+	if !ok {
+		return
+	}
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	if !j.finished() {
+		http.Error(w, "Job has not finished, cancel it first", http.StatusConflict)
+		return
+	}
+	if err := os.RemoveAll(jobDir(j.ID)); err != nil {
+		http.Error(w, "Failed to remove job files", http.StatusInternalServerError)
+		requestLog(r).Error("Error removing job files", "job", j.ID, "error", err)
+		return
+	}
+	delete(jobs, j.ID)
+	removeJob(j.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getJobFile handles GET /jobs/{id}/files/{file}
+func getJobFile(w http.ResponseWriter, r *http.Request) {
+	j, ok := lookupJob(w, r, permView)
+	if !ok {
+		return
+	}
+	jobsMu.Lock()
+	done := j.Status == jobDone
+	jobsMu.Unlock()
+	if !done {
+		http.Error(w, "Job has not finished", http.StatusConflict)
+		return
+	}
+
+	file := r.PathValue("file")
+	if file != filepath.Base(file) {
+		http.Error(w, "Invalid file name", http.StatusBadRequest)
+		return
+	}
+	http.ServeFile(w, r, filepath.Join(jobDir(j.ID), file))
+}
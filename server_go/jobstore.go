@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var jobsBucket = []byte("jobs")
+
+// jobDB persists jobs so they survive restarts, nil when persistence is off
+var jobDB *bolt.DB
+
+// openJobStore opens or creates the job database at path and returns the
+// jobs stored in it
+func openJobStore(path string) ([]*job, error) {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(path, 0o644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	var restored []*job
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(jobsBucket)
+		if err != nil {
+			return err
+		}
+		return b.ForEach(func(k, v []byte) error {
+			j := &job{}
+			if err := json.Unmarshal(v, j); err != nil {
+				slog.Warn("Skipping unreadable job", "job", string(k), "error", err)
+				return nil
+			}
+			restored = append(restored, j)
+			return nil
+		})
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	jobDB = db
+	go writeJobs()
+	return restored, nil
+}
+
+// jobSaveInterval is how often progress and log lines of a running job are
+// saved; state changes are saved at once
+const jobSaveInterval = 2 * time.Second
+
+var (
+	jobWritesMu sync.Mutex
+	jobWrites   = map[string][]byte{} // latest unsaved snapshot by job ID, nil to delete
+	jobWrite    = make(chan struct{}, 1)
+	jobFlushMu  sync.Mutex // keeps flushes, and so the snapshots, in order
+)
+
+// saveJob queues a snapshot of a job for the store; callers hold jobsMu.
+// writeJobs saves it, so holding jobsMu never waits for the disk.
+func saveJob(j *job) {
+	if jobDB == nil {
+		return
+	}
+	j.lastSaved = time.Now()
+	raw, err := json.Marshal(j)
+	if err != nil {
+		j.logger().Error("Error encoding job", "error", err)
+		return
+	}
+	queueJobWrite(j.ID, raw)
+}
+
+// removeJob deletes a job from the store
+func removeJob(id string) {
+	if jobDB == nil {
+		return
+	}
+	queueJobWrite(id, nil)
+}
+
+// queueJobWrite replaces the pending write of a job and wakes writeJobs
+func queueJobWrite(id string, raw []byte) {
+	jobWritesMu.Lock()
+	jobWrites[id] = raw
+	jobWritesMu.Unlock()
+	select {
+	case jobWrite <- struct{}{}:
+	default:
+	}
+}
+
+// writeJobs saves queued snapshots until the server stops. Snapshots queued
+// while a transaction runs are saved together in the next one.
+func writeJobs() {
+	for range jobWrite {
+		flushJobsUntil(context.Background())
+	}
+}
+
+// flushJobsUntil retries flushJobs with backoff until it succeeds or ctx ends
+func flushJobsUntil(ctx context.Context) error {
+	for retry := time.Second; ; retry = min(2*retry, time.Minute) {
+		err := flushJobs()
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(retry):
+		}
+	}
+}
+
+// flushJobs saves the queued snapshots in one transaction, queueing them
+// again when it fails
+func flushJobs() error {
+	jobFlushMu.Lock()
+	defer jobFlushMu.Unlock()
+	jobWritesMu.Lock()
+	pending := jobWrites
+	jobWrites = map[string][]byte{}
+	jobWritesMu.Unlock()
+	if len(pending) == 0 || jobDB == nil {
+		return nil
+	}
+
+	err := jobDB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(jobsBucket)
+		for id, raw := range pending {
+			var err error
+			if raw == nil {
+				err = b.Delete([]byte(id))
+			} else {
+				err = b.Put([]byte(id), raw)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		slog.Error("Error saving jobs", "jobs", len(pending), "error", err)
+		requeueJobWrites(pending)
+	}
+	return err
+}
+
+// requeueJobWrites queues snapshots again that have not been replaced
+func requeueJobWrites(pending map[string][]byte) {
+	jobWritesMu.Lock()
+	defer jobWritesMu.Unlock()
+	for id, raw := range pending {
+		if _, newer := jobWrites[id]; !newer {
+			jobWrites[id] = raw
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// openTestJobDB opens a job database holding job "b" as jobDB until the test ends
+func openTestJobDB(t *testing.T, path string, readOnly bool) {
+	t.Helper()
+	db, err := bolt.Open(path, 0o600, &bolt.Options{ReadOnly: readOnly})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !readOnly {
+		err = db.Update(func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucketIfNotExists(jobsBucket)
+			if err != nil {
+				return err
+			}
+			if b.Get([]byte("b")) != nil {
+				return nil
+			}
+			return b.Put([]byte("b"), []byte(`{"id":"b"}`))
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := jobDB
+	jobDB = db
+	t.Cleanup(func() {
+		jobDB = old
+		db.Close()
+	})
+}
+
+func TestFlushJobsRequeuesOnError(t *testing.T) {
+	defer func() { jobWrites = map[string][]byte{} }()
+	path := filepath.Join(t.TempDir(), "jobs.db")
+	openTestJobDB(t, path, false)
+	jobDB.Close()
+	openTestJobDB(t, path, true)
+
+	queueJobWrite("a", []byte(`{"id":"a","state":"done"}`))
+	queueJobWrite("b", nil)
+	if err := flushJobs(); err == nil {
+		t.Fatal("flush into a read-only database succeeded")
+	}
+	if len(jobWrites) != 2 || jobWrites["b"] != nil || string(jobWrites["a"]) != `{"id":"a","state":"done"}` {
+		t.Fatalf("queue after a failed flush = %q", jobWrites)
+	}
+
+	// snapshots queued while the flush ran win over the failed ones
+	queueJobWrite("c", []byte("new"))
+	requeueJobWrites(map[string][]byte{"c": []byte("old"), "d": []byte("old")})
+	if string(jobWrites["c"]) != "new" || string(jobWrites["d"]) != "old" {
+		t.Errorf("requeued c = %q, d = %q", jobWrites["c"], jobWrites["d"])
+	}
+	delete(jobWrites, "c")
+	delete(jobWrites, "d")
+
+	jobDB.Close()
+	openTestJobDB(t, path, false)
+	if err := flushJobs(); err != nil {
+		t.Fatal(err)
+	}
+	if len(jobWrites) != 0 {
+		t.Errorf("queue after a flush = %q", jobWrites)
+	}
+	jobDB.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(jobsBucket)
+		if got := string(b.Get([]byte("a"))); got != `{"id":"a","state":"done"}` {
+			t.Errorf("saved a = %q", got)
+		}
+		if got := b.Get([]byte("b")); got != nil {
+			t.Errorf("deleted b = %q", got)
+		}
+		return nil
+	})
+}
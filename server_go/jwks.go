@@ -0,0 +1,273 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// jwk is a JSON Web Key (RFC 7517) of type RSA, EC or OKP
+type jwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// publicKey decodes the key into a crypto public key
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	b64 := base64.RawURLEncoding
+	switch k.Kty {
+	case "RSA":
+		n, err1 := b64.DecodeString(k.N)
+		e, err2 := b64.DecodeString(k.E)
+		if err1 != nil || err2 != nil || len(e) > 4 {
+			return nil, errors.New("invalid RSA key")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		curve := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}[k.Crv]
+		x, err1 := b64.DecodeString(k.X)
+		y, err2 := b64.DecodeString(k.Y)
+		if curve == nil || err1 != nil || err2 != nil {
+			return nil, errors.New("invalid EC key")
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("EC key is not on its curve")
+		}
+		return key, nil
+	case "OKP":
+		x, err := b64.DecodeString(k.X)
+		if k.Crv != "Ed25519" || err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid OKP key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// parseJWKS decodes a JSON Web Key Set into public keys by key ID, skipping
+// encryption keys and keys of unsupported types
+func parseJWKS(raw []byte) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(raw, &set); err != nil {
+		return nil, err
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Use == "enc" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			slog.Warn("Skipping JWKS key", "kid", k.Kid, "error", err)
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("key set has no usable signing keys")
+	}
+	return keys, nil
+}
+
+// keySet finds the key that verifies a token
+type keySet interface {
+	key(kid string) (crypto.PublicKey, error)
+}
+
+// staticKeys is a key set read once from a local JWKS file
+type staticKeys map[string]crypto.PublicKey
+
+// loadJWKSFile reads a JWKS file
+func loadJWKSFile(path string) (staticKeys, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := parseJWKS(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return keys, nil
+}
+
+func (s staticKeys) key(kid string) (crypto.PublicKey, error) {
+	return lookupKey(s, kid)
+}
+
+// lookupKey returns the key of kid, or the only key when the token names none
+func lookupKey(keys map[string]crypto.PublicKey, kid string) (crypto.PublicKey, error) {
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+	if kid == "" && len(keys) == 1 {
+		for _, key := range keys {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown key %q", kid)
+}
+
+// oidcKeys is the key set of an OpenID Connect provider, found through
+// discovery and refreshed hourly or when a token names an unknown key
+type oidcKeys struct {
+	jwksURI string
+
+	mu      sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+}
+
+var oidcClient = &http.Client{Timeout: 10 * time.Second}
+
+// discoverOIDC reads the provider configuration of an issuer and its keys
+func discoverOIDC(issuer string) (*oidcKeys, error) {
+	var discovery struct {
+		Issuer  string `json:"issuer"`
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := getJSON(strings.TrimSuffix(issuer, "/")+"/.well-known/openid-configuration", &discovery); err != nil {
+		return nil, err
+	}
+	if discovery.Issuer != issuer {
+		return nil, fmt.Errorf("provider reports issuer %q instead of %q", discovery.Issuer, issuer)
+	}
+	o := &oidcKeys{jwksURI: discovery.JWKSURI}
+	if err := o.refresh(); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// refresh fetches the key set; callers other than discoverOIDC hold mu
+func (o *oidcKeys) refresh() error {
+	resp, err := oidcClient.Get(o.jwksURI)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", o.jwksURI, resp.Status)
+	}
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	keys, err := parseJWKS(raw)
+	if err != nil {
+		return fmt.Errorf("%s: %w", o.jwksURI, err)
+	}
+	o.keys, o.fetched = keys, time.Now()
+	return nil
+}
+
+func (o *oidcKeys) key(kid string) (crypto.PublicKey, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	_, known := o.keys[kid]
+	// rotated keys show up as unknown key IDs; refresh at most once a minute
+	if age := time.Since(o.fetched); age > time.Hour || (!known && age > time.Minute) {
+		if err := o.refresh(); err != nil {
+			slog.Error("Error refreshing OIDC keys", "error", err)
+		}
+	}
+	return lookupKey(o.keys, kid)
+}
+
+// getJSON decodes the JSON document at url
+func getJSON(url string, v any) error {
+	resp, err := oidcClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// jwtAuthenticator accepts bearer JWTs signed by a key set
+type jwtAuthenticator struct {
+	keys        keySet
+	issuer      string
+	audience    string
+	groupsClaim string
+}
+
+// authenticate verifies a token and returns its principal
+func (a *jwtAuthenticator) authenticate(token string) (*principal, error) {
+	if strings.Count(token, ".") != 2 {
+		return nil, errNotMine
+	}
+	// with several token issuers configured, leave other issuers' tokens to them
+	if a.issuer != "" {
+		unverified, _, err := jwt.NewParser().ParseUnverified(token, jwt.MapClaims{})
+		if err != nil {
+			return nil, errNotMine
+		}
+		if iss, _ := unverified.Claims.GetIssuer(); iss != a.issuer {
+			return nil, errNotMine
+		}
+	}
+	opts := []jwt.ParserOption{
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(30 * time.Second),
+	}
+	if a.issuer != "" {
+		opts = append(opts, jwt.WithIssuer(a.issuer))
+	}
+	if a.audience != "" {
+		opts = append(opts, jwt.WithAudience(a.audience))
+	}
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (any, error) {
+		kid, _ := t.Header["kid"].(string)
+		return a.keys.key(kid)
+	}, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	subject, err := claims.GetSubject()
+	if err != nil || subject == "" {
+		return nil, errors.New("token has no subject")
+	}
+	p := &principal{Subject: subject}
+	switch groups := claims[a.groupsClaim].(type) {
+	case []any:
+		for _, g := range groups {
+			if s, ok := g.(string); ok {
+				p.Groups = append(p.Groups, s)
+			}
+		}
+	case string:
+		p.Groups = strings.Fields(groups)
+	}
+	return p, nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// limitsConfig caps the streaming sessions and the processes they spawn.
+// Every session captures its own region of the same screen, so more than
+// one session needs windows that do not overlap.
+type limitsConfig struct {
+	MaxSessions        int `yaml:"maxSessions"`
+	MaxSessionsPerUser int `yaml:"maxSessionsPerUser"` // 0 for no per-user cap
+	// MaxLoad is the 1-minute load average per CPU above which new
+	// sessions are refused, 0 to ignore the load
+	MaxLoad float64 `yaml:"maxLoad"`
+	// MinAvailableMemoryMB is the memory a new session needs to be free
+	MinAvailableMemoryMB int `yaml:"minAvailableMemoryMb"`
+	// QueueTimeout is how long /start waits for a free slot before giving
+	// up, 0 to refuse at once
+	QueueTimeout time.Duration `yaml:"queueTimeout"`
+	// RetryAfter is the delay suggested to refused clients
+	RetryAfter time.Duration `yaml:"retryAfter"`
+	// IdleTimeout stops sessions without segment requests or heartbeats
+	IdleTimeout time.Duration `yaml:"idleTimeout"`
+	// MaxLifetime stops sessions running longer, 0 for no limit
+	MaxLifetime time.Duration `yaml:"maxLifetime"`
+	// MaxProfilePoints caps the points of one elevation profile, 0 for no cap
+	MaxProfilePoints int `yaml:"maxProfilePoints"`
+
+	// CgroupRoot is a cgroup v2 directory the server may create groups in
+	// (Linux only). Without one, memory limits are set with setrlimit.
+	CgroupRoot string        `yaml:"cgroupRoot"`
+	Browser    processLimits `yaml:"browser"`
+	FFmpeg     processLimits `yaml:"ffmpeg"`
+}
+
+// processLimits confine a spawned process and its children; 0 is unlimited
+type processLimits struct {
+	// MemoryMB is the cgroup memory.max, or the address space limit
+	// (RLIMIT_AS) without cgroups, which Chrome does not tolerate
+	MemoryMB     int     `yaml:"memoryMb"`
+	CPUs         float64 `yaml:"cpus"`         // cgroups only
+	MaxProcesses int     `yaml:"maxProcesses"` // cgroups only
+}
+
+// unlimited reports whether no limit is set
+func (l processLimits) unlimited() bool {
+	return l == processLimits{}
+}
+
+// admissionError tells why a session cannot start now
+type admissionError struct {
+	status  int
+	message string
+}
+
+// admit reserves a new session for p when the session caps and the load of
+// the host allow it; callers hold mu
+func admit(p *principal, datasets []string) (*streamSession, *admissionError) {
+	l := &cfg.Limits
+	if shuttingDown {
+		return nil, &admissionError{http.StatusServiceUnavailable, "Server is shutting down"}
+	}
+	if l.MaxSessionsPerUser > 0 && len(ownedSessions(p)) >= l.MaxSessionsPerUser {
+		return nil, &admissionError{http.StatusTooManyRequests,
+			"Each user may run at most " + strconv.Itoa(l.MaxSessionsPerUser) + " streams at a time"}
+	}
+	if len(sessions) >= l.MaxSessions {
+		return nil, &admissionError{http.StatusServiceUnavailable, "All stream slots are in use"}
+	}
+
+	load, availableMB, err := systemLoad()
+	if errors.Is(err, errors.ErrUnsupported) {
+		warnOnce(&loadWarning, "Host load is not available on "+runtime.GOOS+", admission only checks session caps")
+	} else if err != nil {
+		slog.Error("Error reading host load", "error", err)
+	} else {
+		if l.MaxLoad > 0 && load/float64(runtime.NumCPU()) > l.MaxLoad {
+			return nil, &admissionError{http.StatusServiceUnavailable, "Server is too busy to start a stream"}
+		}
+		if availableMB < int64(l.MinAvailableMemoryMB) {
+			return nil, &admissionError{http.StatusServiceUnavailable, "Server does not have enough free memory to start a stream"}
+		}
+	}
+
+	s := &streamSession{ID: uuid.New().String(), Owner: p, Started: time.Now(), datasets: datasets, starting: true}
+	s.log = newSessionLogger(s.ID, p, datasets)
+	s.touch()
+	sessions[s.ID] = s
+	return s, nil
+}
+
+// admitSession reserves a session for the caller to stream datasets,
+// waiting up to QueueTimeout for the server to have room. It responds with
+// 429 when the caller is at their own cap and 503 when the server is full,
+// both with Retry-After.
+func admitSession(w http.ResponseWriter, r *http.Request, datasets []string) (*streamSession, bool) {
+	deadline := time.Now().Add(cfg.Limits.QueueTimeout)
+	for {
+		mu.Lock()
+		s, refused := admit(principalFrom(r), datasets)
+		closing := shuttingDown
+		mu.Unlock()
+		if refused == nil {
+			return s, true
+		}
+		// waiting does not help callers at their own cap or during shutdown
+		if refused.status == http.StatusTooManyRequests || closing || time.Now().After(deadline) {
+			w.Header().Set("Retry-After", strconv.Itoa(int(cfg.Limits.RetryAfter.Seconds())))
+			http.Error(w, refused.message, refused.status)
+			return nil, false
+		}
+		select {
+		case <-r.Context().Done():
+			return nil, false
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+var loadWarning, limitsWarning sync.Once
+
+// warnOnce logs a message the first time it is called with once
+func warnOnce(once *sync.Once, message string) {
+	once.Do(func() { slog.Warn(message) })
+}
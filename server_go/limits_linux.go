@@ -0,0 +1,153 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// systemLoad returns the 1-minute load average and the available memory in MB
+func systemLoad() (load float64, availableMB int64, err error) {
+	raw, err := os.ReadFile("/proc/loadavg")
+	if err != nil {
+		return 0, 0, err
+	}
+	fields := strings.Fields(string(raw))
+	if len(fields) == 0 {
+		return 0, 0, errors.New("empty /proc/loadavg")
+	}
+	if load, err = strconv.ParseFloat(fields[0], 64); err != nil {
+		return 0, 0, err
+	}
+
+	raw, err = os.ReadFile("/proc/meminfo")
+	if err != nil {
+		return 0, 0, err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	for scanner.Scan() {
+		if rest, ok := strings.CutPrefix(scanner.Text(), "MemAvailable:"); ok {
+			kb, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimSpace(rest), " kB"), 10, 64)
+			return load, kb / 1024, err
+		}
+	}
+	return 0, 0, errors.New("MemAvailable missing from /proc/meminfo")
+}
+
+// confine prepares cmd, which has not started yet, to run within limits.
+// started finishes the setup once the process runs and release kills what
+// is left of it and removes its cgroup when the session ends.
+func confine(cmd *exec.Cmd, name string, l processLimits) (started func(pid int), release func(), err error) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	// do not outlive the server, as chromedp does for its own commands
+	cmd.SysProcAttr.Pdeathsig = syscall.SIGKILL
+
+	started, release = func(int) {}, func() {}
+	if l.unlimited() {
+		return started, release, nil
+	}
+	if cfg.Limits.CgroupRoot == "" {
+		if l.CPUs > 0 || l.MaxProcesses > 0 {
+			warnOnce(&limitsWarning, "CPU and process limits need limits.cgroupRoot, only memory limits are applied")
+		}
+		return func(pid int) { setMemoryRlimit(pid, l.MemoryMB) }, release, nil
+	}
+
+	dir := filepath.Join(cfg.Limits.CgroupRoot, name)
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		return nil, nil, err
+	}
+	settings := map[string]string{}
+	if l.MemoryMB > 0 {
+		settings["memory.max"] = strconv.Itoa(l.MemoryMB << 20)
+	}
+	if l.CPUs > 0 {
+		settings["cpu.max"] = fmt.Sprintf("%d 100000", int(l.CPUs*100000))
+	}
+	if l.MaxProcesses > 0 {
+		settings["pids.max"] = strconv.Itoa(l.MaxProcesses)
+	}
+	for file, value := range settings {
+		if err := os.WriteFile(filepath.Join(dir, file), []byte(value), 0o644); err != nil {
+			os.Remove(dir)
+			return nil, nil, err
+		}
+	}
+	group, err := os.Open(dir)
+	if err != nil {
+		os.Remove(dir)
+		return nil, nil, err
+	}
+	// the process starts inside the group, so its children are confined too
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = int(group.Fd())
+
+	untrack := trackCgroup(dir)
+	release = func() {
+		group.Close()
+		removeCgroup(dir)
+		untrack()
+	}
+	return func(int) { group.Close() }, release, nil
+}
+
+// removeCgroup kills the processes of a cgroup and removes it
+func removeCgroup(dir string) {
+	err := os.WriteFile(filepath.Join(dir, "cgroup.kill"), []byte("1"), 0o644)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	} else if err != nil {
+		slog.Error("Error killing cgroup", "cgroup", dir, "error", err)
+	}
+	// the group can only be removed once its processes have exited
+	var rmErr error
+	for range 20 {
+		if rmErr = os.Remove(dir); rmErr == nil || errors.Is(rmErr, os.ErrNotExist) {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	slog.Error("Error removing cgroup", "cgroup", dir, "error", rmErr)
+}
+
+// processStarted returns when a process started, in clock ticks since
+// boot, which tells it apart from a later process with the same PID
+func processStarted(pid int) (uint64, error) {
+	raw, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return 0, err
+	}
+	// the command name in parentheses may contain spaces and parentheses;
+	// the start time is the 22nd field, the 20th after the name
+	fields := strings.Fields(string(raw[bytes.LastIndexByte(raw, ')')+1:]))
+	if len(fields) < 20 {
+		return 0, fmt.Errorf("unexpected /proc/%d/stat", pid)
+	}
+	return strconv.ParseUint(fields[19], 10, 64)
+}
+
+// setMemoryRlimit limits the address space of a running process
+func setMemoryRlimit(pid, memoryMB int) {
+	if memoryMB <= 0 {
+		return
+	}
+	limit := &unix.Rlimit{Cur: uint64(memoryMB) << 20, Max: uint64(memoryMB) << 20}
+	if err := unix.Prlimit(pid, unix.RLIMIT_AS, limit, nil); err != nil {
+		slog.Error("Error limiting process memory", "pid", pid, "error", err)
+	}
+}
@@ -0,0 +1,26 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os/exec"
+	"runtime"
+)
+
+// systemLoad is only implemented on Linux
+func systemLoad() (load float64, availableMB int64, err error) {
+	return 0, 0, errors.ErrUnsupported
+}
+
+// confine leaves processes unlimited, since cgroups and setrlimit are
+// only used on Linux
+func confine(cmd *exec.Cmd, name string, l processLimits) (started func(pid int), release func(), err error) {
+	if !l.unlimited() {
+		warnOnce(&limitsWarning, "Process limits are not supported on "+runtime.GOOS+", Chrome and FFmpeg run unlimited")
+	}
+	return func(int) {}, func() {}, nil
+}
+
+// removeCgroup does nothing, since cgroups are only used on Linux
+func removeCgroup(dir string) {}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// maxEndedSessionLogs is how many ended sessions keep their log for
+// GET /sessions/{id}/logs, so a crash can still be looked into
+const maxEndedSessionLogs = 32
+
+// logConfig configures the server log
+type logConfig struct {
+	Format string `yaml:"format"` // json or text
+	Level  string `yaml:"level"`  // debug, info, warn or error
+	// SessionLines is how many records of each session GET /sessions/{id}/logs keeps
+	SessionLines int `yaml:"sessionLines"`
+}
+
+// initLogging makes slog, and the log package through it, write records
+// in the configured format
+func initLogging(c logConfig) {
+	var level slog.Level
+	level.UnmarshalText([]byte(c.Level)) // checked by validate
+	opts := &slog.HandlerOptions{Level: level}
+	var h slog.Handler = slog.NewJSONHandler(os.Stderr, opts)
+	if c.Format == "text" {
+		h = slog.NewTextHandler(os.Stderr, opts)
+	}
+	slog.SetDefault(slog.New(h))
+}
+
+// requestIDKey is the context key of the request ID
+type requestIDKey struct{}
+
+// traceRequests tags each request with an ID, the X-Request-ID of the
+// client or proxy when it sends a usable one, and echoes it in the response
+func traceRequests(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if id == "" || len(id) > 128 {
+			id = uuid.New().String()
+		}
+		w.Header().Set("X-Request-ID", id)
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// requestID returns the ID traceRequests gave a request
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+// requestLog returns a logger tagged with the ID, caller and dataset of a
+// request
+func requestLog(r *http.Request) *slog.Logger {
+	l := slog.Default()
+	if id := requestID(r); id != "" {
+		l = l.With("request", id)
+	}
+	if p := principalFrom(r); p != nil {
+		l = l.With("user", p.Subject)
+	}
+	if name := r.PathValue("name"); name != "" {
+		l = l.With("dataset", name)
+	}
+	return l
+}
+
+// sessionLog keeps the latest log records of a session as JSON
+type sessionLog struct {
+	owner *principal
+
+	mu      sync.Mutex
+	records []json.RawMessage
+	ended   bool
+}
+
+var (
+	sessionLogsMu sync.Mutex
+	sessionLogs   = map[string]*sessionLog{}
+	endedSessions []string // sessions whose log is kept after they ended, oldest first
+)
+
+// Write adds a record; the JSON handler writes each record in one call
+func (l *sessionLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.records = append(l.records, json.RawMessage(bytes.TrimSpace(bytes.Clone(p))))
+	if over := len(l.records) - cfg.Log.SessionLines; over > 0 {
+		l.records = slices.Delete(l.records, 0, over)
+	}
+	return len(p), nil
+}
+
+// newSessionLogger returns the logger of a session. Its records go to the
+// server log, tagged with the session, user and datasets, and at every
+// level to the session's own log.
+func newSessionLogger(session string, owner *principal, datasets []string) *slog.Logger {
+	sl := &sessionLog{owner: owner}
+	sessionLogsMu.Lock()
+	sessionLogs[session] = sl
+	sessionLogsMu.Unlock()
+
+	attrs := []slog.Attr{slog.String("session", session)}
+	if owner != nil {
+		attrs = append(attrs, slog.String("user", owner.Subject))
+	}
+	if len(datasets) > 0 {
+		attrs = append(attrs, slog.Any("dataset", datasets))
+	}
+	own := slog.NewJSONHandler(sl, &slog.HandlerOptions{Level: slog.LevelDebug})
+	return slog.New(teeHandler{slog.Default().Handler(), own}.WithAttrs(attrs))
+}
+
+// retireSessionLog keeps the log of an ended session until
+// maxEndedSessionLogs newer sessions have ended
+func retireSessionLog(session string) {
+	sessionLogsMu.Lock()
+	defer sessionLogsMu.Unlock()
+	sl, ok := sessionLogs[session]
+	if !ok {
+		return
+	}
+	sl.mu.Lock()
+	sl.ended = true
+	sl.mu.Unlock()
+	endedSessions = append(endedSessions, session)
+	if over := len(endedSessions) - maxEndedSessionLogs; over > 0 {
+		for _, id := range endedSessions[:over] {
+			delete(sessionLogs, id)
+		}
+		endedSessions = slices.Delete(endedSessions, 0, over)
+	}
+}
+
+// getSessionLogs handles GET /sessions/{id}/logs, which returns the latest
+// log records of a running or recently ended session
+func getSessionLogs(w http.ResponseWriter, r *http.Request) {
+	sessionLogsMu.Lock()
+	sl, ok := sessionLogs[r.PathValue("id")]
+	sessionLogsMu.Unlock()
+	if !ok {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	if !principalFrom(r).owns(sl.owner) {
+		http.Error(w, "Session belongs to another user", http.StatusForbidden)
+		return
+	}
+
+	sl.mu.Lock()
+	records, ended := slices.Clone(sl.records), sl.ended
+	sl.mu.Unlock()
+	if records == nil {
+		records = []json.RawMessage{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"session": r.PathValue("id"),
+		"ended":   ended,
+		"records": records,
+	})
+}
+
+// teeHandler sends records to two handlers
+type teeHandler struct {
+	a, b slog.Handler
+}
+
+func (t teeHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return t.a.Enabled(ctx, level) || t.b.Enabled(ctx, level)
+}
+
+func (t teeHandler) Handle(ctx context.Context, r slog.Record) error {
+	var errs []error
+	for _, h := range []slog.Handler{t.a, t.b} {
+		if h.Enabled(ctx, r.Level) {
+			errs = append(errs, h.Handle(ctx, r.Clone()))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (t teeHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return teeHandler{t.a.WithAttrs(attrs), t.b.WithAttrs(attrs)}
+}
+
+func (t teeHandler) WithGroup(name string) slog.Handler {
+	return teeHandler{t.a.WithGroup(name), t.b.WithGroup(name)}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"cmp"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	sessionStartSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gis_session_start_seconds",
+		Help:    "Time from /start to each startup stage of a session.",
+		Buckets: []float64{0.5, 1, 2, 3, 5, 8, 13, 20, 30, 60, 120},
+	}, []string{"stage"})
+	encoderFPS = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gis_encoder_fps",
+		Help: "Frames per second FFmpeg encodes, from its -progress output.",
+	}, []string{"session"})
+	encoderBitrate = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gis_encoder_bitrate_bits_per_second",
+		Help: "Output bitrate FFmpeg reports.",
+	}, []string{"session"})
+	encoderSpeed = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gis_encoder_speed_ratio",
+		Help: "Encoding speed relative to real time; below 1 the stream falls behind.",
+	}, []string{"session"})
+	encoderDupFrames = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gis_encoder_duplicated_frames",
+		Help: "Frames FFmpeg duplicated since the session started because the capture fell behind.",
+	}, []string{"session"})
+	encoderDropFrames = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gis_encoder_dropped_frames",
+		Help: "Frames FFmpeg dropped since the session started.",
+	}, []string{"session"})
+	encoderStarts = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "gis_encoder_starts_total",
+		Help: "FFmpeg encoders started.",
+	})
+	encoderCrashes = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "gis_encoder_crashes_total",
+		Help: "FFmpeg encoders that exited without /stop.",
+	})
+	fileBytesServed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gis_file_bytes_served_total",
+		Help: "Bytes of dataset files served from /file/.",
+	}, []string{"dataset"})
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gis_http_request_duration_seconds",
+		Help:    "HTTP request latency by route pattern.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route", "code"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "gis_sessions_active",
+			Help: "Streaming sessions running or starting.",
+		}, func() float64 {
+			mu.Lock()
+			defer mu.Unlock()
+			return float64(len(sessions))
+		}),
+		sessionStartSeconds, encoderFPS, encoderBitrate, encoderSpeed, encoderDupFrames, encoderDropFrames,
+		encoderStarts, encoderCrashes, fileBytesServed, httpDuration,
+	)
+}
+
+// sessionStages maps the session states that mark startup progress to
+// their stage label
+var sessionStages = map[string]string{
+	sessionBrowserLaunched:  "browser_launched",
+	sessionPointCloudLoaded: "pointcloud_loaded",
+	sessionSegmentWritten:   "first_segment",
+}
+
+// observeSessionState records metrics for a session state change
+func observeSessionState(id, state string) {
+	switch state {
+	case sessionEncoderStarted:
+		encoderStarts.Inc()
+	case sessionEncoderCrashed:
+		encoderCrashes.Inc()
+	}
+	if stage, ok := sessionStages[state]; ok {
+		if s, ok := lookupSession(id); ok {
+			sessionStartSeconds.WithLabelValues(stage).Observe(time.Since(s.Started).Seconds())
+		}
+	}
+	if state == sessionStopped || state == sessionEncoderCrashed {
+		encoderFPS.DeleteLabelValues(id)
+		encoderBitrate.DeleteLabelValues(id)
+		encoderSpeed.DeleteLabelValues(id)
+		encoderDupFrames.DeleteLabelValues(id)
+		encoderDropFrames.DeleteLabelValues(id)
+	}
+}
+
+// observeEncoderHealth exports the progress of a session's encoder
+func observeEncoderHealth(session string, h streamHealth) {
+	encoderFPS.WithLabelValues(session).Set(h.FPS)
+	encoderBitrate.WithLabelValues(session).Set(h.BitrateKbps * 1000)
+	encoderSpeed.WithLabelValues(session).Set(h.Speed)
+	encoderDupFrames.WithLabelValues(session).Set(float64(h.DupFrames))
+	encoderDropFrames.WithLabelValues(session).Set(float64(h.DropFrames))
+}
+
+// statusRecorder captures the status and size of a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// Flush keeps Server-Sent Events working through the recorder
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// instrument records the latency of every request by its route pattern; it
+// wraps the mux directly, which sets the pattern on the request
+func instrument(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		began := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		mux.ServeHTTP(rec, r)
+		route := r.Pattern
+		if route == "" {
+			route = "unmatched"
+		}
+		httpDuration.WithLabelValues(r.Method, route, strconv.Itoa(cmp.Or(rec.status, http.StatusOK))).Observe(time.Since(began).Seconds())
+	})
+}
+
+// countFileBytes counts the bytes of successful /file/ responses by dataset
+func countFileBytes(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w}
+		h.ServeHTTP(rec, r)
+		if rec.status < 300 && rec.bytes > 0 {
+			name, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/file/"), "/")
+			fileBytesServed.WithLabelValues(name).Add(float64(rec.bytes))
+		}
+	})
+}
+
+// serveMetrics handles GET /metrics for admins, which is everyone when
+// authentication is off
+func serveMetrics() http.HandlerFunc {
+	h := promhttp.Handler()
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !principalFrom(r).admin {
+			http.Error(w, "Metrics are only available to admins", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	}
+}
@@ -0,0 +1,473 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Node types stored in a Potree 2.0 hierarchy.bin record
+const (
+	nodeTypeNormal = 0
+	nodeTypeLeaf   = 1
+	nodeTypeProxy  = 2
+)
+
+// bytesPerHierarchyNode is the size of one hierarchy.bin record
+const bytesPerHierarchyNode = 22
+
+var errDatasetNotFound = errors.New("dataset not found")
+
+// potreeMetadata mirrors the metadata.json written by PotreeConverter 2.0
+type potreeMetadata struct {
+	Version     string `json:"version"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Points      int64  `json:"points"`
+	Projection  string `json:"projection"`
+	Hierarchy   struct {
+		FirstChunkSize int64 `json:"firstChunkSize"`
+		StepSize       int   `json:"stepSize"`
+		Depth          int   `json:"depth"`
+	} `json:"hierarchy"`
+	Offset      [3]float64 `json:"offset"`
+	Scale       [3]float64 `json:"scale"`
+	Spacing     float64    `json:"spacing"`
+	BoundingBox struct {
+		Min [3]float64 `json:"min"`
+		Max [3]float64 `json:"max"`
+	} `json:"boundingBox"`
+	Encoding   string            `json:"encoding"`
+	Attributes []potreeAttribute `json:"attributes"`
+}
+
+// potreeAttribute describes one interleaved per-point attribute
+type potreeAttribute struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Size        int       `json:"size"`
+	NumElements int       `json:"numElements"`
+	ElementSize int       `json:"elementSize"`
+	Type        string    `json:"type"`
+	Min         []float64 `json:"min"`
+	Max         []float64 `json:"max"`
+	Scale       []float64 `json:"scale,omitempty"`
+	Offset      []float64 `json:"offset,omitempty"`
+	Histogram   []int64   `json:"histogram,omitempty"`
+}
+
+// value decodes element i of the attribute from a record slice starting at the attribute
+func (a *potreeAttribute) value(b []byte, i int) float64 {
+	b = b[i*a.ElementSize:]
+	switch a.Type {
+	case "int8":
+		return float64(int8(b[0]))
+	case "uint8":
+		return float64(b[0])
+	case "int16":
+		return float64(int16(binary.LittleEndian.Uint16(b)))
+	case "uint16":
+		return float64(binary.LittleEndian.Uint16(b))
+	case "int32":
+		return float64(int32(binary.LittleEndian.Uint32(b)))
+	case "uint32":
+		return float64(binary.LittleEndian.Uint32(b))
+	case "int64":
+		return float64(int64(binary.LittleEndian.Uint64(b)))
+	case "uint64":
+		return float64(binary.LittleEndian.Uint64(b))
+	case "float":
+		return float64(math.Float32frombits(binary.LittleEndian.Uint32(b)))
+	case "double":
+		return math.Float64frombits(binary.LittleEndian.Uint64(b))
+	}
+	return 0
+}
+
+// aabb is an axis aligned bounding box
+type aabb struct {
+	Min [3]float64 `json:"min"`
+	Max [3]float64 `json:"max"`
+}
+
+// child returns the bounds of octree child index, using Potree's bit order (x=4, y=2, z=1)
+func (b aabb) child(index int) aabb {
+	c := b
+	for axis, bit := range [3]int{4, 2, 1} {
+		mid := (b.Min[axis] + b.Max[axis]) / 2
+		if index&bit != 0 {
+			c.Min[axis] = mid
+		} else {
+			c.Max[axis] = mid
+		}
+	}
+	return c
+}
+
+func (b aabb) intersects(o aabb) bool {
+	for i := 0; i < 3; i++ {
+		if b.Min[i] > o.Max[i] || b.Max[i] < o.Min[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (b aabb) contains(x, y, z float64) bool {
+	return x >= b.Min[0] && x <= b.Max[0] &&
+		y >= b.Min[1] && y <= b.Max[1] &&
+		z >= b.Min[2] && z <= b.Max[2]
+}
+
+// octreeNode is one node of the Potree hierarchy
+type octreeNode struct {
+	name       string
+	level      int
+	bounds     aabb
+	nodeType   uint8
+	numPoints  uint32
+	byteOffset int64
+	byteSize   int64
+	children   [8]*octreeNode
+
+	hierarchyByteOffset int64
+	hierarchyByteSize   int64
+}
+
+// point holds the standard LAS attributes of a decoded Potree point
+type point struct {
+	X, Y, Z         float64
+	Intensity       uint16
+	ReturnNumber    uint8
+	NumberOfReturns uint8
+	Classification  uint8
+	UserData        uint8
+	ScanAngle       int16
+	PointSourceID   uint16
+	GPSTime         float64
+	R, G, B         uint16
+}
+
+// potreeDataset is an opened Potree 2.0 dataset under data/
+type potreeDataset struct {
+	name       string
+	dir        string
+	meta       potreeMetadata
+	root       *octreeNode
+	pointSize  int
+	attrOffset map[string]int
+}
+
+// datasetDir resolves a dataset name to its directory, rejecting path traversal
+func datasetDir(name string) (string, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return "", fmt.Errorf("invalid dataset name %q", name)
+	}
+	return filepath.Join(cfg.DataDir, name), nil
+}
+
+// openDataset reads metadata.json and the full hierarchy of a dataset
+func openDataset(name string) (*potreeDataset, error) {
+	dir, err := datasetDir(name)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := os.ReadFile(filepath.Join(dir, "metadata.json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errDatasetNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	d := &potreeDataset{name: name, dir: dir, attrOffset: map[string]int{}}
+	if err := json.Unmarshal(raw, &d.meta); err != nil {
+		return nil, fmt.Errorf("parse metadata.json: %w", err)
+	}
+	if !strings.HasPrefix(d.meta.Version, "2.") {
+		return nil, fmt.Errorf("unsupported Potree version %q", d.meta.Version)
+	}
+	if d.meta.Encoding != "" && d.meta.Encoding != "DEFAULT" {
+		return nil, fmt.Errorf("unsupported Potree encoding %q", d.meta.Encoding)
+	}
+
+	for _, a := range d.meta.Attributes {
+		d.attrOffset[a.Name] = d.pointSize
+		d.pointSize += a.Size
+	}
+	if _, ok := d.attrOffset["position"]; !ok {
+		return nil, errors.New("metadata.json has no position attribute")
+	}
+
+	if err := d.loadHierarchy(); err != nil {
+		return nil, fmt.Errorf("load hierarchy: %w", err)
+	}
+	return d, nil
+}
+
+// bounds returns the cubic octree bounds from metadata.json
+func (d *potreeDataset) bounds() aabb {
+	return aabb{Min: d.meta.BoundingBox.Min, Max: d.meta.BoundingBox.Max}
+}
+
+// spacingAt returns the point spacing of an octree level
+func (d *potreeDataset) spacingAt(level int) float64 {
+	return d.meta.Spacing / math.Pow(2, float64(level))
+}
+
+// attribute looks up an attribute definition by name
+func (d *potreeDataset) attribute(name string) (*potreeAttribute, int, bool) {
+	for i := range d.meta.Attributes {
+		if d.meta.Attributes[i].Name == name {
+			return &d.meta.Attributes[i], d.attrOffset[name], true
+		}
+	}
+	return nil, 0, false
+}
+
+// loadHierarchy parses hierarchy.bin, resolving every proxy chunk eagerly
+func (d *potreeDataset) loadHierarchy() error {
+	f, err := os.Open(filepath.Join(d.dir, "hierarchy.bin"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	d.root = &octreeNode{
+		name:              "r",
+		bounds:            d.bounds(),
+		nodeType:          nodeTypeProxy,
+		hierarchyByteSize: d.meta.Hierarchy.FirstChunkSize,
+	}
+
+	pending := []*octreeNode{d.root}
+	for len(pending) > 0 {
+		n := pending[0]
+		pending = pending[1:]
+
+		buf := make([]byte, n.hierarchyByteSize)
+		if _, err := f.ReadAt(buf, n.hierarchyByteOffset); err != nil {
+			return fmt.Errorf("read chunk of %s: %w", n.name, err)
+		}
+		proxies, err := parseHierarchyChunk(n, buf)
+		if err != nil {
+			return err
+		}
+		pending = append(pending, proxies...)
+	}
+	return nil
+}
+
+// parseHierarchyChunk decodes one chunk in breadth first order, the same way
+// Potree's OctreeLoader does, and returns the proxy nodes it still references
+func parseHierarchyChunk(first *octreeNode, buf []byte) ([]*octreeNode, error) {
+	numNodes := len(buf) / bytesPerHierarchyNode
+	nodes := make([]*octreeNode, 1, numNodes)
+	nodes[0] = first
+
+	var proxies []*octreeNode
+	for i := 0; i < numNodes; i++ {
+		if i >= len(nodes) {
+			return nil, fmt.Errorf("hierarchy chunk of %s has more records than nodes", first.name)
+		}
+		current := nodes[i]
+		rec := buf[i*bytesPerHierarchyNode:]
+
+		nodeType := rec[0]
+		childMask := rec[1]
+		numPoints := binary.LittleEndian.Uint32(rec[2:])
+		byteOffset := int64(binary.LittleEndian.Uint64(rec[6:]))
+		byteSize := int64(binary.LittleEndian.Uint64(rec[14:]))
+
+		current.numPoints = numPoints
+		if nodeType == nodeTypeProxy {
+			current.nodeType = nodeTypeProxy
+			current.hierarchyByteOffset = byteOffset
+			current.hierarchyByteSize = byteSize
+			proxies = append(proxies, current)
+			continue
+		}
+
+		current.nodeType = nodeType
+		current.byteOffset = byteOffset
+		current.byteSize = byteSize
+
+		for childIndex := 0; childIndex < 8; childIndex++ {
+			if childMask&(1<<childIndex) == 0 {
+				continue
+			}
+			child := &octreeNode{
+				name:   current.name + strconv.Itoa(childIndex),
+				level:  current.level + 1,
+				bounds: current.bounds.child(childIndex),
+			}
+			current.children[childIndex] = child
+			nodes = append(nodes, child)
+		}
+	}
+	return proxies, nil
+}
+
+// walk visits nodes depth first; returning false from visit skips the subtree
+func (n *octreeNode) walk(visit func(*octreeNode) bool) {
+	if !visit(n) {
+		return
+	}
+	for _, c := range n.children {
+		if c != nil {
+			c.walk(visit)
+		}
+	}
+}
+
+// nodes returns all nodes up to maxLevel (negative for all levels) whose
+// bounds intersect the filter box
+func (d *potreeDataset) nodes(maxLevel int, filter *aabb) []*octreeNode {
+	var out []*octreeNode
+	d.root.walk(func(n *octreeNode) bool {
+		if maxLevel >= 0 && n.level > maxLevel {
+			return false
+		}
+		if filter != nil && !n.bounds.intersects(*filter) {
+			return false
+		}
+		if n.numPoints > 0 {
+			out = append(out, n)
+		}
+		return true
+	})
+	return out
+}
+
+// octreeReader reads node payloads from octree.bin
+type octreeReader struct {
+	d *potreeDataset
+	f *os.File
+}
+
+func (d *potreeDataset) openOctree() (*octreeReader, error) {
+	f, err := os.Open(filepath.Join(d.dir, "octree.bin"))
+	if err != nil {
+		return nil, err
+	}
+	return &octreeReader{d: d, f: f}, nil
+}
+
+func (r *octreeReader) Close() error {
+	return r.f.Close()
+}
+
+// readNode returns the raw interleaved point records of a node
+func (r *octreeReader) readNode(n *octreeNode) ([]byte, error) {
+	buf := make([]byte, n.byteSize)
+	if _, err := r.f.ReadAt(buf, n.byteOffset); err != nil {
+		return nil, fmt.Errorf("read node %s: %w", n.name, err)
+	}
+	if int64(n.numPoints)*int64(r.d.pointSize) > n.byteSize {
+		return nil, fmt.Errorf("node %s is truncated", n.name)
+	}
+	return buf, nil
+}
+
+// forEachPoint decodes every point of a node
+func (r *octreeReader) forEachPoint(n *octreeNode, fn func(p *point, rec []byte) error) error {
+	buf, err := r.readNode(n)
+	if err != nil {
+		return err
+	}
+	dec := r.d.decoder()
+	var p point
+	for i := 0; i < int(n.numPoints); i++ {
+		rec := buf[i*r.d.pointSize : (i+1)*r.d.pointSize]
+		dec.decode(rec, &p)
+		if err := fn(&p, rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pointDecoder maps record bytes to point fields using the dataset's attribute layout
+type pointDecoder struct {
+	d      *potreeDataset
+	fields []decodedField
+}
+
+type decodedField struct {
+	attr   *potreeAttribute
+	offset int
+	set    func(p *point, a *potreeAttribute, b []byte)
+}
+
+func (d *potreeDataset) decoder() *pointDecoder {
+	setters := map[string]func(p *point, a *potreeAttribute, b []byte){
+		"intensity":         func(p *point, a *potreeAttribute, b []byte) { p.Intensity = uint16(a.value(b, 0)) },
+		"return number":     func(p *point, a *potreeAttribute, b []byte) { p.ReturnNumber = uint8(a.value(b, 0)) },
+		"number of returns": func(p *point, a *potreeAttribute, b []byte) { p.NumberOfReturns = uint8(a.value(b, 0)) },
+		"classification":    func(p *point, a *potreeAttribute, b []byte) { p.Classification = uint8(a.value(b, 0)) },
+		"user data":         func(p *point, a *potreeAttribute, b []byte) { p.UserData = uint8(a.value(b, 0)) },
+		"scan angle":        func(p *point, a *potreeAttribute, b []byte) { p.ScanAngle = int16(a.value(b, 0)) },
+		"point source id":   func(p *point, a *potreeAttribute, b []byte) { p.PointSourceID = uint16(a.value(b, 0)) },
+		"gps-time":          func(p *point, a *potreeAttribute, b []byte) { p.GPSTime = a.value(b, 0) },
+		"rgb": func(p *point, a *potreeAttribute, b []byte) {
+			p.R, p.G, p.B = uint16(a.value(b, 0)), uint16(a.value(b, 1)), uint16(a.value(b, 2))
+		},
+	}
+
+	dec := &pointDecoder{d: d}
+	for i := range d.meta.Attributes {
+		a := &d.meta.Attributes[i]
+		if set, ok := setters[a.Name]; ok {
+			dec.fields = append(dec.fields, decodedField{attr: a, offset: d.attrOffset[a.Name], set: set})
+		}
+	}
+	return dec
+}
+
+func (dec *pointDecoder) decode(rec []byte, p *point) {
+	*p = point{}
+	pos := rec[dec.d.attrOffset["position"]:]
+	m := &dec.d.meta
+	p.X = float64(int32(binary.LittleEndian.Uint32(pos[0:])))*m.Scale[0] + m.Offset[0]
+	p.Y = float64(int32(binary.LittleEndian.Uint32(pos[4:])))*m.Scale[1] + m.Offset[1]
+	p.Z = float64(int32(binary.LittleEndian.Uint32(pos[8:])))*m.Scale[2] + m.Offset[2]
+	for _, f := range dec.fields {
+		f.set(p, f.attr, rec[f.offset:])
+	}
+}
+
+// forEachPointIn streams every point inside the region, up to maxLevel
+// (negative for full resolution), checking ctx between nodes
+func (d *potreeDataset) forEachPointIn(ctx context.Context, reg *region, maxLevel int, fn func(p *point) error) error {
+	octree, err := d.openOctree()
+	if err != nil {
+		return err
+	}
+	defer octree.Close()
+
+	nodes := d.nodes(maxLevel, &reg.bounds)
+	for i, n := range nodes {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		reportProgress(ctx, i, len(nodes))
+		err := octree.forEachPoint(n, func(p *point, _ []byte) error {
+			if !reg.contains(p.X, p.Y, p.Z) {
+				return nil
+			}
+			return fn(p)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
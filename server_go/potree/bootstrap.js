@@ -1,88 +1,164 @@
-document.addEventListener("DOMContentLoaded", function () {
-  // Declare Potree viewer globally as required by Potree
-  const viewer = window.viewer;
-
-  // Get the file path for the point cloud from the query parameters
-  function getQueryParameter(name) {
-    const urlParams = new URLSearchParams(window.location.search);
-    return urlParams.get(name);
-  }
-
-  // Get the point cloud file URL from the query parameters
-  const pointcloudURL = getQueryParameter("pointcloudURL");
-  const pointcloudTitle = "Viewer"; // Optional: another query parameter can be used for this
-  const fitToScreen = true; // Optional: can also be passed as a query parameter if needed
-
-  if (viewer) {
-    // Apply basic viewer configuration
-    useBasicViewerConfig(viewer);
-
-    if (pointcloudURL) {
-      // Load the point cloud file into the viewer
-      useLoadPointcloud(viewer, pointcloudURL, pointcloudTitle, fitToScreen);
-      document.getElementById("potree_render_area").onload = () => {
-        const canvas = document
-          .getElementById("potree_render_area")
-          .querySelectorAll("canvas")[1];
-        canvas.onload = () => {
-          canvas.height = 1980;
-          canvas.width = 1080;
-          canvas.style.height = "1980px";
-          canvas.style.width = "1080px";
-        };
-      };
-    } else {
-      console.error("No pointcloud URL provided in the query parameters.");
-    }
-  } else {
-    console.error("Viewer initialization failed.");
-  }
-
-  // Function to configure the basic Potree viewer settings
-  function useBasicViewerConfig(viewer) {
-    viewer.setEDLEnabled(true);
-    viewer.setFOV(60);
-    viewer.setPointBudget(1_000_000);
-    viewer.loadSettingsFromURL();
-    viewer.setBackground("gradient");
-    viewer.setDescription("Potree component");
-
-    const controls = new Potree.EarthControls(viewer);
-    viewer.setControls(controls);
-
-    viewer.loadGUI(() => {
-      viewer.setLanguage("en");
-      console.log("Viewer GUI loaded and configured.");
-    });
-
-    console.log("Basic Potree viewer configuration applied.");
-  }
-
-  // Function to load the point cloud into the viewer
-  function useLoadPointcloud(
-    viewer,
-    pointcloudURL,
-    pointcloudTitle,
-    fitToScreen = false
-  ) {
-    Potree.loadPointCloud(pointcloudURL, pointcloudTitle, (e) => {
-      const scene = viewer.scene;
-      const pointcloud = e.pointcloud;
-
-      const material = pointcloud.material;
-      material.size = 1;
-      material.pointSizeType = Potree.PointSizeType.FIXED;
-      material.shape = Potree.PointShape.CIRCLE;
-
-      scene.addPointCloud(pointcloud);
-
-      if (fitToScreen) {
-        viewer.fitToScreen();
-      }
-
-      console.log(
-        `Point cloud '${pointcloudTitle}' loaded from ${pointcloudURL}`
-      );
-    });
-  }
-});
+document.addEventListener("DOMContentLoaded", function () {
+  // Declare Potree viewer globally as required by Potree
+  const viewer = window.viewer;
+
+  // Report point cloud load failures to the server, which polls
+  // pointcloudError. Other script errors only reach the session log through
+  // the console capture and do not fail the stream.
+  function reportLoadError(message) {
+    if (!window.pointcloudsLoaded && !window.pointcloudError) {
+      window.pointcloudError = message;
+    }
+  }
+  // Potree's loaders do not reject, they log this message when a cloud fails
+  const consoleError = console.error.bind(console);
+  console.error = (...args) => {
+    const text = args.map(String).join(" ");
+    if (text.includes("failed to load point cloud")) {
+      reportLoadError(text);
+    }
+    consoleError(...args);
+  };
+
+  // Get the file path for the point cloud from the query parameters
+  function getQueryParameter(name) {
+    const urlParams = new URLSearchParams(window.location.search);
+    return urlParams.get(name);
+  }
+
+  // Get the point clouds from the query parameters: "clouds" is a JSON list
+  // of {url, title, visible, colorMode, transform, elevationRange} built by
+  // the server, "pointcloudURL" (with "elevationRange") loads a single cloud
+  const pointclouds = getPointclouds();
+  // Optional: "px,py,pz,tx,ty,tz" camera position and target in dataset coordinates
+  const camera = getQueryParameter("camera");
+  const fitToScreen = !camera;
+
+  if (viewer) {
+    // Apply basic viewer configuration
+    useBasicViewerConfig(viewer);
+
+    if (pointclouds.length > 0) {
+      // Load every point cloud into the same scene
+      useLoadPointclouds(viewer, pointclouds, fitToScreen);
+      document.getElementById("potree_render_area").onload = () => {
+        const canvas = document
+          .getElementById("potree_render_area")
+          .querySelectorAll("canvas")[1];
+        canvas.onload = () => {
+          canvas.height = 1980;
+          canvas.width = 1080;
+          canvas.style.height = "1980px";
+          canvas.style.width = "1080px";
+        };
+      };
+    } else {
+      console.error("No pointcloud URL provided in the query parameters.");
+      reportLoadError("No pointcloud URL provided in the query parameters.");
+    }
+  } else {
+    console.error("Viewer initialization failed.");
+    reportLoadError("Viewer initialization failed.");
+  }
+
+  function getPointclouds() {
+    const clouds = getQueryParameter("clouds");
+    if (clouds) {
+      return JSON.parse(clouds);
+    }
+    const url = getQueryParameter("pointcloudURL");
+    if (!url) {
+      return [];
+    }
+    const elevationRange = getQueryParameter("elevationRange");
+    return [
+      {
+        url,
+        title: "Viewer",
+        elevationRange: elevationRange
+          ? elevationRange.split(",").map(Number)
+          : undefined,
+      },
+    ];
+  }
+
+  // Function to configure the basic Potree viewer settings
+  function useBasicViewerConfig(viewer) {
+    viewer.setEDLEnabled(true);
+    viewer.setFOV(60);
+    viewer.setPointBudget(1_000_000);
+    viewer.loadSettingsFromURL();
+    viewer.setBackground("gradient");
+    viewer.setDescription("Potree component");
+
+    const controls = new Potree.EarthControls(viewer);
+    viewer.setControls(controls);
+
+    viewer.loadGUI(() => {
+      viewer.setLanguage("en");
+      console.log("Viewer GUI loaded and configured.");
+    });
+
+    console.log("Basic Potree viewer configuration applied.");
+  }
+
+  // Function to load the point clouds into the viewer, framing the scene
+  // once all of them are loaded
+  function useLoadPointclouds(viewer, pointclouds, fitToScreen = false) {
+    let remaining = pointclouds.length;
+
+    pointclouds.forEach((cloud) => {
+      const loading = Potree.loadPointCloud(cloud.url, cloud.title, (e) => {
+        const scene = viewer.scene;
+        const pointcloud = e.pointcloud;
+
+        const material = pointcloud.material;
+        material.size = 1;
+        material.pointSizeType = Potree.PointSizeType.FIXED;
+        material.shape = Potree.PointShape.CIRCLE;
+        if (cloud.elevationRange) {
+          material.elevationRange = cloud.elevationRange;
+        }
+        if (cloud.colorMode) {
+          material.activeAttributeName = cloud.colorMode;
+        }
+        pointcloud.visible = cloud.visible !== false;
+
+        const transform = cloud.transform;
+        if (transform) {
+          const toRadians = (degrees) => (degrees * Math.PI) / 180;
+          if (transform.scale) {
+            pointcloud.scale.set(...transform.scale);
+          }
+          pointcloud.rotation.set(...transform.rotation.map(toRadians));
+          // Potree positions clouds at their bounding box, so translate relative to it
+          const [dx, dy, dz] = transform.translation;
+          pointcloud.position.x += dx;
+          pointcloud.position.y += dy;
+          pointcloud.position.z += dz;
+          pointcloud.updateMatrixWorld(true);
+        }
+
+        scene.addPointCloud(pointcloud);
+        console.log(`Point cloud '${cloud.title}' loaded from ${cloud.url}`);
+
+        remaining--;
+        if (remaining > 0) {
+          return;
+        }
+        if (fitToScreen) {
+          viewer.fitToScreen();
+        } else if (camera) {
+          const [px, py, pz, tx, ty, tz] = camera.split(",").map(Number);
+          scene.view.position.set(px, py, pz);
+          scene.view.lookAt(tx, ty, tz);
+        }
+        // polled by the server to report that the scene is ready
+        window.pointcloudsLoaded = true;
+      });
+      Promise.resolve(loading).catch((err) =>
+        reportLoadError(`failed to load point cloud ${cloud.url}: ${err}`),
+      );
+    });
+  }
+});
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testdata/tiny is a Potree 2.0 dataset of 5 points in an 8 m cube with two
+// hierarchy chunks: r, r0 and the proxy r7 in the first, r7 and r71 in the
+// second. Points are position (int32, scale 0.01), intensity and
+// classification, 15 bytes each.
+
+// withDataDir serves datasets from dir until the test ends
+func withDataDir(t *testing.T, dir string) {
+	old := cfg.DataDir
+	cfg.DataDir = dir
+	t.Cleanup(func() { cfg.DataDir = old })
+}
+
+// writeTiny copies testdata/tiny into the data directory as name
+func writeTiny(t *testing.T, name string) {
+	t.Helper()
+	dir := filepath.Join(cfg.DataDir, name)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{"metadata.json", "hierarchy.bin", "octree.bin"} {
+		raw, err := os.ReadFile(filepath.Join("testdata", "tiny", f))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, f), raw, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestParseHierarchyChunk(t *testing.T) {
+	raw, err := os.ReadFile(filepath.Join("testdata", "tiny", "hierarchy.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := &octreeNode{name: "r", bounds: aabb{Max: [3]float64{8, 8, 8}}}
+	proxies, err := parseHierarchyChunk(root, raw[:66])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r0, r7 := root.children[0], root.children[7]
+	if r0 == nil || r7 == nil {
+		t.Fatalf("children = %v, want r0 and r7", root.children)
+	}
+	for i, c := range root.children {
+		if c != nil && i != 0 && i != 7 {
+			t.Errorf("unexpected child %s", c.name)
+		}
+	}
+	tests := []struct {
+		n                    *octreeNode
+		name                 string
+		level                int
+		nodeType             uint8
+		numPoints            uint32
+		byteOffset, byteSize int64
+		bounds               aabb
+	}{
+		{root, "r", 0, nodeTypeNormal, 2, 0, 30, aabb{Max: [3]float64{8, 8, 8}}},
+		{r0, "r0", 1, nodeTypeLeaf, 1, 30, 15, aabb{Max: [3]float64{4, 4, 4}}},
+		{r7, "r7", 1, nodeTypeProxy, 1, 0, 0, aabb{Min: [3]float64{4, 4, 4}, Max: [3]float64{8, 8, 8}}},
+	}
+	for _, tt := range tests {
+		n := tt.n
+		if n.name != tt.name || n.level != tt.level || n.nodeType != tt.nodeType || n.numPoints != tt.numPoints ||
+			n.byteOffset != tt.byteOffset || n.byteSize != tt.byteSize || n.bounds != tt.bounds {
+			t.Errorf("node %s = %+v, want %+v", tt.name, *n, tt)
+		}
+	}
+	if len(proxies) != 1 || proxies[0] != r7 {
+		t.Fatalf("proxies = %v, want r7", proxies)
+	}
+	if r7.hierarchyByteOffset != 66 || r7.hierarchyByteSize != 44 {
+		t.Errorf("r7 chunk at %d+%d, want 66+44", r7.hierarchyByteOffset, r7.hierarchyByteSize)
+	}
+
+	// a chunk whose masks reference fewer nodes than it has records
+	bad := append([]byte{}, raw[:66]...)
+	bad[1] = 0x01 // r only has r0
+	if _, err := parseHierarchyChunk(&octreeNode{name: "r"}, bad); err == nil {
+		t.Error("chunk with extra records was accepted")
+	}
+}
+
+func TestOpenDataset(t *testing.T) {
+	withDataDir(t, "testdata")
+	d, err := openDataset("tiny")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, n := range d.nodes(-1, nil) {
+		names = append(names, n.name)
+	}
+	if got := strings.Join(names, " "); got != "r r0 r7 r71" {
+		t.Errorf("nodes = %v, want r r0 r7 r71", names)
+	}
+	r71 := d.root.children[7].children[1]
+	if r71 == nil || r71.level != 2 || r71.byteOffset != 60 || r71.bounds != (aabb{Min: [3]float64{4, 4, 6}, Max: [3]float64{6, 6, 8}}) {
+		t.Errorf("r71 = %+v", r71)
+	}
+	if n := d.nodes(1, nil); len(n) != 3 {
+		t.Errorf("%d nodes up to level 1, want 3", len(n))
+	}
+
+	reg, _ := newRegion(&aabb{Min: [3]float64{4, 4, 4}, Max: [3]float64{8, 8, 8}}, nil, nil, d.bounds())
+	var got []point
+	err = d.forEachPointIn(context.Background(), reg, -1, func(p *point) error {
+		got = append(got, *p)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []point{
+		{X: 7, Y: 7, Z: 7, Intensity: 200, Classification: 2},
+		{X: 6, Y: 6, Z: 6, Intensity: 400, Classification: 6},
+		{X: 5, Y: 5, Z: 7, Intensity: 500, Classification: 6},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("points = %+v, want %+v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("point %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+
+	for _, name := range []string{"", "..", "a/b", "missing"} {
+		if _, err := openDataset(name); err == nil {
+			t.Errorf("openDataset(%q) succeeded", name)
+		}
+	}
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+var errDatasetExists = errors.New("dataset already exists")
+
+// potreeWriter creates a Potree 2.0 dataset under data/ node by node. Output
+// goes to a hidden staging directory that is renamed into place on close.
+type potreeWriter struct {
+	name    string
+	dir     string
+	staging string
+	meta    potreeMetadata
+	root    *octreeNode
+	octree  *os.File
+	offset  int64
+
+	pointSize int
+	offsets   []int
+	min, max  [][]float64 // per attribute and element
+}
+
+// createDataset starts a new dataset. meta must provide the bounding box,
+// scale, offset, spacing and attributes; counts and hierarchy are filled in.
+func createDataset(name string, meta potreeMetadata) (*potreeWriter, error) {
+	dir, err := datasetDir(name)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(dir); err == nil {
+		return nil, errDatasetExists
+	}
+	if err := os.MkdirAll(cfg.DataDir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	staging, err := os.MkdirTemp(cfg.DataDir, "."+name+"-")
+	if err != nil {
+		return nil, err
+	}
+	octree, err := os.Create(filepath.Join(staging, "octree.bin"))
+	if err != nil {
+		os.RemoveAll(staging)
+		return nil, err
+	}
+
+	meta.Version = "2.0"
+	meta.Encoding = "DEFAULT"
+	if meta.Name == "" {
+		meta.Name = name
+	}
+	w := &potreeWriter{
+		name:    name,
+		dir:     dir,
+		staging: staging,
+		meta:    meta,
+		octree:  octree,
+		root:    &octreeNode{name: "r", bounds: aabb{Min: meta.BoundingBox.Min, Max: meta.BoundingBox.Max}},
+	}
+	for _, a := range meta.Attributes {
+		w.offsets = append(w.offsets, w.pointSize)
+		w.pointSize += a.Size
+		lo, hi := make([]float64, a.NumElements), make([]float64, a.NumElements)
+		for e := range lo {
+			lo[e], hi[e] = math.Inf(1), math.Inf(-1)
+		}
+		w.min, w.max = append(w.min, lo), append(w.max, hi)
+	}
+	return w, nil
+}
+
+// node returns the node with a Potree name such as "r042", creating it and its parents
+func (w *potreeWriter) node(name string) *octreeNode {
+	n := w.root
+	for _, c := range name[1:] {
+		i := int(c - '0')
+		if n.children[i] == nil {
+			n.children[i] = &octreeNode{
+				name:   n.name + strconv.Itoa(i),
+				level:  n.level + 1,
+				bounds: n.bounds.child(i),
+			}
+		}
+		n = n.children[i]
+	}
+	return n
+}
+
+// writeNode appends the interleaved records of a node to octree.bin
+func (w *potreeWriter) writeNode(name string, records []byte) error {
+	if len(records)%w.pointSize != 0 {
+		return fmt.Errorf("node %s: %d bytes is not a multiple of the point size %d", name, len(records), w.pointSize)
+	}
+	n := w.node(name)
+	if n.numPoints > 0 {
+		return fmt.Errorf("node %s written twice", name)
+	}
+	if _, err := w.octree.Write(records); err != nil {
+		return err
+	}
+	n.numPoints = uint32(len(records) / w.pointSize)
+	n.byteOffset = w.offset
+	n.byteSize = int64(len(records))
+	w.offset += n.byteSize
+	w.meta.Points += int64(n.numPoints)
+
+	for i := range w.meta.Attributes {
+		a := &w.meta.Attributes[i]
+		for r := w.offsets[i]; r < len(records); r += w.pointSize {
+			for e := 0; e < a.NumElements; e++ {
+				v := a.value(records[r:], e)
+				if math.IsNaN(v) {
+					continue
+				}
+				if a.Name == "position" {
+					v = v*w.meta.Scale[e] + w.meta.Offset[e]
+				}
+				w.min[i][e] = math.Min(w.min[i][e], v)
+				w.max[i][e] = math.Max(w.max[i][e], v)
+			}
+		}
+	}
+	return nil
+}
+
+// close writes hierarchy.bin as a single breadth first chunk and
+// metadata.json, then moves the dataset into data/
+func (w *potreeWriter) close() error {
+	if err := w.octree.Close(); err != nil {
+		w.abort()
+		return err
+	}
+
+	var nodes []*octreeNode
+	depth := 0
+	queue := []*octreeNode{w.root}
+	for len(queue) > 0 {
+		n := queue[0]
+		queue = queue[1:]
+		nodes = append(nodes, n)
+		depth = max(depth, n.level)
+		for _, c := range n.children {
+			if c != nil {
+				queue = append(queue, c)
+			}
+		}
+	}
+
+	hierarchy := make([]byte, len(nodes)*bytesPerHierarchyNode)
+	for i, n := range nodes {
+		rec := hierarchy[i*bytesPerHierarchyNode:]
+		var childMask uint8
+		for c, child := range n.children {
+			if child != nil {
+				childMask |= 1 << c
+			}
+		}
+		rec[0] = nodeTypeNormal
+		if childMask == 0 {
+			rec[0] = nodeTypeLeaf
+		}
+		rec[1] = childMask
+		binary.LittleEndian.PutUint32(rec[2:], n.numPoints)
+		binary.LittleEndian.PutUint64(rec[6:], uint64(n.byteOffset))
+		binary.LittleEndian.PutUint64(rec[14:], uint64(n.byteSize))
+	}
+	if err := os.WriteFile(filepath.Join(w.staging, "hierarchy.bin"), hierarchy, 0o644); err != nil {
+		w.abort()
+		return err
+	}
+
+	w.meta.Hierarchy.FirstChunkSize = int64(len(hierarchy))
+	w.meta.Hierarchy.StepSize = 4
+	w.meta.Hierarchy.Depth = depth
+	for i := range w.meta.Attributes {
+		a := &w.meta.Attributes[i]
+		a.Min, a.Max = w.min[i], w.max[i]
+		if w.meta.Points == 0 {
+			a.Min, a.Max = make([]float64, a.NumElements), make([]float64, a.NumElements)
+		}
+	}
+	raw, err := json.MarshalIndent(w.meta, "", "\t")
+	if err != nil {
+		w.abort()
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(w.staging, "metadata.json"), raw, 0o644); err != nil {
+		w.abort()
+		return err
+	}
+	if err := os.Rename(w.staging, w.dir); err != nil {
+		w.abort()
+		return err
+	}
+	return nil
+}
+
+// abort discards everything written so far
+func (w *potreeWriter) abort() {
+	w.octree.Close()
+	os.RemoveAll(w.staging)
+}
+
+// deriveDataset writes a copy of src with the same octree as a new dataset.
+// Attributes in extra are appended to every record, or replace a source
+// attribute of the same name and type. fill receives each node's decoded
+// points and new records and may change any attribute; offsets gives the
+// record offset of each extra attribute.
+func deriveDataset(ctx context.Context, src *potreeDataset, output, description string, extra []potreeAttribute,
+	fill func(n *octreeNode, pts []point, records [][]byte, offsets map[string]int) error) error {
+	meta := src.meta
+	meta.Name = output
+	meta.Description = description
+	meta.Points = 0
+	meta.Attributes = append([]potreeAttribute(nil), src.meta.Attributes...)
+	for _, a := range extra {
+		replaced := false
+		for i, existing := range meta.Attributes {
+			if existing.Name == a.Name && existing.Type == a.Type && existing.Size == a.Size {
+				meta.Attributes[i] = a
+				replaced = true
+			}
+		}
+		if !replaced {
+			meta.Attributes = append(meta.Attributes, a)
+		}
+	}
+
+	w, err := createDataset(output, meta)
+	if err != nil {
+		return err
+	}
+	offsets := map[string]int{}
+	for _, a := range extra {
+		for i, existing := range w.meta.Attributes {
+			if existing.Name == a.Name {
+				offsets[a.Name] = w.offsets[i]
+			}
+		}
+	}
+
+	octree, err := src.openOctree()
+	if err != nil {
+		w.abort()
+		return err
+	}
+	defer octree.Close()
+
+	dec := src.decoder()
+	nodes := src.nodes(-1, nil)
+	for i, n := range nodes {
+		if err := ctx.Err(); err != nil {
+			w.abort()
+			return err
+		}
+		reportProgress(ctx, i, len(nodes))
+		buf, err := octree.readNode(n)
+		if err != nil {
+			w.abort()
+			return err
+		}
+		pts := make([]point, n.numPoints)
+		out := make([]byte, int(n.numPoints)*w.pointSize)
+		records := make([][]byte, n.numPoints)
+		for i := range pts {
+			rec := buf[i*src.pointSize : (i+1)*src.pointSize]
+			dec.decode(rec, &pts[i])
+			records[i] = out[i*w.pointSize : (i+1)*w.pointSize]
+			copy(records[i], rec) // appended attributes stay zero
+		}
+		if err := fill(n, pts, records, offsets); err != nil {
+			w.abort()
+			return fmt.Errorf("node %s: %w", n.name, err)
+		}
+		if err := w.writeNode(n.name, out); err != nil {
+			w.abort()
+			return err
+		}
+	}
+	return w.close()
+}
+
+// putValue encodes v as element i of an attribute, the inverse of potreeAttribute.value
+func (a *potreeAttribute) putValue(b []byte, i int, v float64) {
+	b = b[i*a.ElementSize:]
+	le := binary.LittleEndian
+	switch a.Type {
+	case "int8":
+		b[0] = byte(int8(math.Round(v)))
+	case "uint8":
+		b[0] = byte(math.Round(v))
+	case "int16":
+		le.PutUint16(b, uint16(int16(math.Round(v))))
+	case "uint16":
+		le.PutUint16(b, uint16(math.Round(v)))
+	case "int32":
+		le.PutUint32(b, uint32(int32(math.Round(v))))
+	case "uint32":
+		le.PutUint32(b, uint32(math.Round(v)))
+	case "int64":
+		le.PutUint64(b, uint64(int64(math.Round(v))))
+	case "uint64":
+		le.PutUint64(b, uint64(math.Round(v)))
+	case "float":
+		le.PutUint32(b, math.Float32bits(float32(v)))
+	case "double":
+		le.PutUint64(b, math.Float64bits(v))
+	}
+}
+
+// newAttribute describes an attribute of numElements values of a Potree type
+func newAttribute(name, typ string, numElements int) potreeAttribute {
+	size := map[string]int{
+		"int8": 1, "uint8": 1, "int16": 2, "uint16": 2, "int32": 4, "uint32": 4,
+		"int64": 8, "uint64": 8, "float": 4, "double": 8,
+	}[typ]
+	return potreeAttribute{Name: name, Type: typ, NumElements: numElements, ElementSize: size, Size: size * numElements}
+}
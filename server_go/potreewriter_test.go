@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// copyTiny writes the nodes of testdata/tiny as a new dataset under a
+// temporary data directory and returns both datasets
+func copyTiny(t *testing.T) (src, dst *potreeDataset) {
+	t.Helper()
+	withDataDir(t, "testdata")
+	src, err := openDataset("tiny")
+	if err != nil {
+		t.Fatal(err)
+	}
+	withDataDir(t, t.TempDir())
+
+	meta := src.meta
+	meta.Name = ""
+	meta.Points = 0
+	w, err := createDataset("copy", meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	octree, err := src.openOctree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer octree.Close()
+	for _, n := range src.nodes(-1, nil) {
+		buf, err := octree.readNode(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := w.writeNode(n.name, buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.close(); err != nil {
+		t.Fatal(err)
+	}
+	dst, err = openDataset("copy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return src, dst
+}
+
+func TestPotreeWriterRoundTrip(t *testing.T) {
+	src, dst := copyTiny(t)
+
+	// one breadth first chunk: r, r0, r7, r71
+	hierarchy, err := os.ReadFile(filepath.Join(dst.dir, "hierarchy.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	golden := []struct {
+		nodeType, childMask uint8
+		numPoints           uint32
+		byteOffset          uint64
+		byteSize            uint64
+	}{
+		{nodeTypeNormal, 0x81, 2, 0, 30},
+		{nodeTypeLeaf, 0, 1, 30, 15},
+		{nodeTypeNormal, 0x02, 1, 45, 15},
+		{nodeTypeLeaf, 0, 1, 60, 15},
+	}
+	if len(hierarchy) != len(golden)*bytesPerHierarchyNode {
+		t.Fatalf("hierarchy.bin is %d bytes, want %d", len(hierarchy), len(golden)*bytesPerHierarchyNode)
+	}
+	le := binary.LittleEndian
+	for i, g := range golden {
+		rec := hierarchy[i*bytesPerHierarchyNode:]
+		if rec[0] != g.nodeType || rec[1] != g.childMask || le.Uint32(rec[2:]) != g.numPoints ||
+			le.Uint64(rec[6:]) != g.byteOffset || le.Uint64(rec[14:]) != g.byteSize {
+			t.Errorf("hierarchy record %d = % x, want %+v", i, rec[:bytesPerHierarchyNode], g)
+		}
+	}
+
+	if dst.meta.Name != "copy" || dst.meta.Version != "2.0" || dst.meta.Points != 5 {
+		t.Errorf("metadata name %q version %q points %d", dst.meta.Name, dst.meta.Version, dst.meta.Points)
+	}
+	if h := dst.meta.Hierarchy; h.FirstChunkSize != int64(len(hierarchy)) || h.Depth != 2 {
+		t.Errorf("hierarchy metadata = %+v", h)
+	}
+	for i, a := range dst.meta.Attributes {
+		want := src.meta.Attributes[i]
+		if a.Name != want.Name || !slices.Equal(a.Min, want.Min) || !slices.Equal(a.Max, want.Max) {
+			t.Errorf("attribute %s spans %v-%v, want %v-%v", a.Name, a.Min, a.Max, want.Min, want.Max)
+		}
+	}
+
+	srcNodes, dstNodes := src.nodes(-1, nil), dst.nodes(-1, nil)
+	if len(dstNodes) != len(srcNodes) {
+		t.Fatalf("%d nodes, want %d", len(dstNodes), len(srcNodes))
+	}
+	for i, n := range dstNodes {
+		s := srcNodes[i]
+		if n.name != s.name || n.level != s.level || n.bounds != s.bounds || n.numPoints != s.numPoints ||
+			n.byteOffset != s.byteOffset || n.byteSize != s.byteSize {
+			t.Errorf("node %s = %+v, want %+v", n.name, *n, *s)
+		}
+	}
+	srcPoints, dstPoints := allPoints(t, src), allPoints(t, dst)
+	for i := range srcPoints {
+		if dstPoints[i] != srcPoints[i] {
+			t.Errorf("point %d = %+v, want %+v", i, dstPoints[i], srcPoints[i])
+		}
+	}
+
+	// nothing is left behind in the data directory but the dataset
+	entries, _ := os.ReadDir(cfg.DataDir)
+	if len(entries) != 1 || entries[0].Name() != "copy" {
+		t.Errorf("data directory holds %v", entries)
+	}
+	if _, err := createDataset("copy", dst.meta); !errors.Is(err, errDatasetExists) {
+		t.Errorf("creating an existing dataset: %v", err)
+	}
+}
+
+func TestPotreeWriterErrors(t *testing.T) {
+	withDataDir(t, t.TempDir())
+	var meta potreeMetadata
+	meta.Attributes = []potreeAttribute{newAttribute("position", "int32", 3)}
+	w, err := createDataset("bad", meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.writeNode("r", make([]byte, 13)); err == nil {
+		t.Error("partial record was accepted")
+	}
+	if err := w.writeNode("r", make([]byte, 24)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.writeNode("r", make([]byte, 12)); err == nil {
+		t.Error("node written twice was accepted")
+	}
+	w.abort()
+	if entries, _ := os.ReadDir(cfg.DataDir); len(entries) != 0 {
+		t.Errorf("abort left %v", entries)
+	}
+	if _, err := createDataset("../bad", meta); err == nil {
+		t.Error("dataset outside the data directory was created")
+	}
+}
+
+func TestDeriveDataset(t *testing.T) {
+	withDataDir(t, "testdata")
+	src, err := openDataset("tiny")
+	if err != nil {
+		t.Fatal(err)
+	}
+	withDataDir(t, t.TempDir())
+
+	extra := []potreeAttribute{
+		newAttribute("classification", "uint8", 1),
+		newAttribute("height", "float", 1),
+	}
+	err = deriveDataset(context.Background(), src, "derived", "heights", extra,
+		func(n *octreeNode, pts []point, records [][]byte, offsets map[string]int) error {
+			for i, p := range pts {
+				extra[0].putValue(records[i][offsets["classification"]:], 0, 9)
+				extra[1].putValue(records[i][offsets["height"]:], 0, p.Z-1)
+			}
+			return nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := openDataset("derived")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.meta.Description != "heights" || len(d.meta.Attributes) != len(src.meta.Attributes)+1 || d.pointSize != src.pointSize+4 {
+		t.Fatalf("attributes = %+v", d.meta.Attributes)
+	}
+	height, offset, ok := d.attribute("height")
+	if !ok {
+		t.Fatal("height attribute is missing")
+	}
+	if !slices.Equal(height.Min, []float64{0}) || !slices.Equal(height.Max, []float64{6}) {
+		t.Errorf("height spans %v-%v, want 0-6", height.Min, height.Max)
+	}
+
+	octree, err := d.openOctree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer octree.Close()
+	for _, n := range d.nodes(-1, nil) {
+		octree.forEachPoint(n, func(p *point, rec []byte) error {
+			if h := height.value(rec[offset:], 0); p.Classification != 9 || h != p.Z-1 {
+				t.Errorf("node %s: class %d height %v at z %v", n.name, p.Classification, h, p.Z)
+			}
+			return nil
+		})
+	}
+}
+
+func TestPutValue(t *testing.T) {
+	tests := []struct {
+		typ     string
+		in, out float64
+	}{
+		{"int8", -3.4, -3},
+		{"uint8", 254.6, 255},
+		{"int16", -300, -300},
+		{"uint16", 65535, 65535},
+		{"int32", -2.5, -3},
+		{"uint32", 4e9, 4e9},
+		{"int64", -1 << 40, -1 << 40},
+		{"uint64", 1 << 50, 1 << 50},
+		{"float", 0.25, 0.25},
+		{"double", math.Pi, math.Pi},
+	}
+	for _, tt := range tests {
+		a := newAttribute("v", tt.typ, 2)
+		if a.Size != 2*a.ElementSize || a.ElementSize == 0 {
+			t.Errorf("%s: size %d element size %d", tt.typ, a.Size, a.ElementSize)
+		}
+		b := make([]byte, a.Size)
+		a.putValue(b, 1, tt.in)
+		if got := a.value(b, 1); got != tt.out {
+			t.Errorf("%s: %v encoded as %v, want %v", tt.typ, tt.in, got, tt.out)
+		}
+		if got := a.value(b, 0); got != 0 {
+			t.Errorf("%s: element 0 = %v after writing element 1", tt.typ, got)
+		}
+	}
+}
+
+// allPoints decodes every point of d in hierarchy order
+func allPoints(t *testing.T, d *potreeDataset) []point {
+	t.Helper()
+	octree, err := d.openOctree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer octree.Close()
+	var pts []point
+	for _, n := range d.nodes(-1, nil) {
+		err := octree.forEachPoint(n, func(p *point, rec []byte) error {
+			pts = append(pts, *p)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return pts
+}
@@ -0,0 +1,14 @@
+package main
+
+import "golang.org/x/sys/unix"
+
+// processStarted returns when a process started, in microseconds since the
+// epoch, which tells it apart from a later process with the same PID
+func processStarted(pid int) (uint64, error) {
+	info, err := unix.SysctlKinfoProc("kern.proc.pid", pid)
+	if err != nil {
+		return 0, err
+	}
+	t := info.Proc.P_starttime
+	return uint64(t.Sec)*1_000_000 + uint64(t.Usec), nil
+}
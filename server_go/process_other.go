@@ -0,0 +1,11 @@
+//go:build !linux && !windows && !darwin
+
+package main
+
+import "errors"
+
+// processStarted is not implemented here, so leftover processes are not
+// killed after a crash
+func processStarted(pid int) (uint64, error) {
+	return 0, errors.ErrUnsupported
+}
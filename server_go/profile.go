@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+var errProfileTooLarge = errors.New("profile has too many points")
+
+// profilePoint is a point projected onto a profile polyline
+type profilePoint struct {
+	Distance       float64 `json:"distance"`
+	Offset         float64 `json:"offset"`
+	Elevation      float64 `json:"elevation"`
+	Classification uint8   `json:"classification"`
+	X              float64 `json:"x"`
+	Y              float64 `json:"y"`
+}
+
+// profile is a polyline with a corridor, like Potree's client side profile tool
+type profile struct {
+	vertices [][2]float64
+	width    float64
+	starts   []float64 // distance along the line at each segment start
+	length   float64
+}
+
+func newProfile(vertices [][2]float64, width float64) (*profile, error) {
+	if len(vertices) < 2 {
+		return nil, errors.New("polyline needs at least 2 vertices")
+	}
+	if width <= 0 {
+		return nil, errors.New("width must be positive")
+	}
+	p := &profile{vertices: vertices, width: width}
+	for i := 0; i < len(vertices)-1; i++ {
+		p.starts = append(p.starts, p.length)
+		p.length += math.Hypot(vertices[i+1][0]-vertices[i][0], vertices[i+1][1]-vertices[i][1])
+	}
+	return p, nil
+}
+
+// bounds returns the 2D extent of the corridor with the given Z range
+func (p *profile) bounds(zMin, zMax float64) aabb {
+	half := p.width / 2
+	b := aabb{
+		Min: [3]float64{math.Inf(1), math.Inf(1), zMin},
+		Max: [3]float64{math.Inf(-1), math.Inf(-1), zMax},
+	}
+	for _, v := range p.vertices {
+		b.Min[0] = math.Min(b.Min[0], v[0]-half)
+		b.Min[1] = math.Min(b.Min[1], v[1]-half)
+		b.Max[0] = math.Max(b.Max[0], v[0]+half)
+		b.Max[1] = math.Max(b.Max[1], v[1]+half)
+	}
+	return b
+}
+
+// project returns the distance along the line and the signed offset from it
+// of the closest segment, and whether the point lies inside the corridor
+func (p *profile) project(x, y float64) (float64, float64, bool) {
+	best := math.Inf(1)
+	var distance, offset float64
+	for i := 0; i < len(p.vertices)-1; i++ {
+		ax, ay := p.vertices[i][0], p.vertices[i][1]
+		dx, dy := p.vertices[i+1][0]-ax, p.vertices[i+1][1]-ay
+		segLen := math.Hypot(dx, dy)
+		if segLen == 0 {
+			continue
+		}
+		t := ((x-ax)*dx + (y-ay)*dy) / (segLen * segLen)
+		t = math.Max(0, math.Min(1, t))
+		px, py := ax+t*dx, ay+t*dy
+		d := math.Hypot(x-px, y-py)
+		if d < best {
+			best = d
+			distance = p.starts[i] + t*segLen
+			// cross product sign tells which side of the line the point is on
+			offset = math.Copysign(d, dx*(y-ay)-dy*(x-ax))
+		}
+	}
+	return distance, offset, best <= p.width/2
+}
+
+// elevationProfile handles POST /datasets/{name}/profile
+func elevationProfile(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+
+	var requestBody struct {
+		Polyline [][2]float64 `json:"polyline"`
+		Width    float64      `json:"width"`
+		ZRange   *[2]float64  `json:"zRange"`
+		LOD      *int         `json:"lod"`
+		Format   string       `json:"format"`
+		// CRS of the polyline vertices, e.g. "EPSG:4326"; the dataset CRS if empty
+		CRS string `json:"crs"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if requestBody.Format != "" && requestBody.Format != "json" && requestBody.Format != "csv" {
+		http.Error(w, "Unsupported format, use json or csv", http.StatusBadRequest)
+		return
+	}
+
+	d, ok := openDatasetForRequest(w, name)
+	if !ok {
+		return
+	}
+
+	if err := d.localizeXY(requestBody.CRS, requestBody.Polyline); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	prof, err := newProfile(requestBody.Polyline, requestBody.Width)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	zMin, zMax := d.bounds().Min[2], d.bounds().Max[2]
+	if requestBody.ZRange != nil {
+		zMin, zMax = requestBody.ZRange[0], requestBody.ZRange[1]
+		if !(zMin <= zMax) {
+			http.Error(w, "zRange must be [min, max]", http.StatusBadRequest)
+			return
+		}
+	}
+	maxLevel := -1
+	if requestBody.LOD != nil {
+		maxLevel = *requestBody.LOD
+	}
+
+	points := []profilePoint{}
+	reg := &region{bounds: prof.bounds(zMin, zMax)}
+	err = d.forEachPointIn(r.Context(), reg, maxLevel, func(p *point) error {
+		distance, offset, inside := prof.project(p.X, p.Y)
+		if inside {
+			if limit := cfg.Limits.MaxProfilePoints; limit > 0 && len(points) == limit {
+				return errProfileTooLarge
+			}
+			points = append(points, profilePoint{
+				Distance:       distance,
+				Offset:         offset,
+				Elevation:      p.Z,
+				Classification: p.Classification,
+				X:              p.X,
+				Y:              p.Y,
+			})
+		}
+		return nil
+	})
+	if errors.Is(err, errProfileTooLarge) {
+		http.Error(w, fmt.Sprintf("Profile has more than %d points, narrow the corridor or set a lower lod", cfg.Limits.MaxProfilePoints),
+			http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to compute profile", http.StatusInternalServerError)
+		requestLog(r).Error("Error computing profile", "error", err)
+		return
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].Distance < points[j].Distance })
+
+	if requestBody.Format == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name + "-profile.csv"}))
+		fmt.Fprintln(w, "distance,offset,elevation,classification,x,y")
+		xyPrec, zPrec := scaleDecimals(d.meta.Scale[0]), scaleDecimals(d.meta.Scale[2])
+		for _, p := range points {
+			fmt.Fprintf(w, "%s,%s,%s,%d,%s,%s\n",
+				strconv.FormatFloat(p.Distance, 'f', xyPrec, 64),
+				strconv.FormatFloat(p.Offset, 'f', xyPrec, 64),
+				strconv.FormatFloat(p.Elevation, 'f', zPrec, 64),
+				p.Classification,
+				strconv.FormatFloat(p.X, 'f', xyPrec, 64),
+				strconv.FormatFloat(p.Y, 'f', xyPrec, 64),
+			)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"length": prof.length,
+		"width":  prof.width,
+		"count":  len(points),
+		"points": points,
+	})
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestElevationProfile(t *testing.T) {
+	withDataDir(t, "testdata")
+	defer func(limit int) { cfg.Limits.MaxProfilePoints = limit }(cfg.Limits.MaxProfilePoints)
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /datasets/{name}/profile", elevationProfile)
+
+	// every point of testdata/tiny lies within 1 m of the diagonal
+	const line = `"polyline": [[0, 0], [8, 8]], "width": 2`
+	tests := []struct {
+		name   string
+		body   string
+		limit  int
+		code   int
+		points int
+	}{
+		{"whole profile", `{` + line + `}`, 0, http.StatusOK, 5},
+		{"z range", `{` + line + `, "zRange": [5, 8]}`, 0, http.StatusOK, 3},
+		{"empty z range", `{` + line + `, "zRange": [3, 3]}`, 0, http.StatusOK, 0},
+		{"reversed z range", `{` + line + `, "zRange": [8, 5]}`, 0, http.StatusBadRequest, 0},
+		{"at the cap", `{` + line + `}`, 5, http.StatusOK, 5},
+		{"over the cap", `{` + line + `}`, 4, http.StatusRequestEntityTooLarge, 0},
+		{"cap after the z range", `{` + line + `, "zRange": [5, 8]}`, 4, http.StatusOK, 3},
+		{"no width", `{"polyline": [[0, 0], [8, 8]]}`, 0, http.StatusBadRequest, 0},
+	}
+	for _, tt := range tests {
+		cfg.Limits.MaxProfilePoints = tt.limit
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("POST", "/datasets/tiny/profile", strings.NewReader(tt.body)))
+		if rec.Code != tt.code {
+			t.Errorf("%s: status %d %q, want %d", tt.name, rec.Code, rec.Body.String(), tt.code)
+			continue
+		}
+		if rec.Code != http.StatusOK {
+			continue
+		}
+		var resp struct {
+			Count  int            `json:"count"`
+			Points []profilePoint `json:"points"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Count != tt.points || len(resp.Points) != tt.points {
+			t.Errorf("%s: %d points, want %d", tt.name, len(resp.Points), tt.points)
+		}
+		for i := 1; i < len(resp.Points); i++ {
+			if resp.Points[i].Distance < resp.Points[i-1].Distance {
+				t.Errorf("%s: points are not ordered by distance", tt.name)
+			}
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("POST", "/datasets/tiny/profile", strings.NewReader(`{`+line+`, "format": "csv"}`)))
+	if got := rec.Header().Get("Content-Disposition"); got != "attachment; filename=tiny-profile.csv" {
+		t.Errorf("Content-Disposition = %q", got)
+	}
+	if lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n"); len(lines) != 6 || lines[1] != "1.41,0.00,1.00,2,1.00,1.00" {
+		t.Errorf("csv = %q", lines)
+	}
+}
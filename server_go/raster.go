@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// rasterNoData marks empty cells in generated elevation rasters
+const rasterNoData = -9999
+
+// maxRasterCells guards against cell sizes that would exhaust memory
+const maxRasterCells = 400_000_000
+
+// lasClassGround is the ASPRS ground classification code
+const lasClassGround = 2
+
+// rasterOptions configures a DSM/DTM rasterization job
+type rasterOptions struct {
+	Type       string  `json:"type"`     // "dsm" (max Z) or "dtm" (mean Z of ground points)
+	CellSize   float64 `json:"cellSize"` // in dataset units
+	Fill       string  `json:"fill"`     // "none", "nearest" or "idw"
+	FillRadius int     `json:"fillRadius"`
+	Hillshade  bool    `json:"hillshade"`
+	LOD        *int    `json:"lod"`
+}
+
+func (o *rasterOptions) validate() error {
+	if o.Type != "dsm" && o.Type != "dtm" {
+		return errors.New("type must be dsm or dtm")
+	}
+	if o.CellSize <= 0 {
+		return errors.New("cellSize must be positive")
+	}
+	if o.Fill == "" {
+		o.Fill = "idw"
+	}
+	if o.Fill != "none" && o.Fill != "nearest" && o.Fill != "idw" {
+		return errors.New("fill must be none, nearest or idw")
+	}
+	if o.FillRadius == 0 {
+		o.FillRadius = 3
+	}
+	if o.FillRadius < 0 || o.FillRadius > 100 {
+		return errors.New("fillRadius must be between 1 and 100 cells")
+	}
+	return nil
+}
+
+// extent returns the tight bounds of the points from the position attribute,
+// falling back to the cubic octree bounds
+func (d *potreeDataset) extent() aabb {
+	if a, _, ok := d.attribute("position"); ok && len(a.Min) == 3 && len(a.Max) == 3 {
+		return aabb{Min: [3]float64{a.Min[0], a.Min[1], a.Min[2]}, Max: [3]float64{a.Max[0], a.Max[1], a.Max[2]}}
+	}
+	return d.bounds()
+}
+
+// rasterize grids the dataset into max Z (DSM) or mean ground Z (DTM)
+func rasterize(ctx context.Context, d *potreeDataset, opts rasterOptions) (*grid, error) {
+	ext := d.extent()
+	cols := int(math.Ceil((ext.Max[0]-ext.Min[0])/opts.CellSize)) + 1
+	rows := int(math.Ceil((ext.Max[1]-ext.Min[1])/opts.CellSize)) + 1
+	if cols*rows > maxRasterCells {
+		return nil, fmt.Errorf("raster of %dx%d cells is too large, increase cellSize", cols, rows)
+	}
+	g := newGrid(cols, rows, ext.Min[0], ext.Min[1]+float64(rows)*opts.CellSize, opts.CellSize, rasterNoData)
+
+	var counts []uint32
+	if opts.Type == "dtm" {
+		counts = make([]uint32, cols*rows)
+	}
+
+	maxLevel := -1
+	if opts.LOD != nil {
+		maxLevel = *opts.LOD
+	}
+	err := d.forEachPointIn(ctx, &region{bounds: d.bounds()}, maxLevel, func(p *point) error {
+		col, row, ok := g.cell(p.X, p.Y)
+		if !ok {
+			return nil
+		}
+		i := row*cols + col
+		z := float32(p.Z)
+		if opts.Type == "dsm" {
+			if g.values[i] == rasterNoData || z > g.values[i] {
+				g.values[i] = z
+			}
+			return nil
+		}
+		if p.Classification != lasClassGround {
+			return nil
+		}
+		// running mean avoids a second accumulation buffer
+		counts[i]++
+		if counts[i] == 1 {
+			g.values[i] = z
+		} else {
+			g.values[i] += (z - g.values[i]) / float32(counts[i])
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// fillGaps fills empty cells from populated cells within radius cells
+func fillGaps(g *grid, method string, radius int) {
+	if method == "none" {
+		return
+	}
+	src := make([]float32, len(g.values))
+	copy(src, g.values)
+
+	for row := 0; row < g.rows; row++ {
+		for col := 0; col < g.cols; col++ {
+			if src[row*g.cols+col] != g.noData {
+				continue
+			}
+			var sum, weights float64
+			nearest := math.Inf(1)
+			for dy := -radius; dy <= radius; dy++ {
+				for dx := -radius; dx <= radius; dx++ {
+					r, c := row+dy, col+dx
+					if r < 0 || c < 0 || r >= g.rows || c >= g.cols {
+						continue
+					}
+					v := src[r*g.cols+c]
+					if v == g.noData {
+						continue
+					}
+					dist2 := float64(dx*dx + dy*dy)
+					if dist2 > float64(radius*radius) {
+						continue
+					}
+					if method == "nearest" {
+						if dist2 < nearest {
+							nearest = dist2
+							sum, weights = float64(v), 1
+						}
+						continue
+					}
+					w := 1 / dist2
+					sum += w * float64(v)
+					weights += w
+				}
+			}
+			if weights > 0 {
+				g.set(col, row, float32(sum/weights))
+			}
+		}
+	}
+}
+
+// writeHillshade renders a Horn hillshade with the sun at azimuth 315° and altitude 45°
+func writeHillshade(path string, g *grid) error {
+	const azimuth, altitude = 315.0, 45.0
+	zenith := (90 - altitude) * math.Pi / 180
+	az := (360 - azimuth + 90) * math.Pi / 180
+
+	img := image.NewNRGBA(image.Rect(0, 0, g.cols, g.rows))
+	valid := func(c, r int) bool {
+		return c >= 0 && r >= 0 && c < g.cols && r < g.rows && g.at(c, r) != g.noData
+	}
+	for row := 0; row < g.rows; row++ {
+		for col := 0; col < g.cols; col++ {
+			if !valid(col, row) {
+				continue
+			}
+			// neighbours outside the raster or empty reuse the centre value
+			z := func(dc, dr int) float64 {
+				if valid(col+dc, row+dr) {
+					return float64(g.at(col+dc, row+dr))
+				}
+				return float64(g.at(col, row))
+			}
+			dzdx := ((z(1, -1) + 2*z(1, 0) + z(1, 1)) - (z(-1, -1) + 2*z(-1, 0) + z(-1, 1))) / (8 * g.cellSize)
+			dzdy := ((z(-1, 1) + 2*z(0, 1) + z(1, 1)) - (z(-1, -1) + 2*z(0, -1) + z(1, -1))) / (8 * g.cellSize)
+			slope := math.Atan(math.Hypot(dzdx, dzdy))
+			aspect := math.Atan2(dzdy, -dzdx)
+			shade := math.Cos(zenith)*math.Cos(slope) + math.Sin(zenith)*math.Sin(slope)*math.Cos(az-aspect)
+			v := uint8(255 * math.Max(0, shade))
+			img.SetNRGBA(col, row, color.NRGBA{R: v, G: v, B: v, A: 255})
+		}
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := png.Encode(f, img); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// rasterizeDataset handles POST /datasets/{name}/raster and starts a DSM/DTM job
+func rasterizeDataset(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+
+	var opts rasterOptions
+	if err := json.NewDecoder(r.Body).Decode(&opts); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := opts.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	d, ok := openDatasetForRequest(w, name)
+	if !ok {
+		return
+	}
+
+	j := startJob("raster", name, func(ctx context.Context, dir string) ([]string, error) {
+		g, err := rasterize(ctx, d, opts)
+		if err != nil {
+			return nil, err
+		}
+		fillGaps(g, opts.Fill, opts.FillRadius)
+
+		epsg := 0
+		if c, err := d.crs(); err == nil {
+			epsg = c.EPSG
+		}
+		tif := opts.Type + ".tif"
+		if err := writeGeoTIFF(filepath.Join(dir, tif), g, epsg, d.meta.Projection); err != nil {
+			return nil, err
+		}
+		outputs := []string{tif}
+		if opts.Hillshade {
+			if err := writeHillshade(filepath.Join(dir, "hillshade.png"), g); err != nil {
+				return nil, err
+			}
+			outputs = append(outputs, "hillshade.png")
+		}
+		return outputs, nil
+	})
+	writeJob(w, http.StatusAccepted, j)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+)
+
+// sceneCloud is one point cloud of a streamed scene
+type sceneCloud struct {
+	URL     string `json:"url"`
+	Title   string `json:"title,omitempty"`
+	Visible *bool  `json:"visible,omitempty"` // defaults to true
+	// ColorMode is a Potree attribute to color by, e.g. "rgba", "elevation",
+	// "intensity", "classification" or an extra attribute such as "distance"
+	ColorMode string          `json:"colorMode,omitempty"`
+	Transform *cloudTransform `json:"transform,omitempty"`
+
+	// ElevationRange is filled in from the cached dataset statistics
+	ElevationRange *[2]float64 `json:"elevationRange,omitempty"`
+}
+
+// cloudTransform places a cloud in the scene, applied as scale, then
+// rotation (degrees about x, y and z), then translation
+type cloudTransform struct {
+	Translation [3]float64  `json:"translation"`
+	Rotation    [3]float64  `json:"rotation"`
+	Scale       *[3]float64 `json:"scale,omitempty"`
+}
+
+// sceneClouds validates the clouds of a start request; a single
+// pointCloudUrl is accepted as a scene of one cloud
+func sceneClouds(pointCloudURL string, clouds []sceneCloud) ([]sceneCloud, error) {
+	if len(clouds) == 0 {
+		if pointCloudURL == "" {
+			return nil, errors.New("pointCloudUrl or pointClouds is required")
+		}
+		clouds = []sceneCloud{{URL: pointCloudURL, Title: "Viewer"}}
+	} else if pointCloudURL != "" {
+		return nil, errors.New("specify either pointCloudUrl or pointClouds, not both")
+	}
+
+	for i := range clouds {
+		c := &clouds[i]
+		if c.URL == "" {
+			return nil, fmt.Errorf("pointClouds[%d] has no url", i)
+		}
+		if c.Title == "" {
+			c.Title = fmt.Sprintf("Cloud %d", i+1)
+		}
+		if s := c.Transform; s != nil && s.Scale != nil && (s.Scale[0] == 0 || s.Scale[1] == 0 || s.Scale[2] == 0) {
+			return nil, fmt.Errorf("pointClouds[%d] transform scale must not be zero", i)
+		}
+		c.ElevationRange = cachedElevationRange(c.URL)
+	}
+	return clouds, nil
+}
+
+// sceneParam returns the viewer query parameter describing all clouds
+func sceneParam(clouds []sceneCloud) (string, error) {
+	raw, err := json.Marshal(clouds)
+	if err != nil {
+		return "", err
+	}
+	return "clouds=" + url.QueryEscape(string(raw)), nil
+}
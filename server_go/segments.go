@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"io"
+	"net"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hlsContentTypes maps HLS file extensions to their MIME types
+var hlsContentTypes = map[string]string{
+	".m3u8": "application/vnd.apple.mpegurl",
+	".m4s":  "video/iso.segment",
+	".mp4":  "video/mp4",
+	".ts":   "video/mp2t",
+}
+
+const (
+	// segmentsKept is how many media segments a session keeps in memory,
+	// the playlist window plus a few for clients that are behind
+	segmentsKept = 10
+	// maxIngestSize bounds a single uploaded file
+	maxIngestSize = 64 << 20
+)
+
+// segmentStore holds the HLS output of one session in memory. FFmpeg
+// uploads each file once it is complete, so everything stored is servable.
+type segmentStore struct {
+	mu       sync.RWMutex
+	files    map[string][]byte // playlists, init and media segments
+	segments []string          // media segments, oldest first
+	ready    func()            // called once when the first playlist arrives
+	owner    *principal        // who started the session
+	secret   string            // in the ingest URLs, so only the session's FFmpeg can upload
+}
+
+var (
+	segmentStoresMu sync.Mutex
+	segmentStores   = map[string]*segmentStore{}
+)
+
+// newSegmentStore registers the store of a session; ready is called when
+// the session's first segment can be played
+func newSegmentStore(session string, owner *principal, ready func()) *segmentStore {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	s := &segmentStore{files: map[string][]byte{}, ready: ready, owner: owner, secret: hex.EncodeToString(secret)}
+	segmentStoresMu.Lock()
+	segmentStores[session] = s
+	segmentStoresMu.Unlock()
+	return s
+}
+
+// removeSegmentStore frees the output of a session
+func removeSegmentStore(session string) {
+	segmentStoresMu.Lock()
+	delete(segmentStores, session)
+	segmentStoresMu.Unlock()
+}
+
+// lookupSegmentStore returns the store of a session
+func lookupSegmentStore(session string) (*segmentStore, bool) {
+	segmentStoresMu.Lock()
+	defer segmentStoresMu.Unlock()
+	s, ok := segmentStores[session]
+	return s, ok
+}
+
+// put stores a file, evicting the oldest media segments beyond segmentsKept
+func (s *segmentStore) put(name string, data []byte) {
+	s.mu.Lock()
+	var ready func()
+	ext := filepath.Ext(name)
+	if _, exists := s.files[name]; !exists && (ext == ".m4s" || ext == ".ts") {
+		s.segments = append(s.segments, name)
+		for len(s.segments) > segmentsKept {
+			delete(s.files, s.segments[0])
+			s.segments = s.segments[1:]
+		}
+	}
+	s.files[name] = data
+	if ext == ".m3u8" && s.ready != nil {
+		ready, s.ready = s.ready, nil
+	}
+	s.mu.Unlock()
+
+	if ready != nil {
+		ready()
+	}
+}
+
+// remove deletes a file FFmpeg no longer lists
+func (s *segmentStore) remove(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.files, name)
+	for i, segment := range s.segments {
+		if segment == name {
+			s.segments = append(s.segments[:i], s.segments[i+1:]...)
+			break
+		}
+	}
+}
+
+// get returns a stored file
+func (s *segmentStore) get(name string) ([]byte, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	data, ok := s.files[name]
+	return data, ok
+}
+
+// segmentRequest resolves the session store and file name of a request,
+// or responds with an error
+func segmentRequest(w http.ResponseWriter, r *http.Request) (*segmentStore, string, bool) {
+	name := r.PathValue("file")
+	if _, ok := hlsContentTypes[filepath.Ext(name)]; !ok || name != filepath.Base(name) {
+		http.Error(w, "Not an HLS file", http.StatusNotFound)
+		return nil, "", false
+	}
+	s, ok := lookupSegmentStore(r.PathValue("session"))
+	if !ok {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return nil, "", false
+	}
+	return s, name, true
+}
+
+// ingestURL returns where the FFmpeg of a session uploads its output. It
+// uses the listen address, on the loopback interface when the server
+// listens on all of them, and not PublicURL, which may be a proxy or
+// another host.
+func ingestURL(session string, s *segmentStore) string {
+	host, port, _ := net.SplitHostPort(cfg.Listen) // checked by validate
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		host = "127.0.0.1"
+	}
+	return "http://" + net.JoinHostPort(host, port) + "/ingest/" + session + "/" + s.secret
+}
+
+// ingestSegment handles PUT and DELETE /ingest/{session}/{secret}/{file}
+// from the FFmpeg HLS muxer of the session. Behind a local proxy every
+// client connects from localhost, so the session's secret is what keeps
+// others from replacing the stream.
+func ingestSegment(w http.ResponseWriter, r *http.Request) {
+	if !fromThisHost(r) {
+		http.Error(w, "Ingest is only accepted from this host", http.StatusForbidden)
+		return
+	}
+	s, name, ok := segmentRequest(w, r)
+	if !ok {
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(r.PathValue("secret")), []byte(s.secret)) != 1 {
+		http.Error(w, "Invalid ingest secret", http.StatusForbidden)
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		s.remove(name)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxIngestSize))
+	if err != nil {
+		http.Error(w, "Failed to read upload", http.StatusBadRequest)
+		requestLog(r).Error("Error reading HLS upload", "session", r.PathValue("session"), "error", err)
+		return
+	}
+	s.put(name, data)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// fromThisHost reports whether a request comes from the loopback interface
+// or from the address it was received on
+func fromThisHost(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	ip := net.ParseIP(host)
+	if err != nil || ip == nil {
+		return false
+	}
+	if ip.IsLoopback() {
+		return true
+	}
+	local, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if !ok {
+		return false
+	}
+	localHost, _, err := net.SplitHostPort(local.String())
+	return err == nil && ip.Equal(net.ParseIP(localHost))
+}
+
+// serveSegment handles GET /hls/{session}/{file}, with playlists uncached
+// and segments immutable
+func serveSegment(w http.ResponseWriter, r *http.Request) {
+	s, name, ok := segmentRequest(w, r)
+	if !ok {
+		return
+	}
+	// a signed URL grants access on its own, otherwise the caller must own the session
+	signed, expires, ok := checkSignature(w, r, r.URL.Path)
+	if signed && !ok {
+		return
+	}
+	if !signed {
+		p := principalFrom(r)
+		if p == nil {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Authentication required", http.StatusUnauthorized)
+			return
+		}
+		if !p.owns(s.owner) {
+			http.Error(w, "Session belongs to another user", http.StatusForbidden)
+			return
+		}
+	}
+	data, ok := s.get(name)
+	if !ok {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	// playback keeps the session alive
+	if session, ok := lookupSession(r.PathValue("session")); ok {
+		session.touch()
+	}
+
+	w.Header().Set("Content-Type", hlsContentTypes[filepath.Ext(name)])
+	if strings.HasSuffix(name, ".m3u8") {
+		// segment URLs live no longer than the playlist URL and keep its IP binding
+		segmentsExpire := time.Now().Add(cfg.Auth.Signing.SegmentTTL).Truncate(time.Second)
+		if signed && expires.Before(segmentsExpire) {
+			segmentsExpire = expires
+		}
+		ip := ""
+		if cfg.Auth.Signing.BindIP || signed && r.URL.Query().Get(sigBind) == "ip" {
+			ip = clientIP(r)
+		}
+		data = signPlaylist(data, path.Dir(r.URL.Path), segmentsExpire, ip)
+		w.Header().Set("Cache-Control", "no-cache")
+	} else {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	}
+	http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(data))
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestIngestSecret(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("PUT /ingest/{session}/{secret}/{file}", ingestSegment)
+	mux.HandleFunc("DELETE /ingest/{session}/{secret}/{file}", ingestSegment)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	a := newSegmentStore("ingest-a", nil, nil)
+	b := newSegmentStore("ingest-b", nil, nil)
+	defer removeSegmentStore("ingest-a")
+	defer removeSegmentStore("ingest-b")
+	if a.secret == "" || a.secret == b.secret {
+		t.Fatalf("secrets %q and %q", a.secret, b.secret)
+	}
+
+	tests := []struct {
+		name, method, path string
+		want               int
+	}{
+		{"own secret", "PUT", "/ingest/ingest-a/" + a.secret + "/segment_000.m4s", http.StatusCreated},
+		{"no secret", "PUT", "/ingest/ingest-a/segment_000.m4s", http.StatusNotFound},
+		{"wrong secret", "PUT", "/ingest/ingest-a/" + strings.Repeat("0", 64) + "/segment_001.m4s", http.StatusForbidden},
+		{"secret of another session", "PUT", "/ingest/ingest-a/" + b.secret + "/segment_001.m4s", http.StatusForbidden},
+		{"delete with wrong secret", "DELETE", "/ingest/ingest-a/" + b.secret + "/segment_000.m4s", http.StatusForbidden},
+		{"not an HLS file", "PUT", "/ingest/ingest-a/" + a.secret + "/x.sh", http.StatusNotFound},
+		{"unknown session", "PUT", "/ingest/ingest-c/" + a.secret + "/output.m3u8", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(tt.method, srv.URL+tt.path, strings.NewReader("data"))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s: %s %s = %d, want %d", tt.name, tt.method, tt.path, resp.StatusCode, tt.want)
+		}
+	}
+	if _, ok := a.get("segment_000.m4s"); !ok {
+		t.Error("segment uploaded with the secret is missing")
+	}
+	if _, ok := a.get("segment_001.m4s"); ok {
+		t.Error("segment uploaded without the secret was stored")
+	}
+}
+
+func TestIngestURL(t *testing.T) {
+	defer func(listen string) { cfg.Listen = listen }(cfg.Listen)
+	s := &segmentStore{secret: "abc"}
+	for listen, want := range map[string]string{
+		":8080":          "http://127.0.0.1:8080/ingest/s/abc",
+		"0.0.0.0:8080":   "http://127.0.0.1:8080/ingest/s/abc",
+		"[::]:8080":      "http://127.0.0.1:8080/ingest/s/abc",
+		"[::1]:9000":     "http://[::1]:9000/ingest/s/abc",
+		"10.0.0.5:8080":  "http://10.0.0.5:8080/ingest/s/abc",
+		"localhost:8080": "http://localhost:8080/ingest/s/abc",
+	} {
+		cfg.Listen = listen
+		if got := ingestURL("s", s); got != want {
+			t.Errorf("listen %s: ingestURL = %s, want %s", listen, got, want)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"sync/atomic"
+	"time"
+)
+
+// streamSession is one stream: a Chrome window rendering the viewer and
+// FFmpeg capturing it into the session's segment store
+type streamSession struct {
+	ID      string
+	Owner   *principal
+	Started time.Time
+
+	datasets    []string // the /file/ datasets it streams
+	log         *slog.Logger
+	lastActive  atomic.Int64 // Unix nanoseconds of the last viewer request
+	health      encoderHealth
+	diagnostics browserDiagnostics
+	ended       bool // a final state was published, guarded by eventsMu
+
+	// guarded by mu
+	starting      bool // set until FFmpeg runs; /stop waits for it
+	stopped       bool
+	ffmpeg        *exec.Cmd
+	browserCancel context.CancelFunc
+	browserToken  string
+	release       []func() // frees the process limits of Chrome and FFmpeg
+}
+
+// sessions holds the running sessions by ID, guarded by mu
+var sessions = map[string]*streamSession{}
+
+// lookupSession returns a running session
+func lookupSession(id string) (*streamSession, bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	s, ok := sessions[id]
+	return s, ok
+}
+
+// ownedSessions returns the running sessions p started; callers hold mu
+func ownedSessions(p *principal) []*streamSession {
+	var owned []*streamSession
+	for _, s := range sessions {
+		if s.Owner != nil && p != nil && s.Owner.Subject == p.Subject {
+			owned = append(owned, s)
+		}
+	}
+	return owned
+}
+
+// end stops the processes of a session, frees its resources and publishes
+// state. It reports false when the session had already ended.
+func (s *streamSession) end(state, message string) bool {
+	mu.Lock()
+	if s.stopped {
+		mu.Unlock()
+		return false
+	}
+	s.stopped = true
+	delete(sessions, s.ID)
+	ffmpeg, cancel, token, release := s.ffmpeg, s.browserCancel, s.browserToken, s.release
+	mu.Unlock()
+
+	if ffmpeg != nil {
+		if err := ffmpeg.Process.Kill(); err != nil && !errors.Is(err, os.ErrProcessDone) {
+			s.log.Error("Error stopping FFmpeg", "error", err)
+		}
+	}
+	browserTokens.revoke(token)
+	if cancel != nil {
+		cancel() // Cancels the Chrome context
+		s.log.Info("Chrome closed")
+	}
+	for _, f := range release {
+		f()
+	}
+	removeSegmentStore(s.ID)
+	publishSession(s, state, message)
+	retireSessionLog(s.ID)
+	return true
+}
+
+// errSessionEnded reports that a session ended while it was starting, which
+// happens when the server shuts down
+var errSessionEnded = errors.New("session ended while starting")
+
+// attach adds release to what is freed when a starting session ends. When
+// the session has already ended it calls release at once and reports false.
+func (s *streamSession) attach(release func()) bool {
+	mu.Lock()
+	if !s.stopped {
+		s.release = append(s.release, release)
+		mu.Unlock()
+		return true
+	}
+	mu.Unlock()
+	release()
+	return false
+}
+
+// touch records viewer activity, which keeps a session from being reaped
+func (s *streamSession) touch() {
+	s.lastActive.Store(time.Now().UnixNano())
+}
+
+// idle returns how long the session has had no viewer
+func (s *streamSession) idle() time.Duration {
+	return time.Since(time.Unix(0, s.lastActive.Load()))
+}
+
+// reapSessions stops sessions nobody watches for IdleTimeout and sessions
+// older than MaxLifetime, so a closed tab does not leave Chrome and FFmpeg
+// running
+func reapSessions() {
+	l := &cfg.Limits
+	ticker := time.NewTicker(min(l.IdleTimeout/4, 10*time.Second))
+	defer ticker.Stop()
+	for range ticker.C {
+		type expired struct {
+			s      *streamSession
+			reason string
+		}
+		var reaped []expired
+		mu.Lock()
+		for _, s := range sessions {
+			if s.starting {
+				continue
+			}
+			if idle := s.idle(); idle > l.IdleTimeout {
+				reaped = append(reaped, expired{s, "no viewer for " + idle.Round(time.Second).String()})
+			} else if l.MaxLifetime > 0 && time.Since(s.Started) > l.MaxLifetime {
+				reaped = append(reaped, expired{s, "reached the maximum lifetime of " + l.MaxLifetime.String()})
+			}
+		}
+		mu.Unlock()
+
+		for _, e := range reaped {
+			e.s.end(sessionStopped, e.reason)
+		}
+	}
+}
+
+// sessionHeartbeat handles POST /sessions/{id}/heartbeat from viewers that
+// keep a session alive without fetching segments, such as a paused player
+func sessionHeartbeat(w http.ResponseWriter, r *http.Request) {
+	s, ok := lookupSession(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	if !principalFrom(r).owns(s.Owner) {
+		http.Error(w, "Session belongs to another user", http.StatusForbidden)
+		return
+	}
+	s.touch()
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+)
+
+// runState is what the server has running, kept in the state file so the
+// next start can clean up after a crash
+type runState struct {
+	PID       int              `json:"pid"`
+	Started   uint64           `json:"started,omitempty"` // see processStarted
+	Processes []trackedProcess `json:"processes,omitempty"`
+	Cgroups   []string         `json:"cgroups,omitempty"`
+	Dirs      []string         `json:"dirs,omitempty"`
+}
+
+// trackedProcess is a Chrome or FFmpeg of a session
+type trackedProcess struct {
+	Name    string `json:"name"`
+	PID     int    `json:"pid"`
+	Started uint64 `json:"started,omitempty"`
+}
+
+var (
+	stateMu sync.Mutex
+	state   runState
+)
+
+// initRunState cleans up what a previous server left in the state file and
+// starts a new one. It fails when that server is still running.
+func initRunState() error {
+	raw, err := os.ReadFile(cfg.StateFile)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err == nil {
+		var prev runState
+		if err := json.Unmarshal(raw, &prev); err != nil {
+			return fmt.Errorf("%s: %w", cfg.StateFile, err)
+		}
+		if prev.PID != os.Getpid() {
+			if prev.Started == 0 {
+				slog.Warn("Cannot tell whether the previous server still runs", "pid", prev.PID)
+			} else if processAlive(prev.PID, prev.Started) {
+				return fmt.Errorf("%s belongs to the running server process %d; remove it if that process is not a server", cfg.StateFile, prev.PID)
+			}
+		}
+		cleanUpAfter(prev)
+	}
+
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	state = runState{PID: os.Getpid()}
+	state.Started, _ = processStarted(state.PID)
+	return saveRunState()
+}
+
+// cleanUpAfter kills the processes and removes the directories of a server
+// that did not shut down
+func cleanUpAfter(prev runState) {
+	for _, p := range prev.Processes {
+		// the PID may belong to an unrelated process by now
+		if p.Started == 0 {
+			slog.Warn("Not killing leftover process of unknown identity", "process", p.Name, "pid", p.PID)
+			continue
+		}
+		if !processAlive(p.PID, p.Started) {
+			continue
+		}
+		proc, err := os.FindProcess(p.PID)
+		if err == nil {
+			err = proc.Kill()
+		}
+		if err != nil {
+			slog.Error("Error killing leftover process", "process", p.Name, "pid", p.PID, "error", err)
+		} else {
+			slog.Warn("Killed leftover process", "process", p.Name, "pid", p.PID)
+		}
+	}
+	for _, dir := range prev.Cgroups {
+		removeCgroup(dir)
+	}
+	for _, dir := range prev.Dirs {
+		if err := os.RemoveAll(dir); err != nil {
+			slog.Error("Error removing leftover directory", "dir", dir, "error", err)
+		}
+	}
+}
+
+// processAlive reports whether the process pid that started at started is
+// still running. A process without a start time cannot be told apart from
+// a later one with the same PID and does not count.
+func processAlive(pid int, started uint64) bool {
+	if started == 0 {
+		return false
+	}
+	now, err := processStarted(pid)
+	return err == nil && now == started
+}
+
+// saveRunState replaces the state file; callers hold stateMu
+func saveRunState() error {
+	raw, err := json.MarshalIndent(&state, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp := cfg.StateFile + ".tmp"
+	if err := os.WriteFile(tmp, raw, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, cfg.StateFile)
+}
+
+// updateRunState applies change to the state and saves it
+func updateRunState(change func(s *runState)) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	change(&state)
+	if err := saveRunState(); err != nil {
+		slog.Error("Error saving server state", "error", err)
+	}
+}
+
+// trackProcess records a running process until untrack is called
+func trackProcess(name string, pid int) (untrack func()) {
+	p := trackedProcess{Name: name, PID: pid}
+	p.Started, _ = processStarted(pid)
+	updateRunState(func(s *runState) { s.Processes = append(s.Processes, p) })
+	return func() {
+		updateRunState(func(s *runState) {
+			s.Processes = slices.DeleteFunc(s.Processes, func(q trackedProcess) bool { return q == p })
+		})
+	}
+}
+
+// trackCgroup records a cgroup until untrack is called
+func trackCgroup(dir string) (untrack func()) {
+	updateRunState(func(s *runState) { s.Cgroups = append(s.Cgroups, dir) })
+	return func() {
+		updateRunState(func(s *runState) {
+			s.Cgroups = slices.DeleteFunc(s.Cgroups, func(d string) bool { return d == dir })
+		})
+	}
+}
+
+// trackDir records a temporary directory until untrack is called
+func trackDir(dir string) (untrack func()) {
+	updateRunState(func(s *runState) { s.Dirs = append(s.Dirs, dir) })
+	return func() {
+		updateRunState(func(s *runState) {
+			s.Dirs = slices.DeleteFunc(s.Dirs, func(d string) bool { return d == dir })
+		})
+	}
+}
+
+// shuttingDown makes admit refuse new sessions, guarded by mu
+var shuttingDown bool
+
+// shutdown stops the sessions in parallel and lets the requests finish, up
+// to ShutdownTimeout. The state file is removed when everything stopped.
+func shutdown(srv *http.Server) {
+	slog.Info("Shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+
+	mu.Lock()
+	shuttingDown = true
+	running := make([]*streamSession, 0, len(sessions))
+	for _, s := range sessions {
+		running = append(running, s)
+	}
+	mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, s := range running {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.end(sessionStopped, "server is shutting down")
+		}()
+	}
+	stopped := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(stopped)
+	}()
+	clean := true
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		slog.Error("Sessions did not stop in time", "timeout", cfg.ShutdownTimeout)
+		clean = false
+	}
+
+	if err := flushJobsUntil(ctx); err != nil {
+		slog.Error("Jobs were not saved before shutdown", "error", err)
+	}
+
+	// event streams never go idle, so they are closed for Shutdown
+	closeSubscribers()
+	if err := srv.Shutdown(ctx); err != nil {
+		slog.Error("Error shutting down the server", "error", err)
+	}
+
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	if clean && len(state.Processes) == 0 && len(state.Cgroups) == 0 && len(state.Dirs) == 0 {
+		if err := os.Remove(cfg.StateFile); err != nil {
+			slog.Error("Error removing server state", "error", err)
+		}
+	}
+	slog.Info("Server stopped")
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestProcessAlive(t *testing.T) {
+	self := os.Getpid()
+	started, err := processStarted(self)
+	if err != nil {
+		t.Skip("start times are not available:", err)
+	}
+	tests := []struct {
+		name    string
+		pid     int
+		started uint64
+		want    bool
+	}{
+		{"this process", self, started, true},
+		{"reused PID", self, started + 1, false},
+		{"unknown start time", self, 0, false},
+	}
+	for _, tt := range tests {
+		if got := processAlive(tt.pid, tt.started); got != tt.want {
+			t.Errorf("%s: processAlive = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCleanUpAfter(t *testing.T) {
+	if _, err := processStarted(os.Getpid()); err != nil {
+		t.Skip("start times are not available:", err)
+	}
+	leftover := exec.Command("sleep", "60")
+	unknown := exec.Command("sleep", "60")
+	for _, cmd := range []*exec.Cmd{leftover, unknown} {
+		if err := cmd.Start(); err != nil {
+			t.Skip("cannot start sleep:", err)
+		}
+		defer cmd.Process.Kill()
+	}
+	started, _ := processStarted(leftover.Process.Pid)
+	dir := filepath.Join(t.TempDir(), "profile")
+	os.Mkdir(dir, 0o755)
+
+	cleanUpAfter(runState{
+		Processes: []trackedProcess{
+			{Name: "chrome", PID: leftover.Process.Pid, Started: started},
+			{Name: "ffmpeg", PID: unknown.Process.Pid}, // not verifiable, so spared
+		},
+		Dirs: []string{dir},
+	})
+	if err := leftover.Wait(); err == nil {
+		t.Error("leftover process exited normally, want killed")
+	}
+	if !processAlive(unknown.Process.Pid, mustStarted(t, unknown.Process.Pid)) {
+		t.Error("process of unknown identity was killed")
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("leftover directory: %v", err)
+	}
+}
+
+// mustStarted returns the start time of a running process
+func mustStarted(t *testing.T, pid int) uint64 {
+	t.Helper()
+	started, err := processStarted(pid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return started
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// signingConfig configures signed URLs, which give access to /hls/ and
+// /file/ paths without credentials until they expire
+type signingConfig struct {
+	// Key is the HMAC secret; a random key is used when empty, so signed
+	// URLs stop working when the server restarts
+	Key string `yaml:"key"`
+	// TTL is the lifetime of URLs that do not ask for one, MaxTTL the longest allowed
+	TTL    time.Duration `yaml:"ttl"`
+	MaxTTL time.Duration `yaml:"maxTtl"`
+	// SegmentTTL is the lifetime of the segment URLs written into playlists
+	SegmentTTL time.Duration `yaml:"segmentTtl"`
+	// BindIP binds every signed URL to the address of the client it is issued to
+	BindIP bool `yaml:"bindIp"`
+}
+
+// Query parameters of a signed URL
+const (
+	sigExpires   = "expires"
+	sigScope     = "scope"
+	sigBind      = "bind"
+	sigSignature = "signature"
+)
+
+var (
+	signingKey []byte
+
+	errSignatureExpired = errors.New("signed URL has expired")
+	errSignatureInvalid = errors.New("invalid URL signature")
+)
+
+// initSigning sets the key of signed URLs
+func initSigning(c *signingConfig) {
+	if c.Key != "" {
+		signingKey = []byte(c.Key)
+		return
+	}
+	signingKey = make([]byte, 32)
+	rand.Read(signingKey)
+	slog.Warn("No URL signing key is configured, signed URLs are valid until the server restarts")
+}
+
+// signature computes the HMAC of a scope, expiry and client address
+func signature(scope string, expires int64, ip string) string {
+	mac := hmac.New(sha256.New, signingKey)
+	mac.Write([]byte(scope + "\n" + strconv.FormatInt(expires, 10) + "\n" + ip))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// signQuery returns the query that signs every path matching scope until
+// expires. A scope ending in / covers the paths below it, which lets
+// Potree load the files next to a signed metadata.json. A non-empty ip
+// binds the URL to that client.
+func signQuery(scope string, expires time.Time, ip string) url.Values {
+	q := url.Values{}
+	q.Set(sigExpires, strconv.FormatInt(expires.Unix(), 10))
+	q.Set(sigScope, scope)
+	if ip != "" {
+		q.Set(sigBind, "ip")
+	}
+	q.Set(sigSignature, signature(scope, expires.Unix(), ip))
+	return q
+}
+
+// verifySignature checks the signed URL query of a request for urlPath.
+// signed is false when the request carries no signature.
+func verifySignature(r *http.Request, urlPath string) (signed bool, expires time.Time, err error) {
+	q := r.URL.Query()
+	sig := q.Get(sigSignature)
+	if sig == "" {
+		return false, time.Time{}, nil
+	}
+	exp, err := strconv.ParseInt(q.Get(sigExpires), 10, 64)
+	if err != nil {
+		return true, time.Time{}, errSignatureInvalid
+	}
+	scope := q.Get(sigScope)
+	if urlPath != scope && !(strings.HasSuffix(scope, "/") && strings.HasPrefix(urlPath, scope)) {
+		return true, time.Time{}, errSignatureInvalid
+	}
+	ip := ""
+	if q.Get(sigBind) == "ip" {
+		ip = clientIP(r)
+	}
+	if !hmac.Equal([]byte(sig), []byte(signature(scope, exp, ip))) {
+		return true, time.Time{}, errSignatureInvalid
+	}
+	expires = time.Unix(exp, 0)
+	if time.Now().After(expires) {
+		return true, expires, errSignatureExpired
+	}
+	return true, expires, nil
+}
+
+// checkSignature verifies the signature of a request, responding with 403
+// when it is invalid. It reports whether the request was signed, when the
+// signature expires and whether it is valid.
+func checkSignature(w http.ResponseWriter, r *http.Request, urlPath string) (signed bool, expires time.Time, ok bool) {
+	signed, expires, err := verifySignature(r, urlPath)
+	if errors.Is(err, errSignatureExpired) {
+		http.Error(w, "Signed URL has expired", http.StatusForbidden)
+		return true, expires, false
+	}
+	if err != nil {
+		http.Error(w, "Invalid URL signature", http.StatusForbidden)
+		return true, expires, false
+	}
+	return signed, expires, signed
+}
+
+// clientIP returns the address of the client of a request
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// signPlaylist appends a signature to every URI of an HLS playlist, so that
+// players which cannot send credentials, such as Safari's native player, can
+// fetch the segments. Relative URIs are resolved against dir.
+func signPlaylist(playlist []byte, dir string, expires time.Time, ip string) []byte {
+	sign := func(uri string) string {
+		if strings.Contains(uri, "://") || strings.HasPrefix(uri, "/") {
+			return uri
+		}
+		target := path.Join(dir, uri)
+		return uri + "?" + signQuery(target, expires, ip).Encode()
+	}
+
+	lines := strings.Split(string(playlist), "\n")
+	for i, line := range lines {
+		line = strings.TrimRight(line, "\r")
+		switch {
+		case line == "":
+		case !strings.HasPrefix(line, "#"):
+			lines[i] = sign(line)
+		case strings.Contains(line, `URI="`):
+			// tags such as EXT-X-MAP name their file in a URI attribute
+			before, rest, _ := strings.Cut(line, `URI="`)
+			uri, after, _ := strings.Cut(rest, `"`)
+			lines[i] = before + `URI="` + sign(uri) + `"` + after
+		}
+	}
+	return []byte(strings.Join(lines, "\n"))
+}
+
+// signURL handles POST /signed-urls, issuing a signed URL for an /hls/ or
+// /file/ path the caller can access
+func signURL(w http.ResponseWriter, r *http.Request) {
+	var requestBody struct {
+		Path  string `json:"path"`
+		Scope string `json:"scope"` // defaults to path
+		TTL   int    `json:"ttl"`   // seconds
+		// BindIP binds the URL to the caller's address
+		BindIP bool `json:"bindIp"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	urlPath := requestBody.Path
+	scope := requestBody.Scope
+	if scope == "" {
+		scope = urlPath
+	}
+	inScope := urlPath == scope || strings.HasSuffix(scope, "/") && strings.HasPrefix(urlPath, scope)
+	if path.Clean(urlPath) != urlPath || path.Clean(scope) != strings.TrimSuffix(scope, "/") || !inScope {
+		http.Error(w, "Path must be a clean path within scope", http.StatusBadRequest)
+		return
+	}
+
+	// the scope must stay within one dataset or session the caller can access
+	p := principalFrom(r)
+	if rest, ok := strings.CutPrefix(scope, "/file/"); ok {
+		name, _, _ := strings.Cut(rest, "/")
+		if !strings.HasPrefix(scope, "/file/"+name+"/") {
+			http.Error(w, "Scope must be within one dataset", http.StatusBadRequest)
+			return
+		}
+		if !authorize(w, r, name, permView) {
+			return
+		}
+	} else if rest, ok := strings.CutPrefix(scope, "/hls/"); ok {
+		session, _, _ := strings.Cut(rest, "/")
+		if !strings.HasPrefix(scope, "/hls/"+session+"/") {
+			http.Error(w, "Scope must be within one session", http.StatusBadRequest)
+			return
+		}
+		s, found := lookupSegmentStore(session)
+		if !found {
+			http.Error(w, "Session not found", http.StatusNotFound)
+			return
+		}
+		if !p.owns(s.owner) {
+			http.Error(w, "Session belongs to another user", http.StatusForbidden)
+			return
+		}
+	} else {
+		http.Error(w, "Only /hls/ and /file/ paths can be signed", http.StatusBadRequest)
+		return
+	}
+
+	ttl := cfg.Auth.Signing.TTL
+	if requestBody.TTL > 0 {
+		ttl = min(time.Duration(requestBody.TTL)*time.Second, cfg.Auth.Signing.MaxTTL)
+	}
+	expires := time.Now().Add(ttl).Truncate(time.Second)
+	ip := ""
+	if requestBody.BindIP || cfg.Auth.Signing.BindIP {
+		ip = clientIP(r)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"url":     cfg.PublicURL + urlPath + "?" + signQuery(scope, expires, ip).Encode(),
+		"expires": expires,
+	})
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withSigningKey replaces the URL signing key until the test ends
+func withSigningKey(t *testing.T, key string) {
+	old := signingKey
+	signingKey = []byte(key)
+	t.Cleanup(func() { signingKey = old })
+}
+
+func TestSignQuery(t *testing.T) {
+	withSigningKey(t, "test-key")
+	expires := time.Unix(4102444800, 0) // 2100-01-01
+
+	// HMAC-SHA256 of "scope\nexpires\nip", computed independently
+	tests := []struct {
+		scope, ip, want string
+	}{
+		{"/file/survey/", "", "expires=4102444800&scope=%2Ffile%2Fsurvey%2F&signature=J0j_2Wp4vQGIWXQWkqySTj2qe1ruRs5i9RZ61G1HFzU"},
+		{"/hls/abc/output.m3u8", "203.0.113.7", "bind=ip&expires=4102444800&scope=%2Fhls%2Fabc%2Foutput.m3u8&signature=TAu5kb8sv44vG2D1rztV8dWy1MwmBelV4DOR7t0ge2k"},
+	}
+	for _, tt := range tests {
+		if got := signQuery(tt.scope, expires, tt.ip).Encode(); got != tt.want {
+			t.Errorf("signQuery(%q, %q) = %s, want %s", tt.scope, tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestVerifySignature(t *testing.T) {
+	withSigningKey(t, "test-key")
+	future := time.Now().Add(time.Hour).Truncate(time.Second)
+	dir := signQuery("/file/survey/", future, "")
+	bound := signQuery("/hls/abc/output.m3u8", future, "203.0.113.7")
+	expired := signQuery("/file/survey/", time.Now().Add(-time.Second), "")
+
+	// with changes one query parameter of q
+	with := func(q url.Values, key, value string) string {
+		c := url.Values{}
+		for k, v := range q {
+			c[k] = v
+		}
+		if value == "" {
+			c.Del(key)
+		} else {
+			c.Set(key, value)
+		}
+		return c.Encode()
+	}
+	signingKey = []byte("other-key")
+	otherKey := signQuery("/file/survey/", future, "")
+	signingKey = []byte("test-key")
+
+	tests := []struct {
+		name, path, query, remote string
+		signed                    bool
+		err                       error
+	}{
+		{"unsigned", "/file/survey/metadata.json", "", "198.51.100.1:5000", false, nil},
+		{"file in scope", "/file/survey/metadata.json", dir.Encode(), "198.51.100.1:5000", true, nil},
+		{"nested file in scope", "/file/survey/a/b/octree.bin", dir.Encode(), "198.51.100.1:5000", true, nil},
+		{"scope itself", "/file/survey/", dir.Encode(), "198.51.100.1:5000", true, nil},
+		{"other dataset", "/file/surveyor/metadata.json", dir.Encode(), "198.51.100.1:5000", true, errSignatureInvalid},
+		{"scope without slash", "/file/survey", dir.Encode(), "198.51.100.1:5000", true, errSignatureInvalid},
+		{"widened scope", "/file/other/metadata.json", with(dir, sigScope, "/file/"), "198.51.100.1:5000", true, errSignatureInvalid},
+		{"extended expiry", "/file/survey/metadata.json", with(dir, sigExpires, "4102444800"), "198.51.100.1:5000", true, errSignatureInvalid},
+		{"tampered signature", "/file/survey/metadata.json", with(dir, sigSignature, strings.Repeat("A", 43)), "198.51.100.1:5000", true, errSignatureInvalid},
+		{"malformed expiry", "/file/survey/metadata.json", with(dir, sigExpires, "soon"), "198.51.100.1:5000", true, errSignatureInvalid},
+		{"other key", "/file/survey/metadata.json", otherKey.Encode(), "198.51.100.1:5000", true, errSignatureInvalid},
+		{"expired", "/file/survey/metadata.json", expired.Encode(), "198.51.100.1:5000", true, errSignatureExpired},
+		{"expired and tampered", "/file/survey/metadata.json", with(expired, sigSignature, "x"), "198.51.100.1:5000", true, errSignatureInvalid},
+		{"bound to client", "/hls/abc/output.m3u8", bound.Encode(), "203.0.113.7:6000", true, nil},
+		{"bound to another client", "/hls/abc/output.m3u8", bound.Encode(), "198.51.100.1:5000", true, errSignatureInvalid},
+		{"binding removed", "/hls/abc/output.m3u8", with(bound, sigBind, ""), "203.0.113.7:6000", true, errSignatureInvalid},
+		{"binding added", "/file/survey/metadata.json", with(dir, sigBind, "ip"), "198.51.100.1:5000", true, errSignatureInvalid},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", tt.path+"?"+tt.query, nil)
+		r.RemoteAddr = tt.remote
+		signed, expires, err := verifySignature(r, tt.path)
+		if signed != tt.signed || !errors.Is(err, tt.err) {
+			t.Errorf("%s: signed %v error %v, want %v and %v", tt.name, signed, err, tt.signed, tt.err)
+		}
+		if err == nil && signed && !expires.Equal(future) {
+			t.Errorf("%s: expires %v, want %v", tt.name, expires, future)
+		}
+	}
+}
+
+func TestCheckSignature(t *testing.T) {
+	withSigningKey(t, "test-key")
+	tests := []struct {
+		name, query string
+		signed, ok  bool
+		code        int
+		body        string
+	}{
+		{"unsigned", "", false, false, 200, ""},
+		{"valid", signQuery("/file/a/", time.Now().Add(time.Minute), "").Encode(), true, true, 200, ""},
+		{"expired", signQuery("/file/a/", time.Now().Add(-time.Minute), "").Encode(), true, false, 403, "Signed URL has expired\n"},
+		{"invalid", signQuery("/file/b/", time.Now().Add(time.Minute), "").Encode(), true, false, 403, "Invalid URL signature\n"},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		signed, _, ok := checkSignature(rec, httptest.NewRequest("GET", "/file/a/x?"+tt.query, nil), "/file/a/x")
+		if signed != tt.signed || ok != tt.ok || rec.Code != tt.code || rec.Body.String() != tt.body {
+			t.Errorf("%s: signed %v ok %v response %d %q", tt.name, signed, ok, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestSignPlaylist(t *testing.T) {
+	withSigningKey(t, "test-key")
+	expires := time.Now().Add(time.Minute).Truncate(time.Second)
+	playlist := "#EXTM3U\r\n" +
+		"#EXT-X-VERSION:7\r\n" +
+		`#EXT-X-MAP:URI="init.mp4",BYTERANGE="720@0"` + "\r\n" +
+		"#EXTINF:2.0,\r\n" +
+		"segment_000.m4s\r\n" +
+		"#EXTINF:2.0,\n" +
+		"../other/segment_001.m4s\n" +
+		"/hls/abc/absolute.m4s\n" +
+		"https://cdn.example.com/segment_002.m4s\n" +
+		"\n"
+	signed := string(signPlaylist([]byte(playlist), "/hls/abc", expires, "203.0.113.7"))
+
+	lines := strings.Split(signed, "\n")
+	q := func(scope string) string { return signQuery(scope, expires, "203.0.113.7").Encode() }
+	want := []string{
+		"#EXTM3U\r",
+		"#EXT-X-VERSION:7\r",
+		`#EXT-X-MAP:URI="init.mp4?` + q("/hls/abc/init.mp4") + `",BYTERANGE="720@0"`,
+		"#EXTINF:2.0,\r",
+		"segment_000.m4s?" + q("/hls/abc/segment_000.m4s"),
+		"#EXTINF:2.0,",
+		"../other/segment_001.m4s?" + q("/hls/other/segment_001.m4s"),
+		"/hls/abc/absolute.m4s",
+		"https://cdn.example.com/segment_002.m4s",
+		"",
+		"",
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("signed playlist has %d lines, want %d:\n%s", len(lines), len(want), signed)
+	}
+	for i := range want {
+		if lines[i] != want[i] {
+			t.Errorf("line %d = %q, want %q", i, lines[i], want[i])
+		}
+	}
+
+	// every signed URI verifies for the segment it names, from that client only
+	uri := lines[4]
+	for remote, valid := range map[string]bool{"203.0.113.7:1": true, "198.51.100.1:1": false} {
+		r := httptest.NewRequest("GET", "/hls/abc/"+uri, nil)
+		r.RemoteAddr = remote
+		if _, _, err := verifySignature(r, "/hls/abc/segment_000.m4s"); (err == nil) != valid {
+			t.Errorf("segment from %s: %v", remote, err)
+		}
+	}
+}
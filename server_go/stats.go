@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// statsFile is the cache written next to metadata.json
+const statsFile = "stats.json"
+
+// histogramBins is the number of bins of the elevation and intensity histograms
+const histogramBins = 64
+
+// attributeStats summarises one element of a Potree attribute
+type attributeStats struct {
+	Name  string  `json:"name"`
+	Count int64   `json:"count"`
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+	Mean  float64 `json:"mean"`
+}
+
+// histogram has equal width bins between Min and Max
+type histogram struct {
+	Min    float64 `json:"min"`
+	Max    float64 `json:"max"`
+	Counts []int64 `json:"counts"`
+}
+
+func newHistogram(min, max float64) *histogram {
+	if max <= min {
+		max = min + 1
+	}
+	return &histogram{Min: min, Max: max, Counts: make([]int64, histogramBins)}
+}
+
+func (h *histogram) add(v float64) {
+	i := int((v - h.Min) / (h.Max - h.Min) * histogramBins)
+	h.Counts[max(0, min(histogramBins-1, i))]++
+}
+
+// percentile returns the value below which fraction q of the samples fall
+func (h *histogram) percentile(q float64) float64 {
+	var total int64
+	for _, c := range h.Counts {
+		total += c
+	}
+	target := int64(q * float64(total))
+	var acc int64
+	width := (h.Max - h.Min) / histogramBins
+	for i, c := range h.Counts {
+		if acc+c > target {
+			// interpolate linearly inside the bin
+			return h.Min + (float64(i)+float64(target-acc)/float64(c))*width
+		}
+		acc += c
+	}
+	return h.Max
+}
+
+// datasetStats is the response of GET /datasets/{name}/stats
+type datasetStats struct {
+	Dataset    string           `json:"dataset"`
+	Points     int64            `json:"points"`
+	Computed   time.Time        `json:"computed"`
+	Attributes []attributeStats `json:"attributes"`
+	Elevation  *histogram       `json:"elevationHistogram"`
+	Intensity  *histogram       `json:"intensityHistogram,omitempty"`
+
+	// ElevationRange is the 2nd to 98th percentile, suitable for gradient coloring
+	ElevationRange [2]float64 `json:"elevationRange"`
+
+	Classifications map[int]int64 `json:"classificationCounts"`
+	Returns         map[int]int64 `json:"returnNumberCounts"`
+
+	// Density is points per square unit over the XY extent; Spacing is the
+	// average distance between points implied by that density
+	Area    float64 `json:"area"`
+	Density float64 `json:"density"`
+	Spacing float64 `json:"spacing"`
+}
+
+// computeStats reads every point of the dataset once
+func computeStats(d *potreeDataset) (*datasetStats, error) {
+	ext := d.extent()
+	s := &datasetStats{
+		Dataset:         d.name,
+		Computed:        time.Now().UTC(),
+		Elevation:       newHistogram(ext.Min[2], ext.Max[2]),
+		Classifications: map[int]int64{},
+		Returns:         map[int]int64{},
+	}
+
+	// one accumulator per attribute element, e.g. rgb has three
+	type acc struct {
+		attr   *potreeAttribute
+		offset int
+		elem   int
+		stats  attributeStats
+		sum    float64
+	}
+	var accs []*acc
+	for i := range d.meta.Attributes {
+		a := &d.meta.Attributes[i]
+		if a.Name == "position" {
+			continue
+		}
+		for e := 0; e < a.NumElements; e++ {
+			name := a.Name
+			if a.NumElements > 1 {
+				name = a.Name + "[" + strconv.Itoa(e) + "]"
+			}
+			accs = append(accs, &acc{attr: a, offset: d.attrOffset[a.Name], elem: e, stats: attributeStats{Name: name, Min: math.Inf(1), Max: math.Inf(-1)}})
+		}
+	}
+	var position [3]*acc
+	for i, axis := range []string{"x", "y", "z"} {
+		position[i] = &acc{stats: attributeStats{Name: axis, Min: math.Inf(1), Max: math.Inf(-1)}}
+	}
+
+	if a, _, ok := d.attribute("intensity"); ok {
+		lo, hi := 0.0, 65535.0
+		if len(a.Min) == 1 && len(a.Max) == 1 {
+			lo, hi = a.Min[0], a.Max[0]
+		}
+		s.Intensity = newHistogram(lo, hi)
+	}
+	_, hasClassification := d.attrOffset["classification"]
+	_, hasReturns := d.attrOffset["return number"]
+
+	octree, err := d.openOctree()
+	if err != nil {
+		return nil, err
+	}
+	defer octree.Close()
+
+	for _, n := range d.nodes(-1, nil) {
+		err := octree.forEachPoint(n, func(p *point, rec []byte) error {
+			s.Points++
+			for i, v := range [3]float64{p.X, p.Y, p.Z} {
+				position[i].sum += v
+				position[i].stats.Min = math.Min(position[i].stats.Min, v)
+				position[i].stats.Max = math.Max(position[i].stats.Max, v)
+			}
+			s.Elevation.add(p.Z)
+			if s.Intensity != nil {
+				s.Intensity.add(float64(p.Intensity))
+			}
+			if hasClassification {
+				s.Classifications[int(p.Classification)]++
+			}
+			if hasReturns {
+				s.Returns[int(p.ReturnNumber)]++
+			}
+			for _, a := range accs {
+				v := a.attr.value(rec[a.offset:], a.elem)
+				a.sum += v
+				a.stats.Min = math.Min(a.stats.Min, v)
+				a.stats.Max = math.Max(a.stats.Max, v)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if s.Points == 0 {
+		return nil, errors.New("dataset has no points")
+	}
+
+	for _, a := range append(position[:], accs...) {
+		a.stats.Count = s.Points
+		a.stats.Mean = a.sum / float64(s.Points)
+		s.Attributes = append(s.Attributes, a.stats)
+	}
+	s.ElevationRange = [2]float64{s.Elevation.percentile(0.02), s.Elevation.percentile(0.98)}
+
+	s.Area = (ext.Max[0] - ext.Min[0]) * (ext.Max[1] - ext.Min[1])
+	if s.Area > 0 {
+		s.Density = float64(s.Points) / s.Area
+		s.Spacing = 1 / math.Sqrt(s.Density)
+	}
+	return s, nil
+}
+
+// loadStats returns the cached stats if they are newer than the octree
+func loadStats(d *potreeDataset) (*datasetStats, bool) {
+	cache, err := os.Stat(filepath.Join(d.dir, statsFile))
+	if err != nil {
+		return nil, false
+	}
+	for _, f := range []string{"metadata.json", "octree.bin"} {
+		if src, err := os.Stat(filepath.Join(d.dir, f)); err != nil || src.ModTime().After(cache.ModTime()) {
+			return nil, false
+		}
+	}
+	raw, err := os.ReadFile(filepath.Join(d.dir, statsFile))
+	if err != nil {
+		return nil, false
+	}
+	var s datasetStats
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return nil, false
+	}
+	return &s, true
+}
+
+// datasetStatistics handles GET /datasets/{name}/stats; ?refresh=1 recomputes the cache
+func datasetStatistics(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	d, ok := openDatasetForRequest(w, name)
+	if !ok {
+		return
+	}
+
+	s, cached := loadStats(d)
+	if !cached || r.URL.Query().Get("refresh") != "" {
+		var err error
+		s, err = computeStats(d)
+		if err != nil {
+			http.Error(w, "Failed to compute statistics", http.StatusInternalServerError)
+			requestLog(r).Error("Error computing statistics", "error", err)
+			return
+		}
+		raw, _ := json.MarshalIndent(s, "", "\t")
+		if err := os.WriteFile(filepath.Join(d.dir, statsFile), raw, 0o644); err != nil {
+			requestLog(r).Error("Error caching statistics", "error", err)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
+
+// cachedElevationRange returns the cached elevation range of a dataset
+// served from /file/, or nil if none is cached
+func cachedElevationRange(pointCloudURL string) *[2]float64 {
+	name, ok := datasetNameFromURL(pointCloudURL)
+	if !ok {
+		return nil
+	}
+	d, err := openDataset(name)
+	if err != nil {
+		return nil
+	}
+	s, ok := loadStats(d)
+	if !ok {
+		return nil
+	}
+	return &s.ElevationRange
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestHistogramPercentile(t *testing.T) {
+	uniform := newHistogram(0, 64)
+	for i := 0; i < 64; i++ {
+		uniform.add(float64(i) + 0.5)
+	}
+	skewed := newHistogram(0, 64)
+	for i := 0; i < 10; i++ {
+		skewed.add(0.25)
+	}
+	skewed.add(63.5)
+	clamped := newHistogram(10, 74)
+	clamped.add(-100) // counted in the first bin
+	clamped.add(1000) // and in the last
+	flat := newHistogram(5, 5)
+	flat.add(5)
+
+	tests := []struct {
+		name string
+		h    *histogram
+		q    float64
+		want float64
+	}{
+		{"uniform median", uniform, 0.5, 32},
+		{"uniform 2nd percentile", uniform, 0.02, 1},
+		{"uniform minimum", uniform, 0, 0},
+		{"uniform maximum", uniform, 1, 64},
+		{"inside a bin", skewed, 0.25, 2.0 / 10},
+		{"last sample", skewed, 0.98, 63}, // 10 of 11 samples lie below bin 63
+		{"clamped low", clamped, 0, 10},
+		{"clamped high", clamped, 0.5, 73},
+		{"equal bounds", flat, 0.5, 5},
+		{"empty", newHistogram(1, 2), 0.5, 2},
+	}
+	for _, tt := range tests {
+		if got := tt.h.percentile(tt.q); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("%s: percentile(%v) = %v, want %v", tt.name, tt.q, got, tt.want)
+		}
+	}
+}
+
+func TestComputeStats(t *testing.T) {
+	withDataDir(t, "testdata")
+	d, err := openDataset("tiny")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := computeStats(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Points != 5 {
+		t.Errorf("points = %d, want 5", s.Points)
+	}
+	// elevations 1, 2, 6, 7 and 7
+	want := map[string][3]float64{
+		"x":              {1, 7, 4.2},
+		"y":              {1, 7, 4.2},
+		"z":              {1, 7, 4.6},
+		"intensity":      {100, 500, 300},
+		"classification": {1, 6, 3.4},
+	}
+	for _, a := range s.Attributes {
+		w, ok := want[a.Name]
+		if !ok {
+			t.Errorf("unexpected attribute %s", a.Name)
+			continue
+		}
+		delete(want, a.Name)
+		if a.Count != 5 || a.Min != w[0] || a.Max != w[1] || math.Abs(a.Mean-w[2]) > 1e-9 {
+			t.Errorf("%s = %+v, want min %v max %v mean %v", a.Name, a, w[0], w[1], w[2])
+		}
+	}
+	for name := range want {
+		t.Errorf("attribute %s is missing", name)
+	}
+	if c := s.Classifications; len(c) != 3 || c[1] != 1 || c[2] != 2 || c[6] != 2 {
+		t.Errorf("classifications = %v", c)
+	}
+	if s.Elevation.Min != 1 || s.Elevation.Max != 7 || s.Intensity.Min != 100 || s.Intensity.Max != 500 {
+		t.Errorf("histograms span %v-%v and %v-%v", s.Elevation.Min, s.Elevation.Max, s.Intensity.Min, s.Intensity.Max)
+	}
+	if r := s.ElevationRange; r[0] < 1 || r[0] > 1.1 || r[1] < 6.9 || r[1] > 7 {
+		t.Errorf("elevation range = %v, want about 1 to 7", r)
+	}
+	if s.Area != 36 || math.Abs(s.Density-5.0/36) > 1e-12 || math.Abs(s.Spacing-6/math.Sqrt(5)) > 1e-12 {
+		t.Errorf("area %v density %v spacing %v", s.Area, s.Density, s.Spacing)
+	}
+}
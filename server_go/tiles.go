@@ -0,0 +1,442 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// tileFormats maps a 3D Tiles content format to the tileset version that supports it.
+// glTF content needs 3D Tiles 1.1, the vendored Cesium only reads pnts.
+var tileFormats = map[string]string{
+	"pnts": "1.0",
+	"glb":  "1.1",
+}
+
+// tileset is the tileset.json of a 3D Tiles export
+type tileset struct {
+	Asset struct {
+		Version string `json:"version"`
+	} `json:"asset"`
+	GeometricError float64 `json:"geometricError"`
+	Root           *tile   `json:"root"`
+}
+
+type tile struct {
+	BoundingVolume struct {
+		Sphere [4]float64 `json:"sphere"`
+	} `json:"boundingVolume"`
+	GeometricError float64 `json:"geometricError"`
+	Refine         string  `json:"refine,omitempty"`
+	Content        *struct {
+		URI string `json:"uri"`
+	} `json:"content,omitempty"`
+	Children []*tile `json:"children,omitempty"`
+}
+
+// tileFrame maps dataset coordinates into the earth centred frame 3D Tiles
+// expects. Datasets without a usable CRS are tiled in their own coordinates.
+type tileFrame struct {
+	from, ecef *crs
+}
+
+func newTileFrame(d *potreeDataset) *tileFrame {
+	c, err := d.crs()
+	if err != nil || !c.Supported {
+		return &tileFrame{}
+	}
+	ecef, _ := epsgCRS(4978)
+	return &tileFrame{from: c, ecef: ecef}
+}
+
+func (f *tileFrame) apply(x, y, z float64) [3]float64 {
+	if f.from == nil {
+		return [3]float64{x, y, z}
+	}
+	lon, lat, h := f.from.toGeodetic(x, y, z)
+	x, y, z = f.ecef.fromGeodetic(lon, lat, h)
+	return [3]float64{x, y, z}
+}
+
+// sphere returns a bounding sphere of a box after mapping its corners into the frame
+func (f *tileFrame) sphere(b aabb) [4]float64 {
+	var corners [8][3]float64
+	var centre [3]float64
+	for i := range corners {
+		corners[i] = f.apply(
+			[2]float64{b.Min[0], b.Max[0]}[i>>2&1],
+			[2]float64{b.Min[1], b.Max[1]}[i>>1&1],
+			[2]float64{b.Min[2], b.Max[2]}[i&1])
+		for k := 0; k < 3; k++ {
+			centre[k] += corners[i][k] / 8
+		}
+	}
+	radius := 0.0
+	for _, c := range corners {
+		radius = math.Max(radius, math.Sqrt((c[0]-centre[0])*(c[0]-centre[0])+(c[1]-centre[1])*(c[1]-centre[1])+(c[2]-centre[2])*(c[2]-centre[2])))
+	}
+	return [4]float64{centre[0], centre[1], centre[2], radius}
+}
+
+// intersect clips a box to another, used to tighten the cubic octree bounds
+func (b aabb) intersect(o aabb) aabb {
+	for i := 0; i < 3; i++ {
+		b.Min[i] = math.Max(b.Min[i], o.Min[i])
+		b.Max[i] = math.Min(b.Max[i], o.Max[i])
+	}
+	return b
+}
+
+// node looks up an octree node by its Potree name, e.g. "r042"
+func (d *potreeDataset) node(name string) (*octreeNode, bool) {
+	rest, ok := strings.CutPrefix(name, "r")
+	if !ok {
+		return nil, false
+	}
+	n := d.root
+	for _, c := range rest {
+		if c < '0' || c > '7' || n.children[c-'0'] == nil {
+			return nil, false
+		}
+		n = n.children[c-'0']
+	}
+	return n, true
+}
+
+// buildTileset mirrors the octree as an additive tile tree; a tile's
+// geometric error is the spacing of its node, leaves have none
+func buildTileset(d *potreeDataset, frame *tileFrame, format string, maxLevel int) *tileset {
+	ext := d.extent()
+	var build func(n *octreeNode) *tile
+	build = func(n *octreeNode) *tile {
+		t := &tile{}
+		t.BoundingVolume.Sphere = frame.sphere(n.bounds.intersect(ext))
+		if n.numPoints > 0 {
+			t.Content = &struct {
+				URI string `json:"uri"`
+			}{n.name + "." + format}
+		}
+		for _, c := range n.children {
+			if c != nil && (maxLevel < 0 || c.level <= maxLevel) {
+				t.Children = append(t.Children, build(c))
+			}
+		}
+		if len(t.Children) > 0 {
+			t.GeometricError = d.spacingAt(n.level)
+		}
+		return t
+	}
+
+	ts := &tileset{GeometricError: d.spacingAt(-1), Root: build(d.root)}
+	ts.Asset.Version = tileFormats[format]
+	ts.Root.Refine = "ADD"
+	return ts
+}
+
+// tilePoints holds node positions relative to centre, and colors if the dataset has rgb
+type tilePoints struct {
+	centre    [3]float64
+	positions []float32
+	colors    []byte
+}
+
+func readTilePoints(octree *octreeReader, frame *tileFrame, n *octreeNode) (*tilePoints, error) {
+	_, hasRGB := octree.d.attrOffset["rgb"]
+	world := make([][3]float64, 0, n.numPoints)
+	tp := &tilePoints{}
+	err := octree.forEachPoint(n, func(p *point, _ []byte) error {
+		world = append(world, frame.apply(p.X, p.Y, p.Z))
+		if hasRGB {
+			tp.colors = append(tp.colors, colorByte(p.R), colorByte(p.G), colorByte(p.B))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// float32 offsets from the node centre keep millimetre precision in ECEF
+	for _, p := range world {
+		for k := 0; k < 3; k++ {
+			tp.centre[k] += p[k] / float64(len(world))
+		}
+	}
+	tp.positions = make([]float32, 0, 3*len(world))
+	for _, p := range world {
+		tp.positions = append(tp.positions, float32(p[0]-tp.centre[0]), float32(p[1]-tp.centre[1]), float32(p[2]-tp.centre[2]))
+	}
+	return tp, nil
+}
+
+// padTo appends pad bytes until len(b)+offset is a multiple of n
+func padTo(b []byte, offset, n int, pad byte) []byte {
+	for (offset+len(b))%n != 0 {
+		b = append(b, pad)
+	}
+	return b
+}
+
+// encodePnts writes a Point Cloud tile with an RTC_CENTER feature table
+func encodePnts(tp *tilePoints) ([]byte, error) {
+	count := len(tp.positions) / 3
+	features := map[string]interface{}{
+		"POINTS_LENGTH": count,
+		"RTC_CENTER":    tp.centre,
+		"POSITION":      map[string]int{"byteOffset": 0},
+	}
+	if tp.colors != nil {
+		features["RGB"] = map[string]int{"byteOffset": 12 * count}
+	}
+	const headerSize = 28
+	featureJSON, err := json.Marshal(features)
+	if err != nil {
+		return nil, err
+	}
+	featureJSON = padTo(featureJSON, headerSize, 8, ' ')
+
+	var bin bytes.Buffer
+	binary.Write(&bin, binary.LittleEndian, tp.positions)
+	bin.Write(tp.colors)
+	featureBin := padTo(bin.Bytes(), 0, 8, 0)
+
+	out := make([]byte, headerSize, headerSize+len(featureJSON)+len(featureBin))
+	copy(out, "pnts")
+	le := binary.LittleEndian
+	le.PutUint32(out[4:], 1)
+	le.PutUint32(out[8:], uint32(headerSize+len(featureJSON)+len(featureBin)))
+	le.PutUint32(out[12:], uint32(len(featureJSON)))
+	le.PutUint32(out[16:], uint32(len(featureBin)))
+	// no batch table
+	out = append(out, featureJSON...)
+	return append(out, featureBin...), nil
+}
+
+// glTF constants
+const (
+	gltfFloat         = 5126
+	gltfUnsignedByte  = 5121
+	gltfArrayBuffer   = 34962
+	gltfModePoints    = 0
+	glbChunkJSON      = 0x4E4F534A
+	glbChunkBIN       = 0x004E4942
+	glbHeaderSize     = 12
+	glbChunkHeaderLen = 8
+)
+
+// encodeGLB writes a binary glTF with a single POINTS primitive. glTF is
+// y-up and 3D Tiles rotates it to z-up, so positions are stored as (x, z, -y).
+func encodeGLB(tp *tilePoints) ([]byte, error) {
+	count := len(tp.positions) / 3
+	minPos := [3]float32{float32(math.Inf(1)), float32(math.Inf(1)), float32(math.Inf(1))}
+	maxPos := [3]float32{float32(math.Inf(-1)), float32(math.Inf(-1)), float32(math.Inf(-1))}
+	yUp := make([]float32, len(tp.positions))
+	for i := 0; i < count; i++ {
+		x, y, z := tp.positions[3*i], tp.positions[3*i+1], tp.positions[3*i+2]
+		yUp[3*i], yUp[3*i+1], yUp[3*i+2] = x, z, -y
+		for k := 0; k < 3; k++ {
+			minPos[k] = min(minPos[k], yUp[3*i+k])
+			maxPos[k] = max(maxPos[k], yUp[3*i+k])
+		}
+	}
+
+	var bin bytes.Buffer
+	binary.Write(&bin, binary.LittleEndian, yUp)
+	attributes := map[string]int{"POSITION": 0}
+	accessors := []map[string]interface{}{{
+		"bufferView": 0, "componentType": gltfFloat, "count": count, "type": "VEC3",
+		"min": minPos, "max": maxPos,
+	}}
+	bufferViews := []map[string]interface{}{{
+		"buffer": 0, "byteOffset": 0, "byteLength": bin.Len(), "target": gltfArrayBuffer,
+	}}
+	if tp.colors != nil {
+		// vertex attributes must be 4 byte aligned, so colors are RGBA
+		offset := bin.Len()
+		for i := 0; i < count; i++ {
+			bin.Write(tp.colors[3*i : 3*i+3])
+			bin.WriteByte(255)
+		}
+		attributes["COLOR_0"] = 1
+		accessors = append(accessors, map[string]interface{}{
+			"bufferView": 1, "componentType": gltfUnsignedByte, "normalized": true, "count": count, "type": "VEC4",
+		})
+		bufferViews = append(bufferViews, map[string]interface{}{
+			"buffer": 0, "byteOffset": offset, "byteLength": 4 * count, "target": gltfArrayBuffer,
+		})
+	}
+	binChunk := padTo(bin.Bytes(), 0, 4, 0)
+
+	doc := map[string]interface{}{
+		"asset":  map[string]string{"version": "2.0", "generator": "gis-poc"},
+		"scene":  0,
+		"scenes": []map[string]interface{}{{"nodes": []int{0}}},
+		"nodes": []map[string]interface{}{{
+			"mesh":        0,
+			"translation": [3]float64{tp.centre[0], tp.centre[2], -tp.centre[1]},
+		}},
+		"meshes": []map[string]interface{}{{
+			"primitives": []map[string]interface{}{{"attributes": attributes, "mode": gltfModePoints}},
+		}},
+		"accessors":   accessors,
+		"bufferViews": bufferViews,
+		"buffers":     []map[string]int{{"byteLength": len(binChunk)}},
+	}
+	jsonChunk, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	jsonChunk = padTo(jsonChunk, 0, 4, ' ')
+
+	total := glbHeaderSize + 2*glbChunkHeaderLen + len(jsonChunk) + len(binChunk)
+	out := make([]byte, 0, total)
+	le := binary.LittleEndian
+	out = append(out, "glTF"...)
+	out = le.AppendUint32(out, 2)
+	out = le.AppendUint32(out, uint32(total))
+	out = le.AppendUint32(out, uint32(len(jsonChunk)))
+	out = le.AppendUint32(out, glbChunkJSON)
+	out = append(out, jsonChunk...)
+	out = le.AppendUint32(out, uint32(len(binChunk)))
+	out = le.AppendUint32(out, glbChunkBIN)
+	return append(out, binChunk...), nil
+}
+
+// encodeTile reads a node and encodes it as pnts or glb content
+func encodeTile(octree *octreeReader, frame *tileFrame, n *octreeNode, format string) ([]byte, error) {
+	tp, err := readTilePoints(octree, frame, n)
+	if err != nil {
+		return nil, err
+	}
+	if format == "glb" {
+		return encodeGLB(tp)
+	}
+	return encodePnts(tp)
+}
+
+// export3DTiles handles POST /datasets/{name}/3dtiles and starts a conversion job
+func export3DTiles(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+
+	var requestBody struct {
+		Format string `json:"format"` // "pnts" (default) or "glb"
+		LOD    *int   `json:"lod"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	format := requestBody.Format
+	if format == "" {
+		format = "pnts"
+	}
+	if _, ok := tileFormats[format]; !ok {
+		http.Error(w, "Unsupported format, use pnts or glb", http.StatusBadRequest)
+		return
+	}
+	maxLevel := -1
+	if requestBody.LOD != nil {
+		maxLevel = *requestBody.LOD
+	}
+
+	d, ok := openDatasetForRequest(w, name)
+	if !ok {
+		return
+	}
+
+	j := startJob("3dtiles", name, func(ctx context.Context, dir string) ([]string, error) {
+		frame := newTileFrame(d)
+		if frame.from == nil {
+			jobLogf(ctx, "Exporting %s to 3D Tiles in local coordinates, it has no usable CRS", name)
+		}
+		octree, err := d.openOctree()
+		if err != nil {
+			return nil, err
+		}
+		defer octree.Close()
+
+		outputs := []string{"tileset.json"}
+		nodes := d.nodes(maxLevel, nil)
+		for i, n := range nodes {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			reportProgress(ctx, i, len(nodes))
+			content, err := encodeTile(octree, frame, n, format)
+			if err != nil {
+				return nil, err
+			}
+			file := n.name + "." + format
+			if err := os.WriteFile(filepath.Join(dir, file), content, 0o644); err != nil {
+				return nil, err
+			}
+			outputs = append(outputs, file)
+		}
+
+		raw, err := json.Marshal(buildTileset(d, frame, format, maxLevel))
+		if err != nil {
+			return nil, err
+		}
+		return outputs, os.WriteFile(filepath.Join(dir, "tileset.json"), raw, 0o644)
+	})
+	writeJob(w, http.StatusAccepted, j)
+}
+
+// serve3DTiles handles GET /datasets/{name}/3dtiles/{file}, generating
+// tileset.json (?format=pnts|glb) and node content on the fly
+func serve3DTiles(w http.ResponseWriter, r *http.Request) {
+	name, file := r.PathValue("name"), r.PathValue("file")
+
+	d, ok := openDatasetForRequest(w, name)
+	if !ok {
+		return
+	}
+	frame := newTileFrame(d)
+
+	if file == "tileset.json" {
+		format := r.URL.Query().Get("format")
+		if format == "" {
+			format = "pnts"
+		}
+		if _, ok := tileFormats[format]; !ok {
+			http.Error(w, "Unsupported format, use pnts or glb", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(buildTileset(d, frame, format, -1))
+		return
+	}
+
+	nodeName, format, _ := strings.Cut(file, ".")
+	n, ok := d.node(nodeName)
+	if _, supported := tileFormats[format]; !ok || !supported || n.numPoints == 0 {
+		http.Error(w, "Tile not found", http.StatusNotFound)
+		return
+	}
+
+	octree, err := d.openOctree()
+	if err != nil {
+		http.Error(w, "Failed to open octree", http.StatusInternalServerError)
+		requestLog(r).Error("Error opening octree", "error", err)
+		return
+	}
+	defer octree.Close()
+
+	content, err := encodeTile(octree, frame, n, format)
+	if err != nil {
+		http.Error(w, "Failed to encode tile", http.StatusInternalServerError)
+		requestLog(r).Error("Error encoding tile", "tile", file, "error", err)
+		return
+	}
+	contentType := "application/octet-stream"
+	if format == "glb" {
+		contentType = "model/gltf-binary"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Write(content)
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+)
+
+// plane is z = A*x + B*y + C
+type plane struct {
+	A float64 `json:"a"`
+	B float64 `json:"b"`
+	C float64 `json:"c"`
+}
+
+func (p plane) z(x, y float64) float64 {
+	return p.A*x + p.B*y + p.C
+}
+
+// fitPlane fits a least squares plane through the samples
+func fitPlane(samples [][3]float64) (plane, error) {
+	if len(samples) < 3 {
+		return plane{}, errors.New("not enough perimeter samples to fit a plane")
+	}
+	// centre the samples to keep the normal equations well conditioned
+	var cx, cy, cz float64
+	for _, s := range samples {
+		cx += s[0]
+		cy += s[1]
+		cz += s[2]
+	}
+	n := float64(len(samples))
+	cx, cy, cz = cx/n, cy/n, cz/n
+
+	var sxx, sxy, syy, sxz, syz float64
+	for _, s := range samples {
+		x, y, z := s[0]-cx, s[1]-cy, s[2]-cz
+		sxx += x * x
+		sxy += x * y
+		syy += y * y
+		sxz += x * z
+		syz += y * z
+	}
+	det := sxx*syy - sxy*sxy
+	if math.Abs(det) < 1e-12 {
+		return plane{}, errors.New("perimeter samples are collinear")
+	}
+	a := (sxz*syy - syz*sxy) / det
+	b := (syz*sxx - sxz*sxy) / det
+	return plane{A: a, B: b, C: cz - a*cx - b*cy}, nil
+}
+
+// distanceToPolygonEdge returns the distance from a point to the polygon boundary
+func distanceToPolygonEdge(poly [][2]float64, x, y float64) float64 {
+	best := math.Inf(1)
+	for i, j := 0, len(poly)-1; i < len(poly); j, i = i, i+1 {
+		ax, ay := poly[j][0], poly[j][1]
+		dx, dy := poly[i][0]-ax, poly[i][1]-ay
+		t := 0.0
+		if l2 := dx*dx + dy*dy; l2 > 0 {
+			t = math.Max(0, math.Min(1, ((x-ax)*dx+(y-ay)*dy)/l2))
+		}
+		best = math.Min(best, math.Hypot(x-ax-t*dx, y-ay-t*dy))
+	}
+	return best
+}
+
+// computeVolume handles POST /datasets/{name}/volume
+func computeVolume(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+
+	var requestBody struct {
+		Polygon   [][2]float64 `json:"polygon"`
+		Reference struct {
+			Type      string  `json:"type"` // "elevation", "bestFit" or "lowestPerimeter"
+			Elevation float64 `json:"elevation"`
+		} `json:"reference"`
+		CellSize float64 `json:"cellSize"`
+		LOD      *int    `json:"lod"`
+		// CRS of the polygon vertices, e.g. "EPSG:4326"; the dataset CRS if empty
+		CRS string `json:"crs"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	refType := requestBody.Reference.Type
+	if refType != "elevation" && refType != "bestFit" && refType != "lowestPerimeter" {
+		http.Error(w, "reference type must be elevation, bestFit or lowestPerimeter", http.StatusBadRequest)
+		return
+	}
+	if requestBody.Polygon == nil {
+		http.Error(w, "polygon is required", http.StatusBadRequest)
+		return
+	}
+	if requestBody.CellSize < 0 {
+		http.Error(w, "cellSize must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	d, ok := openDatasetForRequest(w, name)
+	if !ok {
+		return
+	}
+
+	if err := d.localizeXY(requestBody.CRS, requestBody.Polygon); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	reg, err := newRegion(nil, requestBody.Polygon, nil, d.bounds())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	maxLevel := -1
+	if requestBody.LOD != nil {
+		maxLevel = *requestBody.LOD
+	}
+	cellSize := requestBody.CellSize
+	if cellSize == 0 {
+		// default to a few times the spacing of the finest level that is read
+		depth := d.meta.Hierarchy.Depth
+		if maxLevel >= 0 && maxLevel < depth {
+			depth = maxLevel
+		}
+		cellSize = 2 * d.spacingAt(depth)
+	}
+
+	cols := int(math.Ceil((reg.bounds.Max[0]-reg.bounds.Min[0])/cellSize)) + 1
+	rows := int(math.Ceil((reg.bounds.Max[1]-reg.bounds.Min[1])/cellSize)) + 1
+	if cols*rows > maxRasterCells {
+		http.Error(w, "Polygon is too large for cellSize", http.StatusBadRequest)
+		return
+	}
+	surface := newGrid(cols, rows, reg.bounds.Min[0], reg.bounds.Min[1]+float64(rows)*cellSize, cellSize, rasterNoData)
+
+	// The surface is the mean elevation per cell; the maximum would bias
+	// volumes upwards on slopes by up to half a cell of rise
+	counts := make([]uint32, cols*rows)
+	err = d.forEachPointIn(r.Context(), reg, maxLevel, func(p *point) error {
+		col, row, ok := surface.cell(p.X, p.Y)
+		if !ok {
+			return nil
+		}
+		i := row*cols + col
+		counts[i]++
+		if counts[i] == 1 {
+			surface.values[i] = float32(p.Z)
+		} else {
+			surface.values[i] += (float32(p.Z) - surface.values[i]) / float32(counts[i])
+		}
+		return nil
+	})
+	if err != nil {
+		http.Error(w, "Failed to compute volume", http.StatusInternalServerError)
+		requestLog(r).Error("Error computing volume", "error", err)
+		return
+	}
+
+	// Only cells whose centre lies inside the polygon count towards the volume
+	type cell struct{ col, row int }
+	var inside []cell
+	emptyCells := 0
+	for row := 0; row < rows; row++ {
+		for col := 0; col < cols; col++ {
+			x, y := surface.centre(col, row)
+			if !pointInPolygon(reg.polygon, x, y) {
+				continue
+			}
+			inside = append(inside, cell{col, row})
+			if surface.at(col, row) == rasterNoData {
+				emptyCells++
+			}
+		}
+	}
+	if len(inside) == 0 || emptyCells == len(inside) {
+		http.Error(w, "No points inside polygon", http.StatusUnprocessableEntity)
+		return
+	}
+	fillGaps(surface, "idw", 3)
+
+	var base plane
+	switch refType {
+	case "elevation":
+		base = plane{C: requestBody.Reference.Elevation}
+	case "bestFit", "lowestPerimeter":
+		var samples [][3]float64
+		for _, c := range inside {
+			x, y := surface.centre(c.col, c.row)
+			z := surface.at(c.col, c.row)
+			if z != rasterNoData && distanceToPolygonEdge(reg.polygon, x, y) <= cellSize {
+				samples = append(samples, [3]float64{x, y, float64(z)})
+			}
+		}
+		if refType == "bestFit" {
+			base, err = fitPlane(samples)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+				return
+			}
+			break
+		}
+		if len(samples) == 0 {
+			http.Error(w, "No points along the polygon perimeter", http.StatusUnprocessableEntity)
+			return
+		}
+		base.C = math.Inf(1)
+		for _, s := range samples {
+			base.C = math.Min(base.C, s[2])
+		}
+	}
+
+	cellArea := cellSize * cellSize
+	var cut, fill, area float64
+	unfilled := 0
+	for _, c := range inside {
+		z := surface.at(c.col, c.row)
+		if z == rasterNoData {
+			unfilled++
+			continue
+		}
+		x, y := surface.centre(c.col, c.row)
+		dz := float64(z) - base.z(x, y)
+		if dz > 0 {
+			cut += dz * cellArea
+		} else {
+			fill -= dz * cellArea
+		}
+		area += cellArea
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"cut":      cut,
+		"fill":     fill,
+		"net":      cut - fill,
+		"area":     area,
+		"cellSize": cellSize,
+		"cells":    len(inside),
+		// cells without points that were interpolated, and those left empty
+		"filledCells": emptyCells - unfilled,
+		"emptyCells":  unfilled,
+		"reference": map[string]interface{}{
+			"type":  refType,
+			"plane": base,
+		},
+	})
+}
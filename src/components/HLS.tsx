@@ -1,105 +1,189 @@
-import React, { useEffect, useRef, useState } from "react";
-import Hls from "hls.js";
-
-const VideoStream = ({
-  pointCloudURL = "http://localhost:8080/file/panhala/metadata.json",
-}) => {
-  const videoRef = useRef<HTMLVideoElement | null>(null);
-  const [isStreaming, setIsStreaming] = useState(false);
-
-  const startStream = async () => {
-    try {
-      await fetch("http://localhost:8080/start", {
-        method: "POST",
-        headers: {
-          "Content-Type": "application/json",
-        },
-        body: JSON.stringify({
-          pointCloudUrl: pointCloudURL,
-          viewportHeight: videoRef.current?.height || 720,
-          viewportWidth: videoRef.current?.width || 1280,
-        }),
-      });
-      setIsStreaming(true);
-    } catch (error) {
-      console.error("Failed to start stream:", error);
-    }
-  };
-
-  const stopStream = async () => {
-    try {
-      await fetch("http://localhost:8080/stop", { method: "POST" });
-      setIsStreaming(false);
-    } catch (error) {
-      console.error("Failed to stop stream:", error);
-    }
-  };
-
-  useEffect(() => {
-    if (videoRef.current) {
-      const video = videoRef.current;
-      const checkFileExists = async (url: string): Promise<boolean> => {
-        try {
-          const response = await fetch(url, { method: "HEAD" });
-          return response.ok;
-        } catch (error) {
-          console.log("Error fetching file:", error);
-          return false;
-        }
-      };
-
-      const checkHlsFileExists = async (): Promise<boolean> => {
-        const url = `http://localhost:8080/hls/output.m3u8`;
-        const exists = await checkFileExists(url);
-        if (!exists) {
-          console.log("Waiting for HLS file to become available...");
-          await new Promise((resolve) => setTimeout(resolve, 4000));
-          return checkHlsFileExists();
-        }
-        return true;
-      };
-
-      checkHlsFileExists().then(() => {
-        if (video.canPlayType("application/vnd.apple.mpegurl")) {
-          video.src = `http://localhost:8080/hls/output.m3u8?nocache=${Date.now()}`;
-          video.load();
-          video.play();
-        } else if (Hls.isSupported()) {
-          const hls = new Hls();
-          hls.loadSource(
-            `http://localhost:8080/hls/output.m3u8?nocache=${Date.now()}`
-          );
-          hls.attachMedia(video);
-          hls.on(Hls.Events.MANIFEST_PARSED, () => {
-            video.play();
-          });
-        }
-      });
-    }
-  }, [isStreaming]);
-
-  return (
-    <div className="h-screen flex flex-col">
-      <h2>Live Stream</h2>
-      <video
-        ref={videoRef}
-        controls
-        autoPlay
-        muted
-        playsInline
-        width="1920"
-        height="1080"
-      />
-      <div>
-        <button onClick={startStream} disabled={isStreaming}>
-          Start Stream
-        </button>
-        <button onClick={stopStream} disabled={!isStreaming}>
-          Stop Stream
-        </button>
-      </div>
-    </div>
-  );
-};
-
-export default VideoStream;
+import React, { useEffect, useRef, useState } from "react";
+import Hls from "hls.js";
+
+// API key or bearer token for servers with authentication enabled
+const token: string | undefined = import.meta.env.VITE_API_TOKEN;
+const authHeaders: Record<string, string> = token
+  ? { Authorization: `Bearer ${token}` }
+  : {};
+// EventSource cannot send headers
+const withToken = (url: string) =>
+  token
+    ? `${url}${url.includes("?") ? "&" : "?"}access_token=${encodeURIComponent(
+        token
+      )}`
+    : url;
+
+const VideoStream = ({
+  pointCloudURL = "http://localhost:8080/file/panhala/metadata.json",
+}) => {
+  const videoRef = useRef<HTMLVideoElement | null>(null);
+  const [isStreaming, setIsStreaming] = useState(false);
+
+  const startStream = async () => {
+    try {
+      const response = await fetch("http://localhost:8080/start", {
+        method: "POST",
+        headers: {
+          "Content-Type": "application/json",
+          ...authHeaders,
+        },
+        body: JSON.stringify({
+          pointCloudUrl: pointCloudURL,
+          viewportHeight: videoRef.current?.height || 720,
+          viewportWidth: videoRef.current?.width || 1280,
+        }),
+      });
+      if (!response.ok) {
+        // 429 and 503 tell when the server expects to have room again
+        const retryAfter = response.headers.get("Retry-After");
+        console.error(
+          "Failed to start stream:",
+          await response.text(),
+          retryAfter ? `(retry in ${retryAfter}s)` : ""
+        );
+        return;
+      }
+      setIsStreaming(true);
+    } catch (error) {
+      console.error("Failed to start stream:", error);
+    }
+  };
+
+  const stopStream = async () => {
+    try {
+      await fetch("http://localhost:8080/stop", {
+        method: "POST",
+        headers: { "Content-Type": "application/json", ...authHeaders },
+        body: JSON.stringify({ session: session ?? "" }),
+      });
+      setIsStreaming(false);
+    } catch (error) {
+      console.error("Failed to stop stream:", error);
+    }
+  };
+
+  // Session events from the server tell us when the first segment exists,
+  // so the player attaches as soon as the stream is playable
+  const [session, setSession] = useState<string | null>(null);
+
+  useEffect(() => {
+    const events = new EventSource(
+      withToken("http://localhost:8080/events?type=session")
+    );
+    events.addEventListener("session", (message) => {
+      const { state, session, message: detail } = JSON.parse(
+        (message as MessageEvent).data
+      );
+      switch (state) {
+        case "segment-written":
+          setIsStreaming(true);
+          setSession(session);
+          break;
+        case "encoder-crashed":
+          console.error("Stream encoder crashed:", detail);
+          setIsStreaming(false);
+          setSession(null);
+          break;
+        case "stopped":
+        case "idle":
+          setIsStreaming(false);
+          setSession(null);
+          break;
+        default:
+          console.log("Stream session:", state);
+      }
+    });
+    return () => events.close();
+  }, []);
+
+  // the server stops sessions nobody watches, and a paused player fetches
+  // no segments, so the page reports that it is still open
+  useEffect(() => {
+    if (!session) {
+      return;
+    }
+    const heartbeat = setInterval(() => {
+      fetch(`http://localhost:8080/sessions/${session}/heartbeat`, {
+        method: "POST",
+        headers: authHeaders,
+      }).catch((error) => console.error("Heartbeat failed:", error));
+    }, 30000);
+    return () => clearInterval(heartbeat);
+  }, [session]);
+
+  useEffect(() => {
+    const video = videoRef.current;
+    if (!video || !session) {
+      return;
+    }
+    // the server marks playlists no-cache, so no cache busting is needed
+    const url = `http://localhost:8080/hls/${session}/output.m3u8`;
+    if (video.canPlayType("application/vnd.apple.mpegurl")) {
+      // the native player cannot send credentials, so it gets a signed
+      // playlist URL whose segment URIs the server signs as well
+      let cancelled = false;
+      const play = async () => {
+        let src = url;
+        if (token) {
+          const response = await fetch("http://localhost:8080/signed-urls", {
+            method: "POST",
+            headers: { "Content-Type": "application/json", ...authHeaders },
+            body: JSON.stringify({ path: `/hls/${session}/output.m3u8` }),
+          });
+          src = (await response.json()).url;
+        }
+        if (!cancelled) {
+          video.src = src;
+          video.load();
+          video.play();
+        }
+      };
+      play().catch((error) => console.error("Failed to play stream:", error));
+      return () => {
+        cancelled = true;
+        video.removeAttribute("src");
+        video.load();
+      };
+    } else if (Hls.isSupported()) {
+      const hls = new Hls({
+        xhrSetup: (xhr) => {
+          if (token) {
+            xhr.setRequestHeader("Authorization", `Bearer ${token}`);
+          }
+        },
+      });
+      hls.loadSource(url);
+      hls.attachMedia(video);
+      hls.on(Hls.Events.MANIFEST_PARSED, () => {
+        video.play();
+      });
+      return () => hls.destroy();
+    }
+  }, [session]);
+
+  return (
+    <div className="h-screen flex flex-col">
+      <h2>Live Stream</h2>
+      <video
+        ref={videoRef}
+        controls
+        autoPlay
+        muted
+        playsInline
+        width="1920"
+        height="1080"
+      />
+      <div>
+        <button onClick={startStream} disabled={isStreaming}>
+          Start Stream
+        </button>
+        <button onClick={stopStream} disabled={!isStreaming}>
+          Stop Stream
+        </button>
+      </div>
+    </div>
+  );
+};
+
+export default VideoStream;